@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"sort"
 	"strings"
 )
@@ -21,9 +22,101 @@ type Buckets interface {
 	Reset()
 }
 
+// CheckedBuckets report the counter overflows of inserts.
+type CheckedBuckets interface {
+	Buckets
+	// InsertNE is InsertN reporting counter overflows with ErrCountOverflow, see BucketsCfg.CountOverflow.
+	InsertNE(float64, uint64) error
+}
+
+// RemovableBuckets can take observations back out.
+type RemovableBuckets interface {
+	Buckets
+	// Remove takes an observation back out, see RemoveN.
+	Remove(float64) error
+	// RemoveN takes observations back out, e.g. the ones leaving a sliding window. Sum and moments are
+	// adjusted by the given value, so they stay exact when removing values which were inserted.
+	// Observations take their share of the weight of their bucket, see InsertWeighted.
+	// It fails with ErrCountUnderflow, leaving the buckets untouched, if they hold fewer observations.
+	RemoveN(float64, uint64) error
+}
+
+// IterableBuckets can be visited partially, stopping early or from a value range, or pulled with an Iterator.
+type IterableBuckets interface {
+	Buckets
+	// RangeWhile visits the buckets in ascending order as long as the callback returns true.
+	RangeWhile(func(Bucket) bool)
+	// ReverseRangeWhile visits the buckets in descending order as long as the callback returns true.
+	ReverseRangeWhile(func(Bucket) bool)
+	// RangeBetween visits in ascending order the buckets which values between lo and hi fall into,
+	// as long as the callback returns true.
+	RangeBetween(lo, hi float64, do func(Bucket) bool)
+	Iterator() *Iterator
+	ReverseIterator() *Iterator
+}
+
+// CompactableBuckets can release the memory of their layers.
+type CompactableBuckets interface {
+	Buckets
+	// ResetWith clears the buckets, keeping or releasing the layers as told by mode.
+	ResetWith(mode ResetMode)
+	// Compact drops the empty layers, so they neither hold memory nor get scanned any longer.
+	Compact()
+}
+
+// MemoryUsageBuckets report the memory they hold, which isn't part of Buckets so other
+// implementations don't have to.
+type MemoryUsageBuckets interface {
+	Buckets
+	// MemoryUsage returns an estimate of the bytes held, layers and counters included.
+	MemoryUsage() uint64
+}
+
+// ErrCountOverflow is returned when inserting would overflow a counter, see BucketsCfg.CountOverflow.
+var ErrCountOverflow = errors.New("count overflow")
+
+// ErrCountUnderflow is returned when removing more observations than the buckets hold.
+var ErrCountUnderflow = errors.New("count underflow")
+
+func countUnderflowError(f float64, count, held uint64) error {
+	return fmt.Errorf("remove %d observations of %g, only %d held: %w", count, f, held, ErrCountUnderflow)
+}
+
+// ResetMode tells ResetWith what to do with the layers.
+type ResetMode int
+
+const (
+	// ResetKeepLayers zeroes the layers but keeps them, so inserting the same range again doesn't allocate.
+	// This is what Reset does.
+	ResetKeepLayers ResetMode = iota
+	// ResetReleaseLayers drops the layers along with their memory.
+	ResetReleaseLayers
+)
+
 var (
 	_ Buckets = &UnSyncBuckets{}
 	_ Buckets = &SyncBuckets{}
+	_ Buckets = &SparseBuckets{}
+
+	_ CheckedBuckets = &UnSyncBuckets{}
+	_ CheckedBuckets = &SyncBuckets{}
+	_ CheckedBuckets = &SparseBuckets{}
+
+	_ RemovableBuckets = &UnSyncBuckets{}
+	_ RemovableBuckets = &SyncBuckets{}
+	_ RemovableBuckets = &SparseBuckets{}
+
+	_ IterableBuckets = &UnSyncBuckets{}
+	_ IterableBuckets = &SyncBuckets{}
+	_ IterableBuckets = &SparseBuckets{}
+
+	_ CompactableBuckets = &UnSyncBuckets{}
+	_ CompactableBuckets = &SyncBuckets{}
+	_ CompactableBuckets = &SparseBuckets{}
+
+	_ MemoryUsageBuckets = &UnSyncBuckets{}
+	_ MemoryUsageBuckets = &SyncBuckets{}
+	_ MemoryUsageBuckets = &SparseBuckets{}
 
 	emptyBuckets = [256]uint64{}
 )
@@ -34,12 +127,50 @@ type Bucket struct {
 }
 
 type Summary struct {
-	Min         LPFloat
-	Max         LPFloat
-	Avg         LPFloat
-	Sum         LPFloat
-	Total       uint64
+	Min   LPFloat
+	Max   LPFloat
+	Avg   LPFloat
+	Sum   LPFloat
+	Total uint64
+	// TotalWeight is the sum of the weights of the observations, only set by weighted buckets
+	// such as DecayingBuckets, whose Sum, Avg, moments and percentiles follow the weights.
+	TotalWeight float64
+	Variance    LPFloat // population variance
+	StdDev      LPFloat
+	Skewness    LPFloat
+	Kurtosis    LPFloat // excess kurtosis
+	// Underflow and Overflow count the observations collapsed out of the layers by BucketsCfg.MaxLayers.
+	// They are part of Total, Sum and the other statistics but have no bucket of their own: Min and
+	// Max become the exact extremes of the collapsed values, and percentiles falling into underflow
+	// or overflow report the largest collapsed value.
+	Underflow uint64
+	Overflow  uint64
+	// Zero counts the observations of the zero bucket, see BucketsCfg.ZeroThreshold.
+	Zero uint64
+	// Clamped tells that observations have been dropped or totals saturated on counter overflows,
+	// see BucketsCfg.CountOverflow.
+	Clamped bool
+	// NaN, PosInf and NegInf count the non-finite observations, which are not part of
+	// the other statistics unless BucketsCfg.KeepNonFinite is set.
+	NaN         uint64
+	PosInf      uint64
+	NegInf      uint64
 	Percentiles []PercentilePair
+	// Unit and UnitSize are set by InUnit: the values stay in recorded units
+	// and print divided by UnitSize, followed by Unit.
+	Unit     string
+	UnitSize float64
+}
+
+// InUnit returns the summary printing its values in a display unit worth size recorded units,
+// e.g. InUnit("ms", 1e6) for a summary of nanoseconds. The values are divided when printed so no
+// error is added to them, the variance by size^2. The counts, skewness and kurtosis are kept.
+func (s Summary) InUnit(unit string, size float64) Summary {
+	if !(size > 0) || math.IsInf(size, 1) {
+		panic(fmt.Errorf("invalid unit size %g: the size should be a positive finite number", size))
+	}
+	s.Unit, s.UnitSize = unit, size
+	return s
 }
 
 func makeSummary(p []float32) Summary {
@@ -49,6 +180,10 @@ func makeSummary(p []float32) Summary {
 		Avg:         _NaN,
 		Sum:         _Zero,
 		Total:       0,
+		Variance:    _NaN,
+		StdDev:      _NaN,
+		Skewness:    _NaN,
+		Kurtosis:    _NaN,
 		Percentiles: make([]PercentilePair, len(p)),
 	}
 	for i := range p {
@@ -58,18 +193,261 @@ func makeSummary(p []float32) Summary {
 	return s
 }
 
+// summaryBuilder computes a Summary from the layers and buckets fed in value order.
+type summaryBuilder struct {
+	summary       Summary
+	total         uint64
+	percentiles   []float32
+	percentileIdx int
+	sum           neumaierSum
+	moments       centralMoments
+	weighted      bool
+	totalWeight   float64
+}
+
+func newSummaryBuilder(percentilesCfg []float32, total uint64) *summaryBuilder {
+	if percentilesCfg == nil {
+		percentilesCfg = DefaultPercentilesCfg()
+	}
+	if err := CheckPercentilesCfg(percentilesCfg); err != nil {
+		panic(fmt.Errorf("invalid percentiles cfg %v: %s", percentilesCfg, err))
+	}
+	return &summaryBuilder{
+		summary:     makeSummary(percentilesCfg),
+		total:       total,
+		percentiles: percentilesCfg,
+	}
+}
+
+// newWeightedSummaryBuilder ranks the buckets by weight instead of count.
+func newWeightedSummaryBuilder(percentilesCfg []float32, total uint64, totalWeight float64) *summaryBuilder {
+	s := newSummaryBuilder(percentilesCfg, total)
+	s.weighted = true
+	s.totalWeight = totalWeight
+	return s
+}
+
+// addLayer adds the statistics of a layer, whose buckets weigh extra beyond their counts.
+func (s *summaryBuilder) addLayer(stats *layerStats, extra float64) {
+	s.addStats(stats.sum, stats.sumComp, stats.moments.centralWeight(float64(stats.count)+extra))
+}
+
+func (s *summaryBuilder) addStats(sum, sumComp float64, moments centralMoments) {
+	s.sum.add(sum)
+	s.sum.add(sumComp)
+	s.moments.merge(moments)
+}
+
+// addUnderflow must be called before the layers.
+func (s *summaryBuilder) addUnderflow(c *collapsedBucket) {
+	if c.count == 0 {
+		return
+	}
+	s.addCollapsed(c)
+	s.summary.Min = FromFloat64(c.min)
+	s.summary.Underflow = c.count
+}
+
+// addOverflow must be called after the layers.
+func (s *summaryBuilder) addOverflow(c *collapsedBucket) {
+	if c.count == 0 {
+		return
+	}
+	s.addCollapsed(c)
+	s.summary.Overflow = c.count
+}
+
+func (s *summaryBuilder) addNonFinite(c *nonFiniteCounts) {
+	s.summary.NaN = c.nan
+	s.summary.PosInf = c.posInf
+	s.summary.NegInf = c.negInf
+}
+
+func (s *summaryBuilder) addClamped(clamped bool) {
+	s.summary.Clamped = s.summary.Clamped || clamped
+}
+
+func (s *summaryBuilder) addCollapsed(c *collapsedBucket) {
+	s.sum.add(c.sum.sum)
+	s.sum.add(c.sum.comp)
+	s.moments.merge(c.moments)
+	if s.weighted {
+		s.rankWeight(FromFloat64(c.max), c.count, float64(c.count)+c.extra)
+	} else {
+		s.rank(FromFloat64(c.max), c.count)
+	}
+}
+
+func (s *summaryBuilder) addBucket(lpf LPFloat, count uint64) {
+	if lpf.ToFloat64() == 0 {
+		s.summary.Zero += count
+	}
+	s.rank(lpf, count)
+}
+
+// addWeightedBucket adds count observations of value lpf weighing weight altogether.
+func (s *summaryBuilder) addWeightedBucket(lpf LPFloat, count uint64, weight float64) {
+	if lpf.ToFloat64() == 0 {
+		s.summary.Zero += count
+	}
+	s.rankWeight(lpf, count, weight)
+}
+
+// rankWeight is rank for weighted summaries, where percentiles follow the weights.
+func (s *summaryBuilder) rankWeight(lpf LPFloat, count uint64, weight float64) {
+	summary := &s.summary
+	if summary.Total == 0 {
+		summary.Min = lpf
+	}
+	summary.Total = s.addTotal(summary.Total, count)
+	summary.TotalWeight += weight
+	summary.Max = lpf
+	for s.percentileIdx < len(s.percentiles) &&
+		summary.TotalWeight*100 >= s.totalWeight*float64(s.percentiles[s.percentileIdx]) {
+		summary.Percentiles[s.percentileIdx].LessThan = lpf
+		s.percentileIdx++
+	}
+}
+
+// rank places count observations of value lpf after the ones already added.
+func (s *summaryBuilder) rank(lpf LPFloat, count uint64) {
+	summary := &s.summary
+	if summary.Total == 0 {
+		summary.Min = lpf
+	}
+	summary.Total = s.addTotal(summary.Total, count)
+	if summary.Total == s.total {
+		summary.Max = lpf
+	}
+	for s.percentileIdx < len(s.percentiles) &&
+		float64(summary.Total)*100 >= float64(s.total)*float64(s.percentiles[s.percentileIdx]) {
+		summary.Percentiles[s.percentileIdx].LessThan = lpf
+		s.percentileIdx++
+	}
+}
+
+// addTotal saturates the running total, as Total does with BucketsCfg.CountOverflow.
+func (s *summaryBuilder) addTotal(total, count uint64) uint64 {
+	if sum := total + count; sum >= total {
+		return sum
+	}
+	s.summary.Clamped = true
+	return math.MaxUint64
+}
+
+func (s *summaryBuilder) build() Summary {
+	s.summary.Sum = statistic(s.sum.value())
+	if s.weighted {
+		s.summary.TotalWeight = s.totalWeight
+		s.summary.Avg = statistic(s.sum.value() / s.totalWeight)
+	} else {
+		s.summary.Avg = statistic(s.sum.value() / float64(s.summary.Total))
+	}
+	s.moments.fill(&s.summary)
+	return s.summary
+}
+
+// statistic is FromFloat64 folding NaNs, whose signs depend on the platform and on the order
+// of the operations, into NaN().
+func statistic(f float64) LPFloat {
+	if math.IsNaN(f) {
+		return _NaN
+	}
+	return FromFloat64(f)
+}
+
 func (s Summary) String() string {
 	buf := bytes.NewBuffer(nil)
-	_, _ = fmt.Fprintf(buf, "Summary{Total: %d, Sum: %v, Avg: %v, Max: %v, Min: %v, Percentiles: %v}",
-		s.Total, s.Sum, s.Avg, s.Max, s.Min, s.Percentiles)
+	_, _ = fmt.Fprintf(buf, "Summary{Total: %d, ", s.Total)
+	if s.TotalWeight != 0 {
+		_, _ = fmt.Fprintf(buf, "TotalWeight: %g, ", s.TotalWeight)
+	}
+	u, u2 := s.units()
+	_, _ = fmt.Fprintf(buf, "Sum: %v%s, Avg: %v%s, Max: %v%s, Min: %v%s, "+
+		"Variance: %v%s, StdDev: %v%s, Skewness: %v, Kurtosis: %v, ",
+		s.inUnit(s.Sum, 1), u, s.inUnit(s.Avg, 1), u, s.inUnit(s.Max, 1), u, s.inUnit(s.Min, 1), u,
+		s.inUnit(s.Variance, 2), u2, s.inUnit(s.StdDev, 1), u, s.Skewness, s.Kurtosis)
+	if s.Underflow != 0 || s.Overflow != 0 {
+		_, _ = fmt.Fprintf(buf, "Underflow: %d, Overflow: %d, ", s.Underflow, s.Overflow)
+	}
+	if s.Zero != 0 {
+		_, _ = fmt.Fprintf(buf, "Zero: %d, ", s.Zero)
+	}
+	if s.Clamped {
+		_, _ = fmt.Fprintf(buf, "Clamped: true, ")
+	}
+	if s.NaN != 0 || s.PosInf != 0 || s.NegInf != 0 {
+		_, _ = fmt.Fprintf(buf, "NaN: %d, +Inf: %d, -Inf: %d, ", s.NaN, s.PosInf, s.NegInf)
+	}
+	if s.UnitSize == 0 {
+		_, _ = fmt.Fprintf(buf, "Percentiles: %v}", s.Percentiles)
+	} else {
+		_, _ = fmt.Fprintf(buf, "Percentiles: %s}", s.percentilesInUnit("%v"))
+	}
 	return buf.String()
 }
 
+// units returns the suffixes of the values and of the variance.
+func (s Summary) units() (unit, squared string) {
+	if s.Unit == "" {
+		return "", ""
+	}
+	return s.Unit, s.Unit + "^2"
+}
+
+// inUnit returns the value to print for lpf, which is in recorded units to the given power.
+func (s Summary) inUnit(lpf LPFloat, power int) interface{} {
+	if s.UnitSize == 0 {
+		return lpf
+	}
+	return lpf.ToFloat64() / math.Pow(s.UnitSize, float64(power))
+}
+
+func (s Summary) percentilesInUnit(fmtCode string) string {
+	parts := make([]string, len(s.Percentiles))
+	for i, p := range s.Percentiles {
+		parts[i] = fmt.Sprintf("P%g: "+fmtCode+"%s", p.Percentile, s.inUnit(p.LessThan, 1), s.Unit)
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
 func (s Summary) Format(f fmt.State, c rune) {
 	fmtCode := toFormatCode(f, c)
-	fmtStr := "Summary{Total: %d, Sum: _CODE_, Avg: _CODE_, Max: _CODE_, Min: _CODE_, Percentiles: _CODE_}"
+	fmtStr := "Summary{Total: %d, "
+	args := []interface{}{s.Total}
+	if s.TotalWeight != 0 {
+		fmtStr += "TotalWeight: %g, "
+		args = append(args, s.TotalWeight)
+	}
+	u, u2 := s.units()
+	fmtStr += "Sum: _CODE_%s, Avg: _CODE_%s, Max: _CODE_%s, Min: _CODE_%s, " +
+		"Variance: _CODE_%s, StdDev: _CODE_%s, Skewness: _CODE_, Kurtosis: _CODE_, "
+	args = append(args, s.inUnit(s.Sum, 1), u, s.inUnit(s.Avg, 1), u, s.inUnit(s.Max, 1), u, s.inUnit(s.Min, 1), u,
+		s.inUnit(s.Variance, 2), u2, s.inUnit(s.StdDev, 1), u, s.Skewness, s.Kurtosis)
+	if s.Underflow != 0 || s.Overflow != 0 {
+		fmtStr += "Underflow: %d, Overflow: %d, "
+		args = append(args, s.Underflow, s.Overflow)
+	}
+	if s.Zero != 0 {
+		fmtStr += "Zero: %d, "
+		args = append(args, s.Zero)
+	}
+	if s.Clamped {
+		fmtStr += "Clamped: true, "
+	}
+	if s.NaN != 0 || s.PosInf != 0 || s.NegInf != 0 {
+		fmtStr += "NaN: %d, +Inf: %d, -Inf: %d, "
+		args = append(args, s.NaN, s.PosInf, s.NegInf)
+	}
+	if s.UnitSize == 0 {
+		fmtStr += "Percentiles: _CODE_}"
+		args = append(args, s.Percentiles)
+	} else {
+		fmtStr += "Percentiles: %s}"
+		args = append(args, s.percentilesInUnit(fmtCode))
+	}
 	fmtStr = strings.Replace(fmtStr, "_CODE_", fmtCode, -1)
-	_, _ = f.Write([]byte(fmt.Sprintf(fmtStr, s.Total, s.Sum, s.Avg, s.Max, s.Min, s.Percentiles)))
+	_, _ = f.Write([]byte(fmt.Sprintf(fmtStr, args...)))
 }
 
 type PercentilePair struct {
@@ -0,0 +1,162 @@
+package lpfloat
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// BucketsCfg holds the optional behaviours of bucket implementations.
+// The zero value is the default configuration, which is also what zero value buckets use.
+type BucketsCfg struct {
+	// CompensatedSum enables Kahan-Neumaier compensated summation of the inserted values,
+	// which keeps Sum and Avg accurate over huge numbers of inserts at a small insert cost.
+	CompensatedSum bool
+
+	// MaxLayers caps the number of layers, 0 means unlimited. Once reached, values below the lowest
+	// layer are collapsed into an underflow bucket and values above the highest one into an overflow
+	// bucket. A value between them evicts whichever of the lowest and highest layers holds fewer
+	// observations into the underflow or overflow bucket to make room for its own layer. Empty layers,
+	// e.g. kept by Reset, are dropped first for any value not beyond the collapsed ones.
+	MaxLayers int
+
+	// ZeroThreshold makes values of smaller magnitude go into a single zero bucket, whose Value is 0,
+	// instead of opening layers for tiny exponents. Their exact values still count in sums and moments.
+	ZeroThreshold float64
+
+	// KeepNonFinite inserts NaNs and infinities into the layers like any other value. By default they
+	// are only counted apart, out of the sums and percentiles, and reported by Summary.
+	KeepNonFinite bool
+
+	// CountOverflow tells what to do when adding observations would overflow the uint64 counter of
+	// a bucket, of its layer or of the underflow or overflow, e.g. when inserting pre-aggregated counts with InsertN. Whatever the policy, InsertNE reports
+	// such inserts with ErrCountOverflow. Total and Summary.Total saturate unless the policy is
+	// CountOverflowWrap.
+	CountOverflow CountOverflowPolicy
+
+	// DroppedBits coarsens the buckets by dropping the lowest bits of their fractions, from 0 to 8:
+	// a power of 2 is split in 2^(8-DroppedBits) buckets instead of 256, 8 leaving one bucket per
+	// power of 2. Values are still truncated toward 0. See UnSyncBuckets.Downsample.
+	DroppedBits int
+}
+
+// CountOverflowPolicy is the handling of counter overflows, see BucketsCfg.CountOverflow.
+type CountOverflowPolicy int
+
+const (
+	// CountOverflowWrap lets counters wrap around without checking them.
+	CountOverflowWrap CountOverflowPolicy = iota
+	// CountOverflowSaturate adds as many observations as fit, the others are dropped and Summary.Clamped is set.
+	CountOverflowSaturate
+	// CountOverflowError drops the whole insert and sets Summary.Clamped.
+	CountOverflowError
+	// CountOverflowPanic panics, leaving the buckets untouched.
+	CountOverflowPanic
+)
+
+func CheckBucketsCfg(cfg BucketsCfg) error {
+	if cfg.MaxLayers < 0 {
+		return errors.New("the max layers should not be negative")
+	}
+	if !(cfg.ZeroThreshold >= 0) || math.IsInf(cfg.ZeroThreshold, 1) {
+		return errors.New("the zero threshold should be a non-negative finite number")
+	}
+	if cfg.CountOverflow < CountOverflowWrap || cfg.CountOverflow > CountOverflowPanic {
+		return errors.New("unknown count overflow policy")
+	}
+	if cfg.DroppedBits < 0 || cfg.DroppedBits > 8 {
+		return errors.New("the dropped bits should be between 0 and 8")
+	}
+	return nil
+}
+
+func mustCheckBucketsCfg(cfg BucketsCfg) {
+	if err := CheckBucketsCfg(cfg); err != nil {
+		panic(fmt.Errorf("invalid buckets cfg %+v: %s", cfg, err))
+	}
+}
+
+func mustCheckWeight(weight float64) {
+	if !(weight > 0) || math.IsInf(weight, 1) {
+		panic(fmt.Errorf("invalid weight %g: the weight should be a positive finite number", weight))
+	}
+}
+
+// fitCount applies the CountOverflow policy to adding count to a counter holding held,
+// it returns how many observations to add and whether the counter overflows.
+func (cfg *BucketsCfg) fitCount(held, count uint64) (fit uint64, overflow bool) {
+	if held+count >= held {
+		return count, false
+	}
+	switch cfg.CountOverflow {
+	case CountOverflowWrap:
+		return count, true
+	case CountOverflowSaturate:
+		return math.MaxUint64 - held, true
+	default:
+		return 0, true
+	}
+}
+
+// fitCounts is fitCount for a bucket counter holding held in a layer counting total observations.
+func (cfg *BucketsCfg) fitCounts(held, total, count uint64) (fit uint64, overflow bool) {
+	fit, overflow = cfg.fitCount(total, count)
+	if fit != 0 {
+		var bucketOverflow bool
+		fit, bucketOverflow = cfg.fitCount(held, fit)
+		overflow = overflow || bucketOverflow
+	}
+	return fit, overflow
+}
+
+// addTotal adds count to a grand total, which saturates unless the policy is CountOverflowWrap.
+func (cfg *BucketsCfg) addTotal(total, count uint64) uint64 {
+	if sum := total + count; sum >= total || cfg.CountOverflow == CountOverflowWrap {
+		return sum
+	}
+	return math.MaxUint64
+}
+
+// overflowed returns the error for InsertNE of count observations of f which overflowed a counter,
+// or panics with it. It must be called once the buckets are consistent again.
+func (cfg *BucketsCfg) overflowed(f float64, count uint64) error {
+	err := fmt.Errorf("insert %d observations of %g: %w", count, f, ErrCountOverflow)
+	if cfg.CountOverflow == CountOverflowPanic {
+		panic(err)
+	}
+	return err
+}
+
+// clamps reports whether overflowing inserts drop observations.
+func (cfg *BucketsCfg) clamps() bool {
+	return cfg.CountOverflow == CountOverflowSaturate || cfg.CountOverflow == CountOverflowError
+}
+
+// lpFloat returns the bucket value of f.
+func (cfg *BucketsCfg) lpFloat(f float64) LPFloat {
+	if cfg.ZeroThreshold > 0 && f < cfg.ZeroThreshold && f > -cfg.ZeroThreshold {
+		return _Zero
+	}
+	lpf := FromFloat64(f)
+	lpf.Fraction &^= cfg.droppedMask(lpf.SignAndExp)
+	return lpf
+}
+
+// droppedMask returns the fraction bits dropped by BucketsCfg.DroppedBits in the layer of signAndExp.
+// NaNs and infinities keep their fractions, which tell them apart.
+func (cfg *BucketsCfg) droppedMask(signAndExp int16) uint8 {
+	if signAndExp&0x7ff0 == 0x7ff0 {
+		return 0
+	}
+	return uint8(1<<uint(cfg.DroppedBits) - 1)
+}
+
+// bucketStep returns what the bits of a bucket value grow by to the next bucket of the same sign.
+func (cfg *BucketsCfg) bucketStep() uint64 {
+	return 1 << (fractionShift + uint(cfg.DroppedBits))
+}
+
+// nonFinite reports whether f is counted apart from the layers.
+func (cfg *BucketsCfg) nonFinite(f float64) bool {
+	return !cfg.KeepNonFinite && (math.IsNaN(f) || math.IsInf(f, 0))
+}
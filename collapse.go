@@ -0,0 +1,138 @@
+package lpfloat
+
+import "math"
+
+// collapsedBucket accumulates the values kept out of the layers by BucketsCfg.MaxLayers.
+type collapsedBucket struct {
+	count   uint64
+	sum     neumaierSum
+	moments centralMoments
+	min     float64
+	max     float64
+	extra   float64 // weight beyond count, see extraWeights
+}
+
+// add adds count observations of f weighing weight altogether, which is count unless inserted weighted.
+func (c *collapsedBucket) add(f float64, count uint64, weight float64) {
+	var sum neumaierSum
+	sum.add(f * weight)
+	c.merge(count, weight-float64(count), sum, centralMoments{n: weight, mean: f}, f, f)
+}
+
+// addLayer collapses the statistics of an evicted layer, which values range from min to max.
+func (c *collapsedBucket) addLayer(stats *layerStats, extra, min, max float64) {
+	sum := neumaierSum{sum: stats.sum, comp: stats.sumComp}
+	moments := stats.moments.centralWeight(float64(stats.count) + extra)
+	c.merge(stats.count, extra, sum, moments, min, max)
+}
+
+// mergeBucket adds the values collapsed into o.
+func (c *collapsedBucket) mergeBucket(o *collapsedBucket) {
+	c.merge(o.count, o.extra, o.sum, o.moments, o.min, o.max)
+}
+
+func (c *collapsedBucket) merge(count uint64, extra float64, sum neumaierSum, moments centralMoments, min, max float64) {
+	if count == 0 {
+		return
+	}
+	if c.count == 0 {
+		c.min, c.max = min, max
+	}
+	c.count += count
+	c.extra += extra
+	c.sum.add(sum.sum)
+	c.sum.add(sum.comp)
+	c.moments.merge(moments)
+	c.min = math.Min(c.min, min)
+	c.max = math.Max(c.max, max)
+}
+
+// remove takes count observations of f back out, along with their share of the extra weight.
+// Min and max are kept as bounds of the remaining values.
+func (c *collapsedBucket) remove(f float64, count uint64) {
+	if count == c.count {
+		c.reset()
+		return
+	}
+	weight := float64(count) + c.extra*float64(count)/float64(c.count)
+	c.extra -= weight - float64(count)
+	c.count -= count
+	c.sum.add(-f * weight)
+	c.moments.unmerge(centralMoments{n: weight, mean: f})
+}
+
+func (c *collapsedBucket) reset() {
+	*c = collapsedBucket{}
+}
+
+// collapsedBuckets are the underflow and overflow buckets of BucketsCfg.MaxLayers.
+type collapsedBuckets struct {
+	underflow collapsedBucket
+	overflow  collapsedBucket
+}
+
+func (c *collapsedBuckets) sum() neumaierSum {
+	var sum neumaierSum
+	sum.add(c.underflow.sum.sum)
+	sum.add(c.underflow.sum.comp)
+	sum.add(c.overflow.sum.sum)
+	sum.add(c.overflow.sum.comp)
+	return sum
+}
+
+// remove takes count observations of f, which has no layer, out of the underflow or overflow bucket.
+func (c *collapsedBuckets) remove(f float64, lpf LPFloat, count uint64) error {
+	order := valueOrder(lpf)
+	var bucket *collapsedBucket
+	switch {
+	case c.underflow.count != 0 && order <= valueOrder(FromFloat64(c.underflow.max)):
+		bucket = &c.underflow
+	case c.overflow.count != 0 && order >= valueOrder(FromFloat64(c.overflow.min)):
+		bucket = &c.overflow
+	default:
+		return countUnderflowError(f, count, 0)
+	}
+	if bucket.count < count {
+		return countUnderflowError(f, count, bucket.count)
+	}
+	bucket.remove(f, count)
+	return nil
+}
+
+func (c *collapsedBuckets) reset() {
+	c.underflow.reset()
+	c.overflow.reset()
+}
+
+// admits reports whether a value of the layer signAndExp can have a layer, in place of an empty one,
+// without passing the values collapsed already, which stay below or above all the layers.
+func (c *collapsedBuckets) admits(signAndExp int16) bool {
+	rank := layerRank(signAndExp)
+	return (c.underflow.count == 0 || rank > layerRank(FromFloat64(c.underflow.max).SignAndExp)) &&
+		(c.overflow.count == 0 || rank < layerRank(FromFloat64(c.overflow.min).SignAndExp))
+}
+
+// collapseAction tells what to do with a value which has no layer yet.
+type collapseAction int
+
+const (
+	collapseUnderflow collapseAction = iota
+	collapseOverflow
+	collapseEvictLowest  // the lowest layer is evicted, then the value gets its own layer
+	collapseEvictHighest // the highest layer is evicted, then the value gets its own layer
+)
+
+// decideCollapse applies BucketsCfg.MaxLayers to a value of a new layer, when the layers are full.
+func decideCollapse(signAndExp, lowest, highest int16, lowestCount, highestCount uint64) collapseAction {
+	rank := layerRank(signAndExp)
+	switch {
+	case rank < layerRank(lowest):
+		return collapseUnderflow
+	case rank > layerRank(highest):
+		return collapseOverflow
+	case lowestCount <= highestCount:
+		return collapseEvictLowest
+	default:
+		return collapseEvictHighest
+	}
+}
@@ -0,0 +1,84 @@
+package lpfloat
+
+import "encoding/binary"
+
+// counters is a slice of unsigned counters stored in as few bytes as possible:
+// every counter starts one byte wide and all of them widen to 2, 4 then 8 bytes
+// as soon as one of them would overflow.
+type counters struct {
+	width int // bytes per counter
+	data  []byte
+}
+
+func counterWidth(v uint64) int {
+	switch {
+	case v <= 0xff:
+		return 1
+	case v <= 0xffff:
+		return 2
+	case v <= 0xffffffff:
+		return 4
+	default:
+		return 8
+	}
+}
+
+func (c *counters) len() int {
+	if c.width == 0 {
+		return 0
+	}
+	return len(c.data) / c.width
+}
+
+func (c *counters) get(i int) uint64 {
+	switch c.width {
+	case 1:
+		return uint64(c.data[i])
+	case 2:
+		return uint64(binary.LittleEndian.Uint16(c.data[i*2:]))
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(c.data[i*4:]))
+	default:
+		return binary.LittleEndian.Uint64(c.data[i*8:])
+	}
+}
+
+func (c *counters) set(i int, v uint64) {
+	c.widen(counterWidth(v))
+	switch c.width {
+	case 1:
+		c.data[i] = uint8(v)
+	case 2:
+		binary.LittleEndian.PutUint16(c.data[i*2:], uint16(v))
+	case 4:
+		binary.LittleEndian.PutUint32(c.data[i*4:], uint32(v))
+	default:
+		binary.LittleEndian.PutUint64(c.data[i*8:], v)
+	}
+}
+
+// insert adds a counter at position i, shifting the following ones.
+func (c *counters) insert(i int, v uint64) {
+	c.widen(counterWidth(v))
+	c.data = append(c.data, make([]byte, c.width)...)
+	copy(c.data[(i+1)*c.width:], c.data[i*c.width:])
+	c.set(i, v)
+}
+
+func (c *counters) widen(width int) {
+	if width <= c.width {
+		return
+	}
+	n := c.len()
+	old := *c
+	c.width = width
+	c.data = make([]byte, n*width)
+	for i := 0; i < n; i++ {
+		c.set(i, old.get(i))
+	}
+}
+
+func (c *counters) reset() {
+	c.width = 0
+	c.data = c.data[:0]
+}
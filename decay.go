@@ -0,0 +1,184 @@
+package lpfloat
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// DecayCfg configures DecayingBuckets.
+type DecayCfg struct {
+	// HalfLife is how long it takes the weight of an observation to halve.
+	HalfLife time.Duration
+	// Buckets are the options of the underlying buckets,
+	// BucketsCfg.MaxLayers and BucketsCfg.CountOverflow aren't supported.
+	Buckets BucketsCfg
+	// Now returns the current time, time.Now if nil. Tests inject fake clocks here.
+	Now func() time.Time
+}
+
+func CheckDecayCfg(cfg DecayCfg) error {
+	if cfg.HalfLife <= 0 {
+		return errors.New("the half-life should be positive")
+	}
+	if cfg.Buckets.MaxLayers != 0 {
+		return errors.New("the max layers are not supported by decaying buckets")
+	}
+	if cfg.Buckets.CountOverflow != CountOverflowWrap {
+		return errors.New("the count overflow policies are not supported by decaying buckets")
+	}
+	return CheckBucketsCfg(cfg.Buckets)
+}
+
+func mustCheckDecayCfg(cfg DecayCfg) {
+	if err := CheckDecayCfg(cfg); err != nil {
+		panic(fmt.Errorf("invalid decay cfg %+v: %s", cfg, err))
+	}
+}
+
+func (cfg *DecayCfg) now() time.Time {
+	if cfg.Now != nil {
+		return cfg.Now()
+	}
+	return time.Now()
+}
+
+// decayRescaleHalfLives is how far the landmark may fall behind before the weights are rescaled,
+// weights up to 2^64 leave plenty of room to the float64 range for the weighted sums.
+const decayRescaleHalfLives = 64
+
+// DecayingBuckets is a histogram where the weight of each observation halves every DecayCfg.HalfLife,
+// so old observations fade out without the hard edges of windows. It uses forward decay: an
+// observation inserted at t weighs 2^((t-L)/HalfLife) for a landmark L, which is moved forward
+// from time to time by rescaling all the weights, and queries divide by the weight of now.
+//
+// Its Summary reports the decayed TotalWeight, where an observation weighs 1 when inserted, and
+// the weighted Sum, Avg, moments and percentiles. Total, Min, Max and the non-finite counts are
+// about all the observations since the last Reset, whatever their weights.
+// DecayingBuckets is not safe for concurrent use.
+type DecayingBuckets struct {
+	cfg       DecayCfg
+	landmark  time.Time
+	layers    []*decayingLayer // ordered by value
+	index     layerIndex
+	weight    float64
+	nonFinite nonFiniteCounts
+}
+
+// decayingLayer keeps fractional weights on top of the counters of a layer,
+// its sums and moments are weighted.
+type decayingLayer struct {
+	f64BucketsLayer
+	weight  float64
+	weights [256]float64
+}
+
+func NewDecayingBuckets(cfg DecayCfg) *DecayingBuckets {
+	mustCheckDecayCfg(cfg)
+	return &DecayingBuckets{cfg: cfg, landmark: cfg.now()}
+}
+
+// decay returns the weight of an observation made at now, relative to the landmark.
+func (b *DecayingBuckets) decay(now time.Time) float64 {
+	return math.Exp2(float64(now.Sub(b.landmark)) / float64(b.cfg.HalfLife))
+}
+
+func (b *DecayingBuckets) Insert(f float64) {
+	b.InsertN(f, 1)
+}
+
+func (b *DecayingBuckets) InsertN(f float64, count uint64) {
+	if b.cfg.Buckets.nonFinite(f) {
+		b.nonFinite.add(f, count)
+		return
+	}
+	now := b.cfg.now()
+	if now.Sub(b.landmark) > decayRescaleHalfLives*b.cfg.HalfLife {
+		b.rescale(now)
+	}
+	weight := b.decay(now) * float64(count)
+
+	lpf := b.cfg.Buckets.lpFloat(f)
+	layer := b.layer(f, lpf.SignAndExp)
+	layer.count += count
+	layer.addSum(f*weight, b.cfg.Buckets.CompensatedSum)
+	layer.moments.addWeight(f, weight)
+	layer.buckets[lpf.Fraction] += count
+	layer.weights[lpf.Fraction] += weight
+	layer.weight += weight
+	b.weight += weight
+}
+
+func (b *DecayingBuckets) layer(f float64, signAndExp int16) *decayingLayer {
+	if i := b.index.get(signAndExp); i >= 0 {
+		return b.layers[i]
+	}
+
+	// cold path
+	layer := &decayingLayer{
+		f64BucketsLayer: f64BucketsLayer{layerStats: makeLayerStats(f), signAndExp: signAndExp},
+	}
+	rank := layerRank(signAndExp)
+	pos := sort.Search(len(b.layers), func(i int) bool {
+		return layerRank(b.layers[i].signAndExp) > rank
+	})
+	b.layers = append(b.layers, nil)
+	copy(b.layers[pos+1:], b.layers[pos:])
+	b.layers[pos] = layer
+	for i := pos; i < len(b.layers); i++ {
+		b.index.set(b.layers[i].signAndExp, i)
+	}
+	return layer
+}
+
+// rescale moves the landmark to now, scaling all the weights down accordingly.
+// The weights of observations many half-lives old may underflow to 0.
+func (b *DecayingBuckets) rescale(now time.Time) {
+	scale := 1 / b.decay(now)
+	for _, layer := range b.layers {
+		for i := range layer.weights {
+			layer.weights[i] *= scale
+		}
+		layer.weight *= scale
+		layer.sum *= scale
+		layer.sumComp *= scale
+		for i := range layer.moments.s {
+			layer.moments.s[i] *= scale
+		}
+	}
+	b.weight *= scale
+	b.landmark = now
+}
+
+// TotalWeight returns the decayed weight of all the observations, each weighing 1 when inserted.
+func (b *DecayingBuckets) TotalWeight() float64 {
+	return b.weight / b.decay(b.cfg.now())
+}
+
+// Summary summarizes the buckets weighted by decay, see DecayingBuckets.
+func (b *DecayingBuckets) Summary(percentilesCfg []float32) Summary {
+	scale := 1 / b.decay(b.cfg.now())
+	total := uint64(0)
+	for _, layer := range b.layers {
+		total += layer.count
+	}
+	builder := newWeightedSummaryBuilder(percentilesCfg, total, b.weight*scale)
+	for _, layer := range b.layers {
+		// the moments don't depend on the scale of the weights
+		builder.addStats(layer.sum*scale, layer.sumComp*scale, layer.moments.centralWeight(layer.weight))
+		for i := range layer.buckets {
+			fraction := layer.fractionAt(i)
+			if count := layer.buckets[fraction]; count != 0 {
+				builder.addWeightedBucket(compose(layer.signAndExp, fraction), count, layer.weights[fraction]*scale)
+			}
+		}
+	}
+	builder.addNonFinite(&b.nonFinite)
+	return builder.build()
+}
+
+func (b *DecayingBuckets) Reset() {
+	*b = DecayingBuckets{cfg: b.cfg, landmark: b.cfg.now()}
+}
@@ -0,0 +1,77 @@
+package lpfloat
+
+import "fmt"
+
+// downsampled returns the cfg of buckets coarsened to bits of fraction, see UnSyncBuckets.Downsample.
+func (cfg *BucketsCfg) downsampled(bits int) BucketsCfg {
+	if bits < 0 || bits > 8 {
+		panic(fmt.Errorf("invalid downsample bits %d: the bits should be between 0 and 8", bits))
+	}
+	downsampled := *cfg
+	if dropped := 8 - bits; dropped > downsampled.DroppedBits {
+		downsampled.DroppedBits = dropped
+	}
+	return downsampled
+}
+
+// Downsample returns a copy of the buckets with bits of fraction left, from 0 to 8: adjacent buckets are
+// merged so a power of 2 is split in 2^bits buckets, 0 leaving one per power of 2. The copy keeps
+// coarsening its inserts, see BucketsCfg.DroppedBits. Totals, sums and moments are kept exactly, as they
+// are per layer. Buckets as coarse already are copied as they are.
+func (b *UnSyncBuckets) Downsample(bits int) *UnSyncBuckets {
+	d := &UnSyncBuckets{
+		cfg:       b.cfg.downsampled(bits),
+		layers:    make([]f64BucketsLayer, len(b.layers)),
+		collapsed: b.collapsed,
+		nonFinite: b.nonFinite,
+		weighted:  b.weighted,
+		clamped:   b.clamped,
+	}
+	for i := range b.layers {
+		src, dst := &b.layers[i], &d.layers[i]
+		dst.layerStats, dst.signAndExp = src.layerStats, src.signAndExp
+		mask := d.cfg.droppedMask(src.signAndExp)
+		for fraction, count := range src.buckets {
+			merged := uint8(fraction) &^ mask
+			dst.buckets[merged] = d.cfg.addTotal(dst.buckets[merged], count)
+		}
+		if src.extra != nil {
+			dst.extra = new(extraWeights)
+			for fraction, extra := range src.extra {
+				dst.extra[uint8(fraction)&^mask] += extra
+			}
+		}
+		d.index.set(dst.signAndExp, i)
+	}
+	return d
+}
+
+// Downsample returns a coarser copy of a snapshot of the buckets, see UnSyncBuckets.Downsample.
+func (b *SyncBuckets) Downsample(bits int) *SyncBuckets {
+	d := NewSyncBuckets(b.cfg)
+	d.replace(b.Snapshot().Downsample(bits))
+	return d
+}
+
+// Downsample returns a coarser copy of the buckets, see UnSyncBuckets.Downsample.
+// The fewer buckets the copy has, the less memory it takes.
+func (b *SparseBuckets) Downsample(bits int) *SparseBuckets {
+	d := &SparseBuckets{
+		cfg:       b.cfg.downsampled(bits),
+		layers:    make([]sparseLayer, len(b.layers)),
+		collapsed: b.collapsed,
+		nonFinite: b.nonFinite,
+		clamped:   b.clamped,
+	}
+	for i := range b.layers {
+		src, dst := &b.layers[i], &d.layers[i]
+		dst.layerStats, dst.signAndExp = src.layerStats, src.signAndExp
+		mask := d.cfg.droppedMask(src.signAndExp)
+		for j := 0; j < src.len(); j++ {
+			if bucket := src.bucketAt(j); bucket.Count != 0 {
+				dst.addBucket(bucket.Value.Fraction&^mask, bucket.Count)
+			}
+		}
+	}
+	return d
+}
@@ -0,0 +1,514 @@
+package lpfloat
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"unsafe"
+)
+
+// The binary encoding of buckets, all integers being unsigned varints and floats 8 bytes little-endian:
+//
+//	version    byte, encodingVersion
+//	precision  byte, the bits of fraction of the buckets, 8 - BucketsCfg.DroppedBits
+//	flags      byte, see encodingFlag*
+//	max layers              BucketsCfg.MaxLayers
+//	zero threshold          float, only with encodingFlagZeroThreshold
+//	count overflow          BucketsCfg.CountOverflow
+//	NaN, +Inf, -Inf         the non-finite counts
+//	underflow, overflow     count, then unless 0: extra weight, sum, its compensation, weight, mean,
+//	                        m2, m3, m4, min and max
+//	layers                  number of layers, then in value order for each of them:
+//	  sign and exponent     the 12 bits of sign and exponent minus those of the previous layer, zigzag encoded
+//	  buckets               number of non-empty buckets, then for each of them in fraction order
+//	                        2*count if it follows the previous one, else 2*skipped+1 and its count,
+//	                        skipped being the number of empty buckets since the previous one
+//	  extra weights         number of non-zero extra weights, then for each of them in fraction order
+//	                        the number of fractions skipped and the weight as a float
+//	  stats                 byte telling which of the following are there, see encodingStat*
+//	  pivot                 float
+//	  sum                   bits of the sum xor those of pivot*weight + s1, if not 0, the weight of
+//	                        the layer being its count plus its extra weights
+//	  sum compensation      float, if not 0
+//	  moments               the 4 shifted power sums s1 to s4, floats, those which are not 0
+//
+// The count of a layer is the sum of its buckets. Empty layers are kept, so are their pivots.
+//
+// Version 1 encoded the sign and exponent of a layer as uint16, followed by the sum, its compensation
+// with BucketsCfg.CompensatedSum, the pivot and the 4 power sums as floats, then the buckets as
+// the number of empty buckets skipped and the count of each one and the extra weights.
+const (
+	encodingVersion   = 2
+	encodingPrecision = 8 // the bits of fraction of LPFloat
+)
+
+const (
+	encodingFlagCompensatedSum = 1 << iota
+	encodingFlagKeepNonFinite
+	encodingFlagZeroThreshold
+	encodingFlagWeighted
+	encodingFlagClamped
+)
+
+const (
+	encodingStatSum = 1 << iota
+	encodingStatSumComp
+	encodingStatMoments // shifted by the index of the power sum
+)
+
+var (
+	_ encoding.BinaryMarshaler   = &UnSyncBuckets{}
+	_ encoding.BinaryUnmarshaler = &UnSyncBuckets{}
+	_ encoding.BinaryMarshaler   = &SyncBuckets{}
+	_ encoding.BinaryUnmarshaler = &SyncBuckets{}
+)
+
+// MarshalBinary encodes the buckets along with their BucketsCfg in a compact versioned format,
+// encoding/gob uses it as well.
+func (b *UnSyncBuckets) MarshalBinary() ([]byte, error) {
+	var e encoder
+	e.byte(encodingVersion)
+	e.byte(byte(encodingPrecision - b.cfg.DroppedBits))
+	e.cfg(&b.cfg, b.weighted, b.clamped)
+	e.uvarint(b.nonFinite.nan)
+	e.uvarint(b.nonFinite.posInf)
+	e.uvarint(b.nonFinite.negInf)
+	e.collapsed(&b.collapsed.underflow)
+	e.collapsed(&b.collapsed.overflow)
+	e.uvarint(uint64(len(b.layers)))
+	var prev int16
+	for i := range b.layers {
+		e.layer(&b.layers[i], &b.cfg, prev)
+		prev = b.layers[i].signAndExp
+	}
+	return e.buf, nil
+}
+
+// UnmarshalBinary replaces the buckets and their BucketsCfg with the ones encoded by MarshalBinary.
+func (b *UnSyncBuckets) UnmarshalBinary(data []byte) error {
+	decoded, err := decodeBuckets(data)
+	if err != nil {
+		return err
+	}
+	*b = *decoded
+	return nil
+}
+
+// MarshalBinary encodes a snapshot of the buckets, see UnSyncBuckets.MarshalBinary.
+func (b *SyncBuckets) MarshalBinary() ([]byte, error) {
+	return b.Snapshot().MarshalBinary()
+}
+
+// UnmarshalBinary replaces the buckets and their BucketsCfg with the ones encoded by MarshalBinary.
+// It must not run concurrently with other methods of b.
+func (b *SyncBuckets) UnmarshalBinary(data []byte) error {
+	decoded, err := decodeBuckets(data)
+	if err != nil {
+		return err
+	}
+	b.replace(decoded)
+	return nil
+}
+
+// replace replaces the buckets and their BucketsCfg with decoded ones.
+func (b *SyncBuckets) replace(decoded *UnSyncBuckets) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	layers := make([]*syncLayer, len(decoded.layers))
+	for i := range decoded.layers {
+		src := &decoded.layers[i]
+		layer := newSyncLayer(src.signAndExp, src.moments.pivot)
+		// the stripes only add up, so the statistics may all live in one
+		layer.stripes[0].layerStats = src.layerStats
+		layer.buckets = src.buckets
+		layer.extra = unsafe.Pointer(src.extra)
+		layers[i] = layer
+	}
+	b.cfg = decoded.cfg
+	b.table.Store(makeSyncLayerTable(layers))
+	b.collapsed = decoded.collapsed
+	atomic.StoreUint64(&b.nonFinite.nan, decoded.nonFinite.nan)
+	atomic.StoreUint64(&b.nonFinite.posInf, decoded.nonFinite.posInf)
+	atomic.StoreUint64(&b.nonFinite.negInf, decoded.nonFinite.negInf)
+	atomic.StoreUint32(&b.weighted, boolUint32(decoded.weighted))
+	atomic.StoreUint32(&b.clamped, boolUint32(decoded.clamped))
+}
+
+func boolUint32(v bool) uint32 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+func decodeBuckets(data []byte) (*UnSyncBuckets, error) {
+	d := decoder{data: data}
+	if d.version = d.byte(); d.err == nil && (d.version < 1 || d.version > encodingVersion) {
+		return nil, fmt.Errorf("decode buckets: unsupported version %d", d.version)
+	}
+	precision := d.byte()
+	if d.err == nil && precision > encodingPrecision {
+		return nil, fmt.Errorf("decode buckets: unsupported precision %d", precision)
+	}
+	b := &UnSyncBuckets{}
+	b.cfg, b.weighted, b.clamped = d.cfg()
+	b.cfg.DroppedBits = encodingPrecision - int(precision)
+	b.nonFinite.nan = d.uvarint()
+	b.nonFinite.posInf = d.uvarint()
+	b.nonFinite.negInf = d.uvarint()
+	d.collapsed(&b.collapsed.underflow)
+	d.collapsed(&b.collapsed.overflow)
+	layers := d.uvarint()
+	if d.err == nil && layers > 1<<12 {
+		d.fail("too many layers")
+	}
+	// layers are appended as they come, so corrupted data can't make us allocate thousands of them upfront
+	var prev int16
+	for i := 0; uint64(i) < layers && d.err == nil; i++ {
+		var layer f64BucketsLayer
+		d.layer(&layer, &b.cfg, prev)
+		prev = layer.signAndExp
+		if i > 0 && layerRank(layer.signAndExp) <= layerRank(b.layers[i-1].signAndExp) {
+			d.fail("layers out of order")
+		}
+		b.layers = append(b.layers, layer)
+		b.index.set(layer.signAndExp, i)
+	}
+	if d.err == nil && len(d.data) != 0 {
+		d.fail("trailing bytes")
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if err := CheckBucketsCfg(b.cfg); err != nil {
+		return nil, fmt.Errorf("decode buckets: %s", err)
+	}
+	return b, nil
+}
+
+type encoder struct {
+	buf     []byte
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (e *encoder) byte(v byte) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) uvarint(v uint64) {
+	n := binary.PutUvarint(e.scratch[:], v)
+	e.buf = append(e.buf, e.scratch[:n]...)
+}
+
+// zigzag encodes small negative numbers as small varints.
+func (e *encoder) varint(v int64) {
+	e.uvarint(uint64(v<<1) ^ uint64(v>>63))
+}
+
+func (e *encoder) float64(f float64) {
+	binary.LittleEndian.PutUint64(e.scratch[:8], math.Float64bits(f))
+	e.buf = append(e.buf, e.scratch[:8]...)
+}
+
+func (e *encoder) cfg(cfg *BucketsCfg, weighted, clamped bool) {
+	var flags byte
+	if cfg.CompensatedSum {
+		flags |= encodingFlagCompensatedSum
+	}
+	if cfg.KeepNonFinite {
+		flags |= encodingFlagKeepNonFinite
+	}
+	if cfg.ZeroThreshold != 0 {
+		flags |= encodingFlagZeroThreshold
+	}
+	if weighted {
+		flags |= encodingFlagWeighted
+	}
+	if clamped {
+		flags |= encodingFlagClamped
+	}
+	e.byte(flags)
+	e.uvarint(uint64(cfg.MaxLayers))
+	if cfg.ZeroThreshold != 0 {
+		e.float64(cfg.ZeroThreshold)
+	}
+	e.uvarint(uint64(cfg.CountOverflow))
+}
+
+func (e *encoder) collapsed(c *collapsedBucket) {
+	e.uvarint(c.count)
+	if c.count == 0 {
+		return
+	}
+	for _, f := range [...]float64{c.extra, c.sum.sum, c.sum.comp,
+		c.moments.n, c.moments.mean, c.moments.m2, c.moments.m3, c.moments.m4, c.min, c.max} {
+		e.float64(f)
+	}
+}
+
+func (e *encoder) layer(l *f64BucketsLayer, cfg *BucketsCfg, prev int16) {
+	e.varint(int64(l.signAndExp>>4) - int64(prev>>4))
+
+	nonEmpty := 0
+	for _, count := range l.buckets {
+		if count != 0 {
+			nonEmpty++
+		}
+	}
+	e.uvarint(uint64(nonEmpty))
+	skipped := 0
+	var count uint64 // summed as the decoder does
+	for _, held := range l.buckets {
+		if held == 0 {
+			skipped++
+			continue
+		}
+		if skipped == 0 && held <= math.MaxUint64>>1 {
+			e.uvarint(held << 1)
+		} else {
+			e.uvarint(uint64(skipped)<<1 | 1)
+			e.uvarint(held)
+		}
+		count = cfg.addTotal(count, held)
+		skipped = 0
+	}
+
+	nonZero := 0
+	if l.extra != nil {
+		for _, extra := range l.extra {
+			if extra != 0 {
+				nonZero++
+			}
+		}
+	}
+	e.uvarint(uint64(nonZero))
+	if nonZero != 0 {
+		skipped = 0
+		for _, extra := range l.extra {
+			if extra == 0 {
+				skipped++
+				continue
+			}
+			e.uvarint(uint64(skipped))
+			e.float64(extra)
+			skipped = 0
+		}
+	}
+
+	sum := math.Float64bits(l.sum) ^ math.Float64bits(predictSum(&l.moments, float64(count)+l.extra.sum()))
+	var stats byte
+	if sum != 0 {
+		stats |= encodingStatSum
+	}
+	if l.sumComp != 0 {
+		stats |= encodingStatSumComp
+	}
+	for i, s := range l.moments.s {
+		if s != 0 {
+			stats |= encodingStatMoments << i
+		}
+	}
+	e.byte(stats)
+	e.float64(l.moments.pivot)
+	if sum != 0 {
+		e.uvarint(sum)
+	}
+	if l.sumComp != 0 {
+		e.float64(l.sumComp)
+	}
+	for _, s := range l.moments.s {
+		if s != 0 {
+			e.float64(s)
+		}
+	}
+}
+
+// predictSum returns the sum of a layer weighing weight as told by its moments, which is close to
+// the actual one. The conversion keeps it from being fused into a multiply-add, so decoders on
+// other architectures predict the same.
+func predictSum(m *layerMoments, weight float64) float64 {
+	return float64(m.pivot*weight) + m.s[0]
+}
+
+// decoder reads what encoder wrote, remembering the first error so callers check it once.
+type decoder struct {
+	data    []byte
+	err     error
+	version byte
+}
+
+func (d *decoder) fail(msg string) {
+	if d.err == nil {
+		d.err = errors.New("decode buckets: " + msg)
+	}
+	d.data = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.data) < 1 {
+		d.fail("unexpected end of data")
+		return 0
+	}
+	v := d.data[0]
+	d.data = d.data[1:]
+	return v
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail("invalid varint")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v := d.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (d *decoder) float64() float64 {
+	if len(d.data) < 8 {
+		d.fail("unexpected end of data")
+		return 0
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(d.data))
+	d.data = d.data[8:]
+	return v
+}
+
+func (d *decoder) cfg() (cfg BucketsCfg, weighted, clamped bool) {
+	flags := d.byte()
+	cfg.CompensatedSum = flags&encodingFlagCompensatedSum != 0
+	cfg.KeepNonFinite = flags&encodingFlagKeepNonFinite != 0
+	cfg.MaxLayers = int(d.uvarint() & math.MaxInt32)
+	if flags&encodingFlagZeroThreshold != 0 {
+		cfg.ZeroThreshold = d.float64()
+	}
+	cfg.CountOverflow = CountOverflowPolicy(d.uvarint() & math.MaxInt32)
+	return cfg, flags&encodingFlagWeighted != 0, flags&encodingFlagClamped != 0
+}
+
+func (d *decoder) collapsed(c *collapsedBucket) {
+	c.count = d.uvarint()
+	if c.count == 0 {
+		return
+	}
+	for _, f := range [...]*float64{&c.extra, &c.sum.sum, &c.sum.comp,
+		&c.moments.n, &c.moments.mean, &c.moments.m2, &c.moments.m3, &c.moments.m4, &c.min, &c.max} {
+		*f = d.float64()
+	}
+}
+
+func (d *decoder) layer(l *f64BucketsLayer, cfg *BucketsCfg, prev int16) {
+	if d.version == 1 {
+		d.layerV1(l, cfg)
+		return
+	}
+	signAndExp := int64(prev>>4) + d.varint()
+	if signAndExp < math.MinInt16>>4 || signAndExp > math.MaxInt16>>4 {
+		d.fail("sign and exponent out of range")
+		return
+	}
+	l.signAndExp = int16(signAndExp << 4)
+
+	fraction := -1
+	for n := d.uvarint(); n > 0 && d.err == nil; n-- {
+		if v := d.uvarint(); v&1 == 0 {
+			fraction++
+			d.bucket(l, cfg, fraction, v>>1)
+		} else {
+			fraction = skip(fraction, v>>1)
+			d.bucket(l, cfg, fraction, d.uvarint())
+		}
+	}
+	d.extraWeights(l, cfg)
+
+	stats := d.byte()
+	l.moments.pivot = d.float64()
+	var sum uint64
+	if stats&encodingStatSum != 0 {
+		sum = d.uvarint()
+	}
+	if stats&encodingStatSumComp != 0 {
+		l.sumComp = d.float64()
+	}
+	for i := range l.moments.s {
+		if stats&(encodingStatMoments<<i) != 0 {
+			l.moments.s[i] = d.float64()
+		}
+	}
+	l.sum = math.Float64frombits(math.Float64bits(predictSum(&l.moments, float64(l.count)+l.extra.sum())) ^ sum)
+}
+
+func (d *decoder) layerV1(l *f64BucketsLayer, cfg *BucketsCfg) {
+	l.signAndExp = int16(uint16(d.uvarint()))
+	if l.signAndExp&0xf != 0 {
+		d.fail("invalid sign and exponent")
+		return
+	}
+	l.sum = d.float64()
+	if cfg.CompensatedSum {
+		l.sumComp = d.float64()
+	}
+	l.moments.pivot = d.float64()
+	for i := range l.moments.s {
+		l.moments.s[i] = d.float64()
+	}
+
+	fraction := -1
+	for n := d.uvarint(); n > 0 && d.err == nil; n-- {
+		fraction = skip(fraction, d.uvarint())
+		d.bucket(l, cfg, fraction, d.uvarint())
+	}
+	d.extraWeights(l, cfg)
+}
+
+// skip returns the fraction following the skipped ones, out of range if they are too many.
+func skip(fraction int, skipped uint64) int {
+	if skipped >= 0x100 {
+		return 0x100
+	}
+	return fraction + int(skipped) + 1
+}
+
+func (d *decoder) bucket(l *f64BucketsLayer, cfg *BucketsCfg, fraction int, count uint64) {
+	if d.err != nil {
+		return
+	}
+	if fraction > 0xff {
+		d.fail("bucket out of range")
+		return
+	}
+	if uint8(fraction)&cfg.droppedMask(l.signAndExp) != 0 {
+		d.fail("bucket finer than the precision")
+		return
+	}
+	l.buckets[fraction] = count
+	l.count = cfg.addTotal(l.count, count)
+}
+
+func (d *decoder) extraWeights(l *f64BucketsLayer, cfg *BucketsCfg) {
+	fraction := -1
+	for n := d.uvarint(); n > 0 && d.err == nil; n-- {
+		fraction = skip(fraction, d.uvarint())
+		if fraction > 0xff {
+			d.fail("extra weight out of range")
+			return
+		}
+		if uint8(fraction)&cfg.droppedMask(l.signAndExp) != 0 {
+			d.fail("extra weight finer than the precision")
+			return
+		}
+		if l.extra == nil {
+			l.extra = new(extraWeights)
+		}
+		l.extra[fraction] = d.float64()
+	}
+}
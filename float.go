@@ -105,15 +105,16 @@ func toFormatCode(s fmt.State, c rune) string {
 	return fmtCode
 }
 
+// MarshalJSON encodes the value as a number, or as one of the strings "NaN", "+Inf" and "-Inf".
 func (f LPFloat) MarshalJSON() ([]byte, error) {
-	return json.Marshal(f.ToFloat64())
+	return jsonFloat(f.ToFloat64()).MarshalJSON()
 }
 
 func (f *LPFloat) UnmarshalJSON(data []byte) error {
-	var n float64
-	if err := json.Unmarshal(data, &n); err != nil {
+	var n jsonFloat
+	if err := n.UnmarshalJSON(data); err != nil {
 		return err
 	}
-	*f = FromFloat64(n)
+	*f = FromFloat64(float64(n))
 	return nil
 }
@@ -0,0 +1,384 @@
+package lpfloat
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/bits"
+	"strings"
+	"time"
+)
+
+// The V2 encoding of HdrHistogram: a big-endian header followed by the counts as zigzag LEB128
+// varints of up to 9 bytes, a negative count -n standing for n empty buckets. The compressed form
+// wraps it in zlib behind its own cookie, and is what logs hold in base64.
+const (
+	hdrEncodingCookie           = 0x1c849303 | 0x10
+	hdrCompressedEncodingCookie = 0x1c849304 | 0x10
+	hdrCookieWordSizeMask       = 0xf0
+	hdrHeaderSize               = 40
+	hdrCompressedHeaderSize     = 8
+	// hdrMaxValueUnitRatio divides the interval maxes of logs, as in the reference log writers
+	hdrMaxValueUnitRatio = 1e6
+)
+
+// HdrCfg configures the conversion between buckets and HdrHistogram, which records integers.
+type HdrCfg struct {
+	// Unit is the value of one HdrHistogram unit, 0 meaning 1.
+	// E.g. 1e-6 maps buckets of seconds to HdrHistogram microseconds.
+	Unit float64
+	// SignificantDigits is the precision of exported histograms, from 1 to 5, 0 meaning 3.
+	// 3 digits are finer than LP buckets, which are about 2.4 digits.
+	SignificantDigits int
+	// Buckets are the options of imported buckets.
+	Buckets BucketsCfg
+}
+
+func CheckHdrCfg(cfg HdrCfg) error {
+	if !(cfg.Unit >= 0) || math.IsInf(cfg.Unit, 1) {
+		return errors.New("the unit should be a non-negative finite number")
+	}
+	if cfg.SignificantDigits < 0 || cfg.SignificantDigits > 5 {
+		return errors.New("the significant digits should be between 1 and 5, or 0")
+	}
+	return CheckBucketsCfg(cfg.Buckets)
+}
+
+func mustCheckHdrCfg(cfg HdrCfg) {
+	if err := CheckHdrCfg(cfg); err != nil {
+		panic(fmt.Errorf("invalid hdr cfg %+v: %s", cfg, err))
+	}
+}
+
+func (cfg *HdrCfg) unit() float64 {
+	if cfg.Unit == 0 {
+		return 1
+	}
+	return cfg.Unit
+}
+
+func (cfg *HdrCfg) significantDigits() int {
+	if cfg.SignificantDigits == 0 {
+		return 3
+	}
+	return cfg.SignificantDigits
+}
+
+// hdrLayout is the bucketing of an HdrHistogram: buckets of subBucketCount sub-buckets each,
+// the sub-buckets doubling in width from one bucket to the next, the first half of every bucket
+// but the first overlapping the previous bucket and left out of the counts array.
+type hdrLayout struct {
+	unitMagnitude               uint
+	subBucketHalfCountMagnitude uint
+}
+
+func newHdrLayout(lowestDiscernibleValue int64, significantDigits int) hdrLayout {
+	subBucketCountMagnitude := uint(math.Ceil(math.Log2(2 * math.Pow10(significantDigits))))
+	if subBucketCountMagnitude < 1 {
+		subBucketCountMagnitude = 1
+	}
+	return hdrLayout{
+		unitMagnitude:               uint(bits.Len64(uint64(lowestDiscernibleValue)) - 1),
+		subBucketHalfCountMagnitude: subBucketCountMagnitude - 1,
+	}
+}
+
+func (l hdrLayout) subBucketHalfCount() int64 {
+	return 1 << l.subBucketHalfCountMagnitude
+}
+
+// index returns the index in the counts array of the non-negative value v.
+func (l hdrLayout) index(v int64) int {
+	mask := uint64(2*l.subBucketHalfCount()-1) << l.unitMagnitude
+	bucket := uint(bits.Len64(uint64(v)|mask)) - l.unitMagnitude - l.subBucketHalfCountMagnitude - 1
+	subBucket := v >> (bucket + l.unitMagnitude)
+	return int((int64(bucket)+1)<<l.subBucketHalfCountMagnitude + subBucket - l.subBucketHalfCount())
+}
+
+// bucket returns the bucket and the sub-bucket of the index.
+func (l hdrLayout) bucket(index int) (bucket uint, subBucket int64) {
+	b := index>>l.subBucketHalfCountMagnitude - 1
+	subBucket = int64(index)&(l.subBucketHalfCount()-1) + l.subBucketHalfCount()
+	if b < 0 {
+		return 0, subBucket - l.subBucketHalfCount()
+	}
+	return uint(b), subBucket
+}
+
+// highestEquivalent returns the highest value the index holds, the max HdrHistogram reports.
+func (l hdrLayout) highestEquivalent(index int) int64 {
+	bucket, subBucket := l.bucket(index)
+	shift := bucket + l.unitMagnitude
+	return (subBucket+1)<<shift - 1
+}
+
+// median returns the middle of the values the index holds, the value HdrHistogram reports for them.
+// ok is false if they don't fit an int64.
+func (l hdrLayout) median(index int) (median int64, ok bool) {
+	bucket, subBucket := l.bucket(index)
+	shift := bucket + l.unitMagnitude
+	if shift+uint(bits.Len64(uint64(subBucket))) > 62 {
+		return 0, false
+	}
+	return subBucket<<shift + 1<<shift>>1, true
+}
+
+// EncodeHdrHistogram encodes the buckets as an HdrHistogram with the V2 compressed encoding in base64,
+// as found in HdrHistogram logs.
+//
+// Every LP bucket goes whole into the HdrHistogram bucket of its midpoint, rounded to the closest unit,
+// the zero bucket going to 0. The observations collapsed by BucketsCfg.MaxLayers go at Summary.Min
+// for the underflow and Summary.Max for the overflow. HdrHistogram can't hold negative values:
+// it fails if there are any. NaNs and infinities are left out. SyncBuckets are encoded from a snapshot.
+func EncodeHdrHistogram(buckets Buckets, cfg HdrCfg) (string, error) {
+	mustCheckHdrCfg(cfg)
+	encoded, _, err := encodeHdrHistogram(buckets, cfg)
+	return encoded, err
+}
+
+// encodeHdrHistogram returns the encoded histogram with its max in units, the highest value
+// equivalent to the largest one as HdrHistogram reports it.
+func encodeHdrHistogram(buckets Buckets, cfg HdrCfg) (string, int64, error) {
+	if snapshotter, ok := buckets.(interface{ Snapshot() *UnSyncBuckets }); ok {
+		buckets = snapshotter.Snapshot()
+	}
+	bucketsCfg := bucketsCfgOf(buckets)
+	layout := newHdrLayout(1, cfg.significantDigits())
+	counts := make(map[int]uint64)
+	maxValue, maxIndex := int64(0), 0
+	var err error
+	add := func(at float64, count uint64) {
+		switch {
+		case count == 0 || err != nil || math.IsNaN(at) || math.IsInf(at, 0):
+			return
+		case at < 0:
+			err = fmt.Errorf("encode hdr histogram: negative value %g", at)
+			return
+		}
+		units := math.Round(at / cfg.unit())
+		if units >= 1<<62 {
+			err = fmt.Errorf("encode hdr histogram: value %g is too large for the unit %g", at, cfg.unit())
+			return
+		}
+		v := int64(units)
+		index := layout.index(v)
+		counts[index] += count
+		if v > maxValue {
+			maxValue, maxIndex = v, index
+		}
+	}
+	summary := buckets.Summary([]float32{})
+	add(summary.Min.ToFloat64(), summary.Underflow)
+	buckets.Range(func(bucket Bucket) {
+		add(bucketsCfg.bucketMidpoint(bucket.Value), bucket.Count)
+	})
+	add(summary.Max.ToFloat64(), summary.Overflow)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var payload bytes.Buffer
+	var header [hdrHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:], hdrEncodingCookie)
+	// header[4:8] is the payload length, header[8:12] the normalizing index offset left to 0
+	binary.BigEndian.PutUint32(header[12:], uint32(cfg.significantDigits()))
+	binary.BigEndian.PutUint64(header[16:], 1)
+	highestTrackableValue := maxValue
+	if highestTrackableValue < 2 {
+		highestTrackableValue = 2
+	}
+	binary.BigEndian.PutUint64(header[24:], uint64(highestTrackableValue))
+	binary.BigEndian.PutUint64(header[32:], math.Float64bits(1))
+	payload.Write(header[:])
+	var buf []byte
+	for index := 0; index <= maxIndex && len(counts) > 0; index++ {
+		count, ok := counts[index]
+		if !ok {
+			zeros := 1
+			for ; index+1 <= maxIndex && counts[index+1] == 0; index++ {
+				zeros++
+			}
+			if zeros == 1 {
+				buf = appendHdrVarint(buf, 0)
+			} else {
+				buf = appendHdrVarint(buf, -int64(zeros))
+			}
+			continue
+		}
+		if count > math.MaxInt64 {
+			return "", 0, fmt.Errorf("encode hdr histogram: count %d overflows an int64", count)
+		}
+		buf = appendHdrVarint(buf, int64(count))
+	}
+	payload.Write(buf)
+	binary.BigEndian.PutUint32(payload.Bytes()[4:], uint32(len(buf)))
+
+	var compressed bytes.Buffer
+	compressed.Write(make([]byte, hdrCompressedHeaderSize))
+	w := zlib.NewWriter(&compressed)
+	_, _ = w.Write(payload.Bytes())
+	_ = w.Close()
+	binary.BigEndian.PutUint32(compressed.Bytes()[0:], hdrCompressedEncodingCookie)
+	binary.BigEndian.PutUint32(compressed.Bytes()[4:], uint32(compressed.Len()-hdrCompressedHeaderSize))
+	return base64.StdEncoding.EncodeToString(compressed.Bytes()), layout.highestEquivalent(maxIndex), nil
+}
+
+// DecodeHdrHistogram decodes an HdrHistogram with the V2 compressed encoding in base64 into new buckets
+// of cfg.Buckets. The counts of every HdrHistogram bucket are inserted at its median value, the one
+// HdrHistogram reports for them, times the unit.
+func DecodeHdrHistogram(encoded string, cfg HdrCfg) (*UnSyncBuckets, error) {
+	mustCheckHdrCfg(cfg)
+	compressed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("decode hdr histogram: %s", err)
+	}
+	if len(compressed) < hdrCompressedHeaderSize ||
+		binary.BigEndian.Uint32(compressed)&^hdrCookieWordSizeMask != hdrCompressedEncodingCookie&^hdrCookieWordSizeMask {
+		return nil, errors.New("decode hdr histogram: not a V2 compressed encoding")
+	}
+	if length := binary.BigEndian.Uint32(compressed[4:]); uint64(length) != uint64(len(compressed)-hdrCompressedHeaderSize) {
+		return nil, fmt.Errorf("decode hdr histogram: %d compressed bytes, %d expected",
+			len(compressed)-hdrCompressedHeaderSize, length)
+	}
+	r, err := zlib.NewReader(bytes.NewReader(compressed[hdrCompressedHeaderSize:]))
+	if err != nil {
+		return nil, fmt.Errorf("decode hdr histogram: %s", err)
+	}
+	header := make([]byte, hdrHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("decode hdr histogram: header: %s", err)
+	}
+	if binary.BigEndian.Uint32(header)&^hdrCookieWordSizeMask != hdrEncodingCookie&^hdrCookieWordSizeMask {
+		return nil, errors.New("decode hdr histogram: not a V2 encoding")
+	}
+	payloadLength := binary.BigEndian.Uint32(header[4:])
+	significantDigits := int32(binary.BigEndian.Uint32(header[12:]))
+	lowestDiscernibleValue := int64(binary.BigEndian.Uint64(header[16:]))
+	highestTrackableValue := int64(binary.BigEndian.Uint64(header[24:]))
+	ratio := math.Float64frombits(binary.BigEndian.Uint64(header[32:]))
+	// header[8:12], the normalizing index offset, is ignored as by hdrhistogram-go, which writes 1
+	// with counts that aren't shifted
+	switch {
+	case significantDigits < 0 || significantDigits > 5:
+		return nil, fmt.Errorf("decode hdr histogram: %d significant digits", significantDigits)
+	case lowestDiscernibleValue < 1:
+		return nil, fmt.Errorf("decode hdr histogram: lowest discernible value %d", lowestDiscernibleValue)
+	case highestTrackableValue/2 < lowestDiscernibleValue:
+		return nil, fmt.Errorf("decode hdr histogram: highest trackable value %d", highestTrackableValue)
+	case !(ratio > 0) || math.IsInf(ratio, 1):
+		return nil, fmt.Errorf("decode hdr histogram: conversion ratio %g", ratio)
+	}
+	layout := newHdrLayout(lowestDiscernibleValue, int(significantDigits))
+	// every count of the highest trackable value takes 9 bytes at most,
+	// a larger length can't be trusted to size the inflated payload
+	if maxLength := 9 * (int64(layout.index(highestTrackableValue)) + 1); int64(payloadLength) > maxLength {
+		return nil, fmt.Errorf("decode hdr histogram: %d payload bytes, %d at most", payloadLength, maxLength)
+	}
+	payload, err := ioutil.ReadAll(io.LimitReader(r, int64(payloadLength)+1))
+	if err != nil {
+		return nil, fmt.Errorf("decode hdr histogram: %s", err)
+	}
+	if uint64(len(payload)) != uint64(payloadLength) {
+		return nil, fmt.Errorf("decode hdr histogram: %d payload bytes, %d expected", len(payload), payloadLength)
+	}
+
+	buckets := NewUnSyncBuckets(cfg.Buckets)
+	for index := 0; len(payload) > 0; {
+		count, n := hdrVarint(payload)
+		if n == 0 {
+			return nil, errors.New("decode hdr histogram: truncated count")
+		}
+		payload = payload[n:]
+		if count < 0 {
+			if index += int(-count); -count < 0 || index < 0 {
+				return nil, errors.New("decode hdr histogram: index overflow")
+			}
+			continue
+		}
+		if count > 0 {
+			median, ok := layout.median(index)
+			if !ok {
+				return nil, fmt.Errorf("decode hdr histogram: index %d overflows an int64", index)
+			}
+			buckets.InsertN(float64(median)*ratio*cfg.unit(), uint64(count))
+		}
+		index++
+	}
+	return buckets, nil
+}
+
+func appendHdrVarint(buf []byte, x int64) []byte {
+	v := zigzag(x)
+	for i := 0; i < 8; i++ {
+		if v < 0x80 {
+			return append(buf, byte(v))
+		}
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	// the 9th byte holds 8 bits
+	return append(buf, byte(v))
+}
+
+// hdrVarint decodes a varint of appendHdrVarint, n is 0 if buf is too short.
+func hdrVarint(buf []byte) (x int64, n int) {
+	var v uint64
+	for i := 0; i < 9 && i < len(buf); i++ {
+		if i == 8 {
+			return unzigzag(v | uint64(buf[i])<<56), 9
+		}
+		v |= uint64(buf[i]&0x7f) << (7 * uint(i))
+		if buf[i] < 0x80 {
+			return unzigzag(v), i + 1
+		}
+	}
+	return 0, 0
+}
+
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// HdrLogWriter writes histograms in the HdrHistogram log format, version 1.3, one per interval,
+// which HistogramLogAnalyzer and the HdrHistogram log processors read.
+type HdrLogWriter struct {
+	out           io.Writer
+	cfg           HdrCfg
+	base          time.Time
+	headerWritten bool
+}
+
+// NewHdrLogWriter returns a writer of logs starting at base, the intervals being timestamped relative to it.
+func NewHdrLogWriter(out io.Writer, base time.Time, cfg HdrCfg) *HdrLogWriter {
+	mustCheckHdrCfg(cfg)
+	return &HdrLogWriter{out: out, cfg: cfg, base: base}
+}
+
+// WriteInterval writes the buckets of the interval starting at start, the header first if not written yet.
+// The interval max is in millions of units, milliseconds for nanosecond units, as HdrHistogram writes it.
+func (w *HdrLogWriter) WriteInterval(start time.Time, length time.Duration, buckets Buckets) error {
+	encoded, maxValue, err := encodeHdrHistogram(buckets, w.cfg)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if !w.headerWritten {
+		base := float64(w.base.UnixNano()) / 1e9
+		fmt.Fprintf(&buf, "#[Histogram log format version 1.3]\n")
+		fmt.Fprintf(&buf, "#[StartTime: %.3f (seconds since epoch), %s]\n", base, w.base.Format(time.UnixDate))
+		fmt.Fprintf(&buf, "#[BaseTime: %.3f (seconds since epoch)]\n", base)
+		buf.WriteString(`"StartTimestamp","Interval_Length","Interval_Max","Interval_Compressed_Histogram"` + "\n")
+	}
+	fmt.Fprintf(&buf, "%.3f,%.3f,%.3f,%s\n", start.Sub(w.base).Seconds(), length.Seconds(), float64(maxValue)/hdrMaxValueUnitRatio, encoded)
+	if _, err := w.out.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	w.headerWritten = true
+	return nil
+}
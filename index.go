@@ -0,0 +1,96 @@
+package lpfloat
+
+import (
+	"sort"
+	"unsafe"
+)
+
+const (
+	layerIndexPageBits = 6
+	layerIndexPageSize = 1 << layerIndexPageBits
+	layerIndexPages    = 1 << (12 - layerIndexPageBits)
+)
+
+// layerIndex maps the sign and exponent of a value to the position of its layer in constant time.
+// The 12bits key space is split into pages which are only allocated once a layer lives in them,
+// so a histogram of clustered values needs a couple of hundred bytes for its index.
+type layerIndex struct {
+	pages [layerIndexPages]*[layerIndexPageSize]uint16 // position + 1, 0 means no layer
+}
+
+func layerKey(signAndExp int16) uint16 {
+	return uint16(signAndExp) >> 4
+}
+
+// get returns the position of the layer, or -1 if there isn't one.
+func (idx *layerIndex) get(signAndExp int16) int {
+	key := layerKey(signAndExp)
+	page := idx.pages[key>>layerIndexPageBits]
+	if page == nil {
+		return -1
+	}
+	return int(page[key&(layerIndexPageSize-1)]) - 1
+}
+
+func (idx *layerIndex) set(signAndExp int16, pos int) {
+	key := layerKey(signAndExp)
+	page := idx.pages[key>>layerIndexPageBits]
+	if page == nil {
+		page = new([layerIndexPageSize]uint16)
+		idx.pages[key>>layerIndexPageBits] = page
+	}
+	page[key&(layerIndexPageSize-1)] = uint16(pos + 1)
+}
+
+func (idx *layerIndex) clear(signAndExp int16) {
+	key := layerKey(signAndExp)
+	if page := idx.pages[key>>layerIndexPageBits]; page != nil {
+		page[key&(layerIndexPageSize-1)] = 0
+	}
+}
+
+// memoryUsage returns the bytes of the allocated pages.
+func (idx *layerIndex) memoryUsage() uint64 {
+	var usage uint64
+	for _, page := range idx.pages {
+		if page != nil {
+			usage += uint64(unsafe.Sizeof(*page))
+		}
+	}
+	return usage
+}
+
+// layerRank orders layers by the values they hold: negative layers by descending magnitude, -0, +0,
+// then positive layers by ascending magnitude.
+func layerRank(signAndExp int16) int32 {
+	if signAndExp >= 0 {
+		return int32(signAndExp)
+	}
+	return -int32(signAndExp&0x7fff) - 1
+}
+
+// insertLayer adds a layer to the ordered layers and keeps the index up to date.
+func insertLayer(layers []f64BucketsLayer, idx *layerIndex, layer f64BucketsLayer) []f64BucketsLayer {
+	rank := layerRank(layer.signAndExp)
+	pos := sort.Search(len(layers), func(i int) bool {
+		return layerRank(layers[i].signAndExp) > rank
+	})
+	layers = append(layers, f64BucketsLayer{})
+	copy(layers[pos+1:], layers[pos:])
+	layers[pos] = layer
+	for i := pos; i < len(layers); i++ {
+		idx.set(layers[i].signAndExp, i)
+	}
+	return layers
+}
+
+// removeLayer removes the layer at pos and keeps the index up to date.
+func removeLayer(layers []f64BucketsLayer, idx *layerIndex, pos int) []f64BucketsLayer {
+	idx.clear(layers[pos].signAndExp)
+	copy(layers[pos:], layers[pos+1:])
+	layers = layers[:len(layers)-1]
+	for i := pos; i < len(layers); i++ {
+		idx.set(layers[i].signAndExp, i)
+	}
+	return layers
+}
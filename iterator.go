@@ -0,0 +1,113 @@
+package lpfloat
+
+// Iterator is a pull-style iterator over non-empty buckets.
+// Iterators of UnSyncBuckets and SparseBuckets must not be used after inserting into them,
+// the ones of SyncBuckets walk a snapshot.
+//
+//	it := buckets.ReverseIterator()
+//	for i := 0; i < k && it.Next(); i++ {
+//		topK = append(topK, it.Bucket())
+//	}
+type Iterator struct {
+	cursor *layersCursor
+	bucket Bucket
+}
+
+// Next advances to the next bucket and reports whether there is one.
+func (it *Iterator) Next() bool {
+	var ok bool
+	it.bucket, ok = it.cursor.next()
+	return ok
+}
+
+// Bucket returns the current bucket.
+func (it *Iterator) Bucket() Bucket {
+	return it.bucket
+}
+
+// layeredBuckets exposes the layers of buckets implementations to cursors.
+type layeredBuckets interface {
+	layersLen() int
+	layerRankAt(layer int) int32
+	// layerLen is the number of slots of the layer, bucketAt may return empty buckets.
+	layerLen(layer int) int
+	// bucketAt returns the i-th slot of the layer in value order.
+	bucketAt(layer, i int) Bucket
+}
+
+// layersCursor walks the non-empty buckets of layeredBuckets in value order, or in reverse.
+type layersCursor struct {
+	buckets layeredBuckets
+	reverse bool
+	layer   int // steps taken over layers
+	slot    int // steps taken within the layer
+}
+
+func newLayersCursor(buckets layeredBuckets, reverse bool) *layersCursor {
+	return &layersCursor{buckets: buckets, reverse: reverse}
+}
+
+func (c *layersCursor) next() (Bucket, bool) {
+	layers := c.buckets.layersLen()
+	for c.layer < layers {
+		layer := c.layer
+		if c.reverse {
+			layer = layers - 1 - c.layer
+		}
+		slots := c.buckets.layerLen(layer)
+		for c.slot < slots {
+			i := c.slot
+			if c.reverse {
+				i = slots - 1 - c.slot
+			}
+			c.slot++
+			if bucket := c.buckets.bucketAt(layer, i); bucket.Count != 0 {
+				return bucket, true
+			}
+		}
+		c.layer++
+		c.slot = 0
+	}
+	return Bucket{}, false
+}
+
+// seek moves a forward cursor to the first layer which may hold buckets not less than lpf.
+func (c *layersCursor) seek(lpf LPFloat) {
+	rank := layerRank(lpf.SignAndExp)
+	lo, hi := 0, c.buckets.layersLen()
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if c.buckets.layerRankAt(mid) < rank {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	c.layer, c.slot = lo, 0
+}
+
+func rangeWhile(buckets layeredBuckets, reverse bool, do func(Bucket) bool) {
+	cursor := newLayersCursor(buckets, reverse)
+	for bucket, ok := cursor.next(); ok && do(bucket); bucket, ok = cursor.next() {
+	}
+}
+
+func rangeBetween(buckets layeredBuckets, loLPF, hiLPF LPFloat, do func(Bucket) bool) {
+	loOrder, hiOrder := valueOrder(loLPF), valueOrder(hiLPF)
+	cursor := newLayersCursor(buckets, false)
+	cursor.seek(loLPF)
+	for bucket, ok := cursor.next(); ok; bucket, ok = cursor.next() {
+		order := valueOrder(bucket.Value)
+		if order < loOrder {
+			continue
+		}
+		if order > hiOrder || !do(bucket) {
+			return
+		}
+	}
+}
+
+// valueOrder orders LPFloats by value, NaNs excluded.
+func valueOrder(lpf LPFloat) int64 {
+	return int64(layerRank(lpf.SignAndExp))<<8 | int64(fractionAt(lpf.SignAndExp, int(lpf.Fraction)))
+}
@@ -0,0 +1,482 @@
+package lpfloat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonVersion is the version of the JSON encoding of buckets, which goes its own way from the binary one.
+const jsonVersion = 1
+
+var (
+	_ json.Marshaler   = &UnSyncBuckets{}
+	_ json.Unmarshaler = &UnSyncBuckets{}
+	_ json.Marshaler   = &SyncBuckets{}
+	_ json.Unmarshaler = &SyncBuckets{}
+	_ json.Marshaler   = &SparseBuckets{}
+	_ json.Unmarshaler = &SparseBuckets{}
+	_ json.Marshaler   = Summary{}
+	_ json.Unmarshaler = &Summary{}
+)
+
+// bucketsJSON is the JSON encoding of buckets, see UnSyncBuckets.MarshalJSON.
+type bucketsJSON struct {
+	Version   int                `json:"version"`
+	Precision int                `json:"precision"`
+	Settings  bucketsCfgJSON     `json:"settings"`
+	Weighted  bool               `json:"weighted,omitempty"`
+	Clamped   bool               `json:"clamped,omitempty"`
+	NaN       uint64             `json:"nan,omitempty"`
+	PosInf    uint64             `json:"posInf,omitempty"`
+	NegInf    uint64             `json:"negInf,omitempty"`
+	Underflow *collapsedJSON     `json:"underflow,omitempty"`
+	Overflow  *collapsedJSON     `json:"overflow,omitempty"`
+	Layers    []bucketsLayerJSON `json:"layers"`
+}
+
+type bucketsCfgJSON struct {
+	CompensatedSum bool      `json:"compensatedSum,omitempty"`
+	MaxLayers      int       `json:"maxLayers,omitempty"`
+	ZeroThreshold  jsonFloat `json:"zeroThreshold,omitempty"`
+	KeepNonFinite  bool      `json:"keepNonFinite,omitempty"`
+	CountOverflow  string    `json:"countOverflow,omitempty"`
+}
+
+var countOverflowNames = [...]string{
+	CountOverflowWrap:     "wrap",
+	CountOverflowSaturate: "saturate",
+	CountOverflowError:    "error",
+	CountOverflowPanic:    "panic",
+}
+
+type collapsedJSON struct {
+	Count       uint64    `json:"count"`
+	ExtraWeight jsonFloat `json:"extraWeight"`
+	Sum         jsonFloat `json:"sum"`
+	SumComp     jsonFloat `json:"sumComp"`
+	Weight      jsonFloat `json:"weight"`
+	Mean        jsonFloat `json:"mean"`
+	M2          jsonFloat `json:"m2"`
+	M3          jsonFloat `json:"m3"`
+	M4          jsonFloat `json:"m4"`
+	Min         jsonFloat `json:"min"`
+	Max         jsonFloat `json:"max"`
+}
+
+type bucketsLayerJSON struct {
+	SignAndExp int16        `json:"signAndExp"`
+	Sum        jsonFloat    `json:"sum"`
+	SumComp    jsonFloat    `json:"sumComp"`
+	Pivot      jsonFloat    `json:"pivot"`
+	Moments    [4]jsonFloat `json:"moments"`
+	Buckets    []bucketJSON `json:"buckets"`
+}
+
+type bucketJSON struct {
+	Value       jsonFloat `json:"value"`
+	Count       uint64    `json:"count"`
+	ExtraWeight jsonFloat `json:"extraWeight,omitempty"`
+}
+
+// MarshalJSON encodes the buckets along with their BucketsCfg as follows,
+// zero fields but version, precision and layers being omitted:
+//
+//	{
+//	  "version": 1,
+//	  "precision": 8,
+//	  "settings": {"compensatedSum": true, "maxLayers": 16, "zeroThreshold": 1e-9,
+//	    "keepNonFinite": true, "countOverflow": "saturate"},
+//	  "weighted": true,
+//	  "clamped": true,
+//	  "nan": 1, "posInf": 2, "negInf": 3,
+//	  "underflow": {"count": 2, "extraWeight": 0.5, "sum": 0.25, "sumComp": 0, "weight": 2.5,
+//	    "mean": 0.1, "m2": 0, "m3": 0, "m4": 0, "min": 0.1, "max": 0.1},
+//	  "overflow": {...},
+//	  "layers": [
+//	    {"signAndExp": 1023, "sum": 4.5, "sumComp": 0, "pivot": 1.5, "moments": [0, 0, 0, 0],
+//	      "buckets": [{"value": 1.5, "count": 3, "extraWeight": 0.5}]}
+//	  ]
+//	}
+//
+// The fields mirror the binary encoding, see MarshalBinary. Layers are in value order and buckets
+// in fraction order, a bucket is listed if it has a count or an extra weight. Floats which are not
+// finite are written as the strings "NaN", "+Inf" and "-Inf", NaNs losing their signs and payloads.
+func (b *UnSyncBuckets) MarshalJSON() ([]byte, error) {
+	v := bucketsJSON{
+		Version:   jsonVersion,
+		Precision: encodingPrecision - b.cfg.DroppedBits,
+		Settings: bucketsCfgJSON{
+			CompensatedSum: b.cfg.CompensatedSum,
+			MaxLayers:      b.cfg.MaxLayers,
+			ZeroThreshold:  jsonFloat(b.cfg.ZeroThreshold),
+			KeepNonFinite:  b.cfg.KeepNonFinite,
+		},
+		Weighted:  b.weighted,
+		Clamped:   b.clamped,
+		NaN:       b.nonFinite.nan,
+		PosInf:    b.nonFinite.posInf,
+		NegInf:    b.nonFinite.negInf,
+		Underflow: marshalCollapsed(&b.collapsed.underflow),
+		Overflow:  marshalCollapsed(&b.collapsed.overflow),
+		Layers:    make([]bucketsLayerJSON, len(b.layers)),
+	}
+	if b.cfg.CountOverflow != CountOverflowWrap {
+		v.Settings.CountOverflow = countOverflowNames[b.cfg.CountOverflow]
+	}
+	for i := range b.layers {
+		layer := &b.layers[i]
+		l := &v.Layers[i]
+		l.SignAndExp = layer.signAndExp
+		l.Sum, l.SumComp = jsonFloat(layer.sum), jsonFloat(layer.sumComp)
+		l.Pivot = jsonFloat(layer.moments.pivot)
+		for j, s := range layer.moments.s {
+			l.Moments[j] = jsonFloat(s)
+		}
+		l.Buckets = []bucketJSON{}
+		for fraction, count := range layer.buckets {
+			extra := layer.extra.get(uint8(fraction))
+			if count == 0 && extra == 0 {
+				continue
+			}
+			l.Buckets = append(l.Buckets, bucketJSON{
+				Value:       jsonFloat(compose(layer.signAndExp, uint8(fraction)).ToFloat64()),
+				Count:       count,
+				ExtraWeight: jsonFloat(extra),
+			})
+		}
+	}
+	return json.Marshal(v)
+}
+
+func marshalCollapsed(c *collapsedBucket) *collapsedJSON {
+	if c.count == 0 {
+		return nil
+	}
+	return &collapsedJSON{
+		Count:       c.count,
+		ExtraWeight: jsonFloat(c.extra),
+		Sum:         jsonFloat(c.sum.sum),
+		SumComp:     jsonFloat(c.sum.comp),
+		Weight:      jsonFloat(c.moments.n),
+		Mean:        jsonFloat(c.moments.mean),
+		M2:          jsonFloat(c.moments.m2),
+		M3:          jsonFloat(c.moments.m3),
+		M4:          jsonFloat(c.moments.m4),
+		Min:         jsonFloat(c.min),
+		Max:         jsonFloat(c.max),
+	}
+}
+
+// UnmarshalJSON replaces the buckets and their BucketsCfg with the ones encoded by MarshalJSON.
+func (b *UnSyncBuckets) UnmarshalJSON(data []byte) error {
+	decoded, err := decodeBucketsJSON(data)
+	if err != nil {
+		return err
+	}
+	*b = *decoded
+	return nil
+}
+
+// MarshalJSON encodes a snapshot of the buckets, see UnSyncBuckets.MarshalJSON.
+func (b *SyncBuckets) MarshalJSON() ([]byte, error) {
+	return b.Snapshot().MarshalJSON()
+}
+
+// UnmarshalJSON replaces the buckets and their BucketsCfg with the ones encoded by MarshalJSON.
+// It must not run concurrently with other methods of b.
+func (b *SyncBuckets) UnmarshalJSON(data []byte) error {
+	decoded, err := decodeBucketsJSON(data)
+	if err != nil {
+		return err
+	}
+	b.replace(decoded)
+	return nil
+}
+
+// MarshalJSON encodes the buckets like UnSyncBuckets.MarshalJSON, so either can decode them.
+func (b *SparseBuckets) MarshalJSON() ([]byte, error) {
+	return b.unSync().MarshalJSON()
+}
+
+// UnmarshalJSON replaces the buckets and their BucketsCfg with the ones encoded by MarshalJSON,
+// it fails on buckets holding weighted observations.
+func (b *SparseBuckets) UnmarshalJSON(data []byte) error {
+	decoded, err := decodeBucketsJSON(data)
+	if err != nil {
+		return err
+	}
+	sparse, err := sparseBucketsOf(decoded)
+	if err != nil {
+		return fmt.Errorf("decode buckets: %s", err)
+	}
+	*b = *sparse
+	return nil
+}
+
+func decodeBucketsJSON(data []byte) (*UnSyncBuckets, error) {
+	var v bucketsJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	if v.Version != jsonVersion {
+		return nil, fmt.Errorf("decode buckets: unsupported version %d", v.Version)
+	}
+	if v.Precision < 0 || v.Precision > encodingPrecision {
+		return nil, fmt.Errorf("decode buckets: unsupported precision %d", v.Precision)
+	}
+	b := &UnSyncBuckets{
+		cfg: BucketsCfg{
+			CompensatedSum: v.Settings.CompensatedSum,
+			MaxLayers:      v.Settings.MaxLayers,
+			ZeroThreshold:  float64(v.Settings.ZeroThreshold),
+			KeepNonFinite:  v.Settings.KeepNonFinite,
+			DroppedBits:    encodingPrecision - v.Precision,
+		},
+		weighted:  v.Weighted,
+		clamped:   v.Clamped,
+		nonFinite: nonFiniteCounts{nan: v.NaN, posInf: v.PosInf, negInf: v.NegInf},
+	}
+	if name := v.Settings.CountOverflow; name != "" {
+		b.cfg.CountOverflow = -1
+		for policy := range countOverflowNames {
+			if countOverflowNames[policy] == name {
+				b.cfg.CountOverflow = CountOverflowPolicy(policy)
+			}
+		}
+	}
+	if err := CheckBucketsCfg(b.cfg); err != nil {
+		return nil, fmt.Errorf("decode buckets: %s", err)
+	}
+	unmarshalCollapsed(&b.collapsed.underflow, v.Underflow)
+	unmarshalCollapsed(&b.collapsed.overflow, v.Overflow)
+
+	for i := range v.Layers {
+		l := &v.Layers[i]
+		if l.SignAndExp&0xf != 0 {
+			return nil, fmt.Errorf("decode buckets: invalid sign and exponent %d", l.SignAndExp)
+		}
+		if i > 0 && layerRank(l.SignAndExp) <= layerRank(v.Layers[i-1].SignAndExp) {
+			return nil, errors.New("decode buckets: layers out of order")
+		}
+		layer := f64BucketsLayer{layerStats: makeLayerStats(float64(l.Pivot)), signAndExp: l.SignAndExp}
+		layer.sum, layer.sumComp = float64(l.Sum), float64(l.SumComp)
+		for j, s := range l.Moments {
+			layer.moments.s[j] = float64(s)
+		}
+		prev := -1
+		for _, bucket := range l.Buckets {
+			// NaNs lose their payloads in JSON, only the fraction of the value matters
+			lpf := FromFloat64(float64(bucket.Value))
+			if lpf.SignAndExp != l.SignAndExp && !math.IsNaN(float64(bucket.Value)) {
+				return nil, fmt.Errorf("decode buckets: bucket %v out of its layer", lpf)
+			}
+			fraction := lpf.Fraction
+			if fraction&b.cfg.droppedMask(l.SignAndExp) != 0 {
+				return nil, fmt.Errorf("decode buckets: bucket %v finer than the precision", lpf)
+			}
+			if int(fraction) <= prev {
+				return nil, fmt.Errorf("decode buckets: bucket %v duplicated or out of order", lpf)
+			}
+			prev = int(fraction)
+			layer.buckets[fraction] = bucket.Count
+			layer.count = b.cfg.addTotal(layer.count, bucket.Count)
+			if bucket.ExtraWeight != 0 {
+				if layer.extra == nil {
+					layer.extra = new(extraWeights)
+				}
+				layer.extra[fraction] = float64(bucket.ExtraWeight)
+			}
+		}
+		b.layers = append(b.layers, layer)
+		b.index.set(layer.signAndExp, i)
+	}
+	return b, nil
+}
+
+func unmarshalCollapsed(c *collapsedBucket, v *collapsedJSON) {
+	if v == nil || v.Count == 0 {
+		return
+	}
+	*c = collapsedBucket{
+		count:   v.Count,
+		sum:     neumaierSum{sum: float64(v.Sum), comp: float64(v.SumComp)},
+		moments: centralMoments{n: float64(v.Weight), mean: float64(v.Mean), m2: float64(v.M2), m3: float64(v.M3), m4: float64(v.M4)},
+		min:     float64(v.Min),
+		max:     float64(v.Max),
+		extra:   float64(v.ExtraWeight),
+	}
+}
+
+// summaryJSON is the JSON encoding of Summary, see Summary.MarshalJSON.
+type summaryJSON struct {
+	Total       uint64          `json:"total"`
+	TotalWeight jsonFloat       `json:"totalWeight,omitempty"`
+	Sum         LPFloat         `json:"sum"`
+	Avg         LPFloat         `json:"avg"`
+	Min         LPFloat         `json:"min"`
+	Max         LPFloat         `json:"max"`
+	Variance    LPFloat         `json:"variance"`
+	StdDev      LPFloat         `json:"stdDev"`
+	Skewness    LPFloat         `json:"skewness"`
+	Kurtosis    LPFloat         `json:"kurtosis"`
+	Underflow   uint64          `json:"underflow,omitempty"`
+	Overflow    uint64          `json:"overflow,omitempty"`
+	Zero        uint64          `json:"zero,omitempty"`
+	Clamped     bool            `json:"clamped,omitempty"`
+	NaN         uint64          `json:"nan,omitempty"`
+	PosInf      uint64          `json:"posInf,omitempty"`
+	NegInf      uint64          `json:"negInf,omitempty"`
+	Percentiles percentilesJSON `json:"percentiles"`
+	Unit        string          `json:"unit,omitempty"`
+	UnitSize    jsonFloat       `json:"unitSize,omitempty"`
+}
+
+// MarshalJSON encodes the summary as follows, zero fields after kurtosis being omitted:
+//
+//	{
+//	  "total": 4, "totalWeight": 4.5, "sum": 10, "avg": 2.5, "min": 1, "max": 4,
+//	  "variance": 1.25, "stdDev": 1.1171875, "skewness": 0, "kurtosis": -1.359375,
+//	  "underflow": 1, "overflow": 1, "zero": 1, "clamped": true, "nan": 1, "posInf": 1, "negInf": 1,
+//	  "percentiles": {"p50": 2, "p99.9": 4}, "unit": "ms", "unitSize": 1e6
+//	}
+//
+// The values are in recorded units, unit and unitSize are those set by Summary.InUnit.
+// Floats which are not finite, such as the statistics of empty summaries, are written as
+// the strings "NaN", "+Inf" and "-Inf".
+func (s Summary) MarshalJSON() ([]byte, error) {
+	return json.Marshal(summaryJSON{
+		Total:       s.Total,
+		TotalWeight: jsonFloat(s.TotalWeight),
+		Sum:         s.Sum,
+		Avg:         s.Avg,
+		Min:         s.Min,
+		Max:         s.Max,
+		Variance:    s.Variance,
+		StdDev:      s.StdDev,
+		Skewness:    s.Skewness,
+		Kurtosis:    s.Kurtosis,
+		Underflow:   s.Underflow,
+		Overflow:    s.Overflow,
+		Zero:        s.Zero,
+		Clamped:     s.Clamped,
+		NaN:         s.NaN,
+		PosInf:      s.PosInf,
+		NegInf:      s.NegInf,
+		Percentiles: s.Percentiles,
+		Unit:        s.Unit,
+		UnitSize:    jsonFloat(s.UnitSize),
+	})
+}
+
+// UnmarshalJSON decodes a summary encoded by MarshalJSON.
+func (s *Summary) UnmarshalJSON(data []byte) error {
+	var v summaryJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*s = Summary{
+		Total:       v.Total,
+		TotalWeight: float64(v.TotalWeight),
+		Sum:         v.Sum,
+		Avg:         v.Avg,
+		Min:         v.Min,
+		Max:         v.Max,
+		Variance:    v.Variance,
+		StdDev:      v.StdDev,
+		Skewness:    v.Skewness,
+		Kurtosis:    v.Kurtosis,
+		Underflow:   v.Underflow,
+		Overflow:    v.Overflow,
+		Zero:        v.Zero,
+		Clamped:     v.Clamped,
+		NaN:         v.NaN,
+		PosInf:      v.PosInf,
+		NegInf:      v.NegInf,
+		Percentiles: v.Percentiles,
+		Unit:        v.Unit,
+		UnitSize:    float64(v.UnitSize),
+	}
+	return nil
+}
+
+// percentilesJSON encodes percentiles as an object keyed like "p99", in ascending order.
+type percentilesJSON []PercentilePair
+
+func percentileKey(p float32) string {
+	return "p" + strconv.FormatFloat(float64(p), 'g', -1, 32)
+}
+
+func (p percentilesJSON) MarshalJSON() ([]byte, error) {
+	buf := []byte{'{'}
+	for i, pair := range p {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = strconv.AppendQuote(buf, percentileKey(pair.Percentile))
+		buf = append(buf, ':')
+		value, err := pair.LessThan.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, value...)
+	}
+	return append(buf, '}'), nil
+}
+
+func (p *percentilesJSON) UnmarshalJSON(data []byte) error {
+	var m map[string]LPFloat
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	pairs := make([]PercentilePair, 0, len(m))
+	for key, lessThan := range m {
+		percentile, err := strconv.ParseFloat(strings.TrimPrefix(key, "p"), 32)
+		if err != nil || !strings.HasPrefix(key, "p") {
+			return fmt.Errorf("invalid percentile %q", key)
+		}
+		pairs = append(pairs, PercentilePair{Percentile: float32(percentile), LessThan: lessThan})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Percentile < pairs[j].Percentile
+	})
+	*p = pairs
+	return nil
+}
+
+// jsonFloat is a float64 which JSON encoding admits NaNs and infinities as "NaN", "+Inf" and "-Inf".
+// "-NaN", written by former versions, is decoded too.
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	switch v := float64(f); {
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(v, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Inf"`), nil
+	default:
+		return json.Marshal(v)
+	}
+}
+
+func (f *jsonFloat) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case `"NaN"`:
+		*f = jsonFloat(math.NaN())
+	case `"-NaN"`:
+		*f = jsonFloat(math.Copysign(math.NaN(), -1))
+	case `"+Inf"`:
+		*f = jsonFloat(math.Inf(1))
+	case `"-Inf"`:
+		*f = jsonFloat(math.Inf(-1))
+	default:
+		return json.Unmarshal(data, (*float64)(f))
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package lpfloat
+
+// layerStats are the statistics of all the values inserted into a layer.
+type layerStats struct {
+	count   uint64
+	sum     float64
+	sumComp float64 // compensation of sum, only used with BucketsCfg.CompensatedSum
+	moments layerMoments
+}
+
+func makeLayerStats(pivot float64) layerStats {
+	return layerStats{moments: makeLayerMoments(pivot)}
+}
+
+func (s *layerStats) add(f float64, count uint64, compensated bool) {
+	s.count += count
+	s.addSum(f*float64(count), compensated)
+	s.moments.add(f, count)
+}
+
+// addWeight adds count observations of f weighing weight altogether, the sums and moments are weighted.
+func (s *layerStats) addWeight(f float64, count uint64, weight float64, compensated bool) {
+	s.count += count
+	s.addSum(f*weight, compensated)
+	s.moments.addWeight(f, weight)
+}
+
+// remove takes count observations of f weighing weight altogether back out.
+func (s *layerStats) remove(f float64, count uint64, weight float64, compensated bool) {
+	s.count -= count
+	s.addSum(-f*weight, compensated)
+	s.moments.addWeight(f, -weight)
+}
+
+// merge adds the statistics of another layer of the same exponent.
+func (s *layerStats) merge(o *layerStats) {
+	s.count += o.count
+	s.addSum(o.sum, true)
+	s.addSum(o.sumComp, true)
+	moments := o.moments.rebase(s.moments.pivot, float64(o.count))
+	s.moments.merge(&moments)
+}
+
+func (s *layerStats) addSum(f float64, compensated bool) {
+	if !compensated {
+		s.sum += f
+		return
+	}
+	t := s.sum + f
+	s.sumComp += twoSumErr(s.sum, f, t)
+	s.sum = t
+}
+
+func (s *layerStats) reset() {
+	s.count = 0
+	s.sum = 0
+	s.sumComp = 0
+	s.moments.reset()
+}
+
+// fitWeight is the weight of the fit observations out of count weighing weight altogether.
+func fitWeight(weight float64, fit, count uint64) float64 {
+	if fit == count {
+		return weight
+	}
+	return weight * float64(fit) / float64(count)
+}
+
+type f64BucketsLayer struct {
+	layerStats
+	signAndExp int16
+	buckets    [256]uint64
+	extra      *extraWeights // allocated by the first weighted insert
+}
+
+// extraWeights are the weights of buckets beyond their counts, so a bucket weighs its count plus
+// its extra weight and the buckets nobody inserted weighted values into don't pay for weights.
+type extraWeights [256]float64
+
+// sum returns the extra weight of a layer.
+func (w *extraWeights) sum() float64 {
+	if w == nil {
+		return 0
+	}
+	var sum neumaierSum
+	for i := range w {
+		sum.add(w[i])
+	}
+	return sum.value()
+}
+
+func (w *extraWeights) get(fraction uint8) float64 {
+	if w == nil {
+		return 0
+	}
+	return w[fraction]
+}
+
+// take removes the share of count observations out of the held ones of a bucket from its extra weight,
+// as the observations of a bucket are indistinguishable, and returns it.
+func (w *extraWeights) take(fraction uint8, count, held uint64) float64 {
+	if w == nil || w[fraction] == 0 {
+		return 0
+	}
+	share := w[fraction]
+	if count != held {
+		share *= float64(count) / float64(held)
+	}
+	w[fraction] -= share
+	return share
+}
+
+// addWeight adds count observations of f weighing weight altogether.
+func (l *f64BucketsLayer) addWeight(f float64, fraction uint8, count uint64, weight float64, compensated bool) {
+	l.layerStats.addWeight(f, count, weight, compensated)
+	l.buckets[fraction] += count
+	if extra := weight - float64(count); extra != 0 {
+		if l.extra == nil {
+			l.extra = new(extraWeights)
+		}
+		l.extra[fraction] += extra
+	}
+}
+
+// fractionAt returns the fraction of the i-th bucket in value order,
+// the magnitude of negative values decreases as the fraction grows.
+func (l *f64BucketsLayer) fractionAt(i int) uint8 {
+	return fractionAt(l.signAndExp, i)
+}
+
+func fractionAt(signAndExp int16, i int) uint8 {
+	if signAndExp < 0 {
+		return uint8(0xff - i)
+	}
+	return uint8(i)
+}
+
+// valueRange returns the values of the lowest and the highest non-empty buckets.
+func (l *f64BucketsLayer) valueRange() (min, max float64) {
+	for i := range l.buckets {
+		if fraction := l.fractionAt(i); l.buckets[fraction] != 0 {
+			min = compose(l.signAndExp, fraction).ToFloat64()
+			break
+		}
+	}
+	for i := range l.buckets {
+		if fraction := l.fractionAt(0xff - i); l.buckets[fraction] != 0 {
+			max = compose(l.signAndExp, fraction).ToFloat64()
+			break
+		}
+	}
+	return min, max
+}
@@ -1,13 +1,32 @@
 package lpfloat
 
 import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"math"
+	"math/big"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 	"unsafe"
@@ -127,7 +146,7 @@ func BenchmarkAtomicAddFloat64(b *testing.B) {
 }
 
 func TestBuckets(t *testing.T) {
-	bucketsList := []Buckets{new(UnSyncBuckets), new(SyncBuckets)}
+	bucketsList := []Buckets{new(UnSyncBuckets), new(SyncBuckets), new(SparseBuckets)}
 
 	const size = 1000000
 	const maxVal = 100
@@ -173,6 +192,2222 @@ func TestBuckets(t *testing.T) {
 	check()
 }
 
+func TestBuckets_WideRange(t *testing.T) {
+	data := wideRangeData(100000)
+	plainSummary := calPlainSummary(data, DefaultPercentilesCfg())
+	plainBuckets := calPlainBuckets(data)
+	for _, buckets := range []Buckets{new(UnSyncBuckets), new(SyncBuckets), new(SparseBuckets)} {
+		for _, val := range data {
+			buckets.Insert(val)
+		}
+		if summary := buckets.Summary(DefaultPercentilesCfg()); !reflect.DeepEqual(plainSummary, summary) {
+			t.Fatalf("%T summary,\nexpected:\t%v\nactual:\t%v", buckets, plainSummary, summary)
+		}
+		if !reflect.DeepEqual(plainBuckets, buckets.Buckets()) {
+			t.Fatalf("%T buckets", buckets)
+		}
+		for _, val := range data[:1000] {
+			if expected := plainCount(plainBuckets, val); buckets.Count(val) != expected {
+				t.Fatalf("%T count of %g, expected %d, actual %d", buckets, val, expected, buckets.Count(val))
+			}
+		}
+	}
+}
+
+func TestSparseBuckets_Counters(t *testing.T) {
+	var buckets SparseBuckets
+	counts := []uint64{1, 0xff, 0x100, 0xffff, 0x10000, 0xffffffff, 0x100000000, math.MaxUint64 / 4}
+	for i, count := range counts {
+		buckets.InsertN(float64(i+1), count)
+	}
+	for i, count := range counts {
+		if actual := buckets.Count(float64(i + 1)); actual != count {
+			t.Fatalf("count of %d, expected %d, actual %d", i+1, count, actual)
+		}
+	}
+	buckets.InsertN(1, math.MaxUint64/2)
+	if actual := buckets.Count(1); actual != math.MaxUint64/2+1 {
+		t.Fatalf("count of 1, expected %d, actual %d", uint64(math.MaxUint64/2+1), actual)
+	}
+}
+
+func TestBuckets_MemoryUsage(t *testing.T) {
+	var unSync UnSyncBuckets
+	var sparse SparseBuckets
+	for _, val := range randomData(1000, 1, 1000) {
+		unSync.Insert(val)
+		sparse.Insert(val)
+	}
+	if sparse.MemoryUsage() >= unSync.MemoryUsage()/2 {
+		t.Fatalf("sparse buckets use %d bytes, unsync buckets %d bytes", sparse.MemoryUsage(), unSync.MemoryUsage())
+	}
+	if unSync.MemoryUsage() < uint64(len(unSync.layers))*2048 {
+		t.Fatalf("unsync buckets use at least 2KiB per layer, reported %d bytes", unSync.MemoryUsage())
+	}
+}
+
+func TestSyncBuckets_Concurrent(t *testing.T) {
+	var buckets SyncBuckets
+	data := wideRangeData(10000)
+	const writers = 8
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		// readers run alongside the writers
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				_ = buckets.Summary(nil)
+				_ = buckets.Total()
+				_ = buckets.Sum()
+				_ = buckets.Count(data[0])
+				buckets.ReverseRange(func(Bucket) {})
+			}
+		}
+	}()
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			insertBuckets(&buckets, data)
+		}()
+	}
+	wg.Wait()
+	close(done)
+
+	var expected UnSyncBuckets
+	for i := 0; i < writers; i++ {
+		insertBuckets(&expected, data)
+	}
+	if !reflect.DeepEqual(expected.Buckets(), buckets.Buckets()) {
+		t.Fatal("buckets mismatch")
+	}
+	if expected.Total() != buckets.Total() {
+		t.Fatalf("total, expected %d, actual %d", expected.Total(), buckets.Total())
+	}
+	if relErr := math.Abs(expected.Sum()-buckets.Sum()) / math.Abs(expected.Sum()); relErr > 1e-9 {
+		t.Fatalf("sum, expected %g, actual %g", expected.Sum(), buckets.Sum())
+	}
+}
+
+func TestSyncBuckets_RangeDoesNotBlock(t *testing.T) {
+	var buckets SyncBuckets
+	buckets.Insert(1)
+
+	// a callback inserting new layers must not deadlock
+	buckets.Range(func(bucket Bucket) {
+		buckets.Insert(bucket.Value.ToFloat64() * 1000)
+	})
+	if buckets.Count(1000) != 1 {
+		t.Fatalf("count of 1000, expected 1, actual %d", buckets.Count(1000))
+	}
+
+	// a slow callback must not stall writers
+	var once sync.Once
+	inRange, release, ranged := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go func() {
+		buckets.ReverseRange(func(Bucket) {
+			once.Do(func() { close(inRange) })
+			<-release
+		})
+		close(ranged)
+	}()
+	<-inRange
+	inserted := make(chan struct{})
+	go func() {
+		buckets.Insert(1e9)
+		buckets.Reset()
+		close(inserted)
+	}()
+	select {
+	case <-inserted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("writers are blocked by a callback")
+	}
+	close(release)
+	<-ranged
+}
+
+func TestBuckets_Iterate(t *testing.T) {
+	data := wideRangeData(10000)
+	plainBuckets := calPlainBuckets(data)
+	for _, buckets := range []IterableBuckets{new(UnSyncBuckets), new(SyncBuckets), new(SparseBuckets)} {
+		insertBuckets(buckets, data)
+
+		var first Bucket
+		visited := 0
+		buckets.RangeWhile(func(bucket Bucket) bool {
+			visited++
+			first = bucket
+			return bucket.Value.ToFloat64() <= 1
+		})
+		if first.Value.ToFloat64() <= 1 || visited != sort.Search(len(plainBuckets), func(i int) bool {
+			return plainBuckets[i].Value.ToFloat64() > 1
+		})+1 {
+			t.Fatalf("%T first bucket above 1 is %v after %d buckets", buckets, first.Value, visited)
+		}
+
+		var topK []Bucket
+		it := buckets.ReverseIterator()
+		for len(topK) < 10 && it.Next() {
+			topK = append(topK, it.Bucket())
+		}
+		for i, bucket := range topK {
+			expected := plainBuckets[len(plainBuckets)-1-i]
+			expected.Count *= 3
+			if bucket != expected {
+				t.Fatalf("%T top %d, expected %v, actual %v", buckets, i, expected, bucket)
+			}
+		}
+
+		var all []Bucket
+		for it := buckets.Iterator(); it.Next(); {
+			all = append(all, it.Bucket())
+		}
+		if !reflect.DeepEqual(all, buckets.Buckets()) {
+			t.Fatalf("%T iterator", buckets)
+		}
+
+		for _, bounds := range [][2]float64{{-1, 1}, {1e-3, 1e-3}, {-1e9, -1e-9}, {0.5, 1e9}, {2, 1}} {
+			var between []Bucket
+			buckets.RangeBetween(bounds[0], bounds[1], func(bucket Bucket) bool {
+				between = append(between, bucket)
+				return true
+			})
+			var expected []Bucket
+			for _, bucket := range all {
+				if bounds[0] > bounds[1] {
+					break
+				}
+				if bucket.Value == FromFloat64(bounds[0]) || bucket.Value == FromFloat64(bounds[1]) ||
+					bucket.Value.ToFloat64() >= bounds[0] && bucket.Value.ToFloat64() <= bounds[1] {
+					expected = append(expected, bucket)
+				}
+			}
+			if !reflect.DeepEqual(expected, between) {
+				t.Fatalf("%T between %g and %g,\nexpected:\t%v\nactual:\t%v", buckets, bounds[0], bounds[1], expected, between)
+			}
+		}
+	}
+}
+
+func TestBuckets_MaxLayers(t *testing.T) {
+	cfg := BucketsCfg{MaxLayers: 3}
+	for _, buckets := range []Buckets{NewUnSyncBuckets(cfg), NewSyncBuckets(cfg), NewSparseBuckets(cfg)} {
+		buckets.Insert(1)
+		buckets.InsertN(4, 3)
+		buckets.InsertN(16, 2)
+		buckets.Insert(0.1) // underflow
+		buckets.Insert(100) // overflow
+		buckets.Insert(2)   // evicts the layer of 1, which has fewer observations than the one of 16
+
+		expectedBuckets := []Bucket{{FromFloat64(2), 1}, {FromFloat64(4), 3}, {FromFloat64(16), 2}}
+		if !reflect.DeepEqual(expectedBuckets, buckets.Buckets()) {
+			t.Fatalf("%T buckets %v", buckets, buckets.Buckets())
+		}
+		if buckets.Total() != 9 || buckets.Sum() != 147.1 {
+			t.Fatalf("%T total %d, sum %g", buckets, buckets.Total(), buckets.Sum())
+		}
+		summary := buckets.Summary([]float32{10, 50, 99})
+		if summary.Underflow != 2 || summary.Overflow != 1 || summary.Total != 9 {
+			t.Fatalf("%T summary %v", buckets, summary)
+		}
+		if summary.Min != FromFloat64(0.1) || summary.Max != FromFloat64(100) {
+			t.Fatalf("%T min %v, max %v", buckets, summary.Min, summary.Max)
+		}
+		if summary.Percentiles[0].LessThan != FromFloat64(1) || summary.Percentiles[1].LessThan != FromFloat64(4) ||
+			summary.Percentiles[2].LessThan != FromFloat64(100) {
+			t.Fatalf("%T percentiles %v", buckets, summary.Percentiles)
+		}
+
+		buckets.Reset()
+		if buckets.Total() != 0 || buckets.Summary(nil).Underflow != 0 {
+			t.Fatalf("%T reset", buckets)
+		}
+	}
+
+	if err := CheckBucketsCfg(BucketsCfg{MaxLayers: -1}); err == nil {
+		t.Fatal("negative max layers should be invalid")
+	}
+}
+
+func TestBuckets_MaxLayersAfterReset(t *testing.T) {
+	cfg := BucketsCfg{MaxLayers: 3}
+	for _, buckets := range []RemovableBuckets{NewUnSyncBuckets(cfg), NewSyncBuckets(cfg), NewSparseBuckets(cfg)} {
+		buckets.Insert(1)
+		buckets.Insert(2)
+		buckets.Insert(4)
+		buckets.Reset()
+		// the empty layers kept by Reset make room for new ones
+		for _, val := range []float64{100, 1000, 0.01} {
+			buckets.Insert(val)
+			if buckets.Count(val) != 1 {
+				t.Fatalf("%T %v collapsed after reset, %v", buckets, val, buckets.Summary(nil))
+			}
+		}
+		if summary := buckets.Summary(nil); summary.Underflow != 0 || summary.Overflow != 0 {
+			t.Fatalf("%T after reset %v", buckets, summary)
+		}
+
+		// the values collapsed already stay below and above the layers
+		buckets.Insert(1e-3)
+		buckets.Insert(1e4)
+		if err := buckets.Remove(100); err != nil {
+			t.Fatal(err)
+		}
+		for _, val := range []float64{1e-4, 1e5} {
+			buckets.Insert(val)
+		}
+		buckets.Insert(10)
+		summary := buckets.Summary(nil)
+		if summary.Total != 7 || summary.Underflow+summary.Overflow != 4 || buckets.Count(10) != 1 || buckets.Count(1000) != 1 {
+			t.Fatalf("%T collapsed %v", buckets, summary)
+		}
+	}
+}
+
+func TestSyncBuckets_MaxLayersConcurrent(t *testing.T) {
+	buckets := NewSyncBuckets(BucketsCfg{MaxLayers: 8})
+	data := wideRangeData(10000)
+	const writers = 8
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			insertBuckets(buckets, data)
+		}()
+	}
+	wg.Wait()
+
+	if layers := len(buckets.loadTable().layers); layers > 8 {
+		t.Fatalf("%d layers", layers)
+	}
+	summary := buckets.Summary(nil)
+	var inBuckets uint64
+	buckets.Range(func(bucket Bucket) {
+		inBuckets += bucket.Count
+	})
+	if expected := uint64(writers * len(data) * 3); summary.Total != expected ||
+		inBuckets+summary.Underflow+summary.Overflow != expected {
+		t.Fatalf("expected %d observations, summary %v, %d in buckets", expected, summary, inBuckets)
+	}
+}
+
+func TestBuckets_ResetAndCompact(t *testing.T) {
+	data := wideRangeData(10000)
+	for _, buckets := range []CompactableBuckets{NewUnSyncBuckets(BucketsCfg{}), NewSyncBuckets(BucketsCfg{}),
+		NewSparseBuckets(BucketsCfg{})} {
+		layered := func() int {
+			if b, ok := buckets.(*SyncBuckets); ok {
+				return len(b.loadTable().layers)
+			}
+			return buckets.(layeredBuckets).layersLen()
+		}
+		memoryUsage := buckets.(MemoryUsageBuckets).MemoryUsage
+		insertBuckets(buckets, data)
+		layers, usage := layered(), memoryUsage()
+
+		buckets.Reset()
+		if layered() != layers || memoryUsage() < usage {
+			t.Fatalf("%T reset should keep %d layers, %d left", buckets, layers, layered())
+		}
+		buckets.Insert(1)
+		buckets.Compact()
+		if layered() != 1 || buckets.Count(1) != 1 || memoryUsage() >= usage {
+			t.Fatalf("%T compact left %d layers, %d bytes", buckets, layered(), memoryUsage())
+		}
+		insertBuckets(buckets, data)
+		expected := &UnSyncBuckets{}
+		insertBuckets(expected, data)
+		expected.Insert(1)
+		if !reflect.DeepEqual(expected.Buckets(), buckets.Buckets()) {
+			t.Fatalf("%T buckets after compact", buckets)
+		}
+
+		buckets.ResetWith(ResetReleaseLayers)
+		if layered() != 0 || buckets.Total() != 0 || memoryUsage() >= usage {
+			t.Fatalf("%T release left %d layers, %d bytes", buckets, layered(), memoryUsage())
+		}
+		insertBuckets(buckets, data)
+		expected = &UnSyncBuckets{}
+		insertBuckets(expected, data)
+		if !reflect.DeepEqual(expected.Buckets(), buckets.Buckets()) {
+			t.Fatalf("%T buckets after release", buckets)
+		}
+	}
+}
+
+func TestSyncBuckets_CompactConcurrent(t *testing.T) {
+	buckets := NewSyncBuckets(BucketsCfg{})
+	// an insert holding a stripe of an empty layer while Compact runs
+	lpf := FromFloat64(1)
+	buckets.Insert(1)
+	buckets.Reset()
+	layer := buckets.loadTable().get(lpf.SignAndExp)
+	stripe, _ := layer.lock()
+	compacted := make(chan struct{})
+	go func() {
+		defer close(compacted)
+		buckets.Compact()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	layer.add(stripe, 1, lpf.Fraction, 1, 1, false)
+	stripe.unlock()
+	<-compacted
+	if buckets.Count(1) != 1 || buckets.Total() != 1 {
+		t.Fatalf("insert lost by compact, %v", buckets.Buckets())
+	}
+
+	data := wideRangeData(10000)
+	const writers = 4
+
+	for round := 0; round < 10; round++ {
+		// empty layers for the writers to race with Compact
+		insertBuckets(buckets, data)
+		buckets.Reset()
+
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				insertBuckets(buckets, data)
+			}()
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				buckets.Compact()
+				runtime.Gosched()
+			}
+		}()
+		wg.Wait()
+		<-done
+
+		if expected, total := uint64(writers*len(data)*3), buckets.Total(); total != expected {
+			t.Fatalf("round %d, expected %d observations, actual %d", round, expected, total)
+		}
+	}
+}
+
+func TestSyncBuckets_ResetReleaseLayersConcurrent(t *testing.T) {
+	buckets := NewSyncBuckets(BucketsCfg{})
+	// an insert which found the layer of 1 before the reset and locks it after
+	buckets.Insert(1)
+	layer := buckets.loadTable().get(FromFloat64(1).SignAndExp)
+	buckets.ResetWith(ResetReleaseLayers)
+	if stripe, ok := layer.lock(); ok {
+		stripe.unlock()
+		t.Fatal("insert into a released layer")
+	}
+	buckets.Insert(1)
+	if buckets.Count(1) != 1 || buckets.Total() != 1 {
+		t.Fatalf("insert lost by reset, %v", buckets.Buckets())
+	}
+
+	// the inserts done after a reset returns are kept, but one per writer which may have locked
+	// a layer before it was released
+	data := wideRangeData(1000)
+	const writers = 4
+	for round := 0; round < 10; round++ {
+		var inserted, stop uint64
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; atomic.LoadUint64(&stop) == 0; j++ {
+					buckets.Insert(data[j%len(data)])
+					atomic.AddUint64(&inserted, 1)
+					if j%64 == 0 {
+						runtime.Gosched()
+					}
+				}
+			}()
+		}
+		var since uint64
+		for i := 0; i < 100; i++ {
+			buckets.ResetWith(ResetReleaseLayers)
+			since = atomic.LoadUint64(&inserted)
+			for atomic.LoadUint64(&inserted) < since+100 {
+				runtime.Gosched()
+			}
+		}
+		atomic.StoreUint64(&stop, 1)
+		wg.Wait()
+
+		if expected, total := atomic.LoadUint64(&inserted)-since, buckets.Total(); total+writers < expected {
+			t.Fatalf("round %d, expected %d observations at least, actual %d", round, expected-writers, total)
+		}
+	}
+}
+
+func TestBuckets_ZeroThreshold(t *testing.T) {
+	cfg := BucketsCfg{ZeroThreshold: 1e-6}
+	data := []float64{1e-300, -1e-9, 0, math.Copysign(0, -1), 5e-7, 1, 2, -3}
+	for _, buckets := range []Buckets{NewUnSyncBuckets(cfg), NewSyncBuckets(cfg), NewSparseBuckets(cfg)} {
+		for _, val := range data {
+			buckets.Insert(val)
+		}
+		expectedBuckets := []Bucket{{FromFloat64(-3), 1}, {Zero(), 5}, {FromFloat64(1), 1}, {FromFloat64(2), 1}}
+		if !reflect.DeepEqual(expectedBuckets, buckets.Buckets()) {
+			t.Fatalf("%T buckets %v", buckets, buckets.Buckets())
+		}
+		if buckets.Count(-1e-7) != 5 {
+			t.Fatalf("%T count of the zero bucket %d", buckets, buckets.Count(-1e-7))
+		}
+		if expected := 5e-7 - 1e-9; buckets.Sum() != expected {
+			t.Fatalf("%T sum, expected %g, actual %g", buckets, expected, buckets.Sum())
+		}
+		summary := buckets.Summary(nil)
+		if summary.Zero != 5 || summary.Total != 8 || summary.Percentiles[0].LessThan != Zero() {
+			t.Fatalf("%T summary %v", buckets, summary)
+		}
+	}
+
+	for _, threshold := range []float64{-1, math.NaN(), math.Inf(1)} {
+		if err := CheckBucketsCfg(BucketsCfg{ZeroThreshold: threshold}); err == nil {
+			t.Fatalf("zero threshold %g should be invalid", threshold)
+		}
+	}
+}
+
+func TestBuckets_NonFinite(t *testing.T) {
+	insert := func(buckets Buckets) {
+		buckets.Insert(1)
+		buckets.Insert(math.NaN())
+		buckets.InsertN(math.Inf(1), 2)
+		buckets.Insert(2)
+		buckets.Insert(math.Inf(-1))
+	}
+	for _, buckets := range []Buckets{new(UnSyncBuckets), new(SyncBuckets), new(SparseBuckets)} {
+		insert(buckets)
+		summary := buckets.Summary(nil)
+		if summary.Total != 2 || summary.Sum != FromFloat64(3) || summary.Max != FromFloat64(2) ||
+			summary.NaN != 1 || summary.PosInf != 2 || summary.NegInf != 1 {
+			t.Fatalf("%T summary %v", buckets, summary)
+		}
+		if buckets.Total() != 2 || buckets.Sum() != 3 || buckets.Count(math.Inf(1)) != 2 || len(buckets.Buckets()) != 2 {
+			t.Fatalf("%T total %d, sum %g, buckets %v", buckets, buckets.Total(), buckets.Sum(), buckets.Buckets())
+		}
+		buckets.Reset()
+		if summary := buckets.Summary(nil); summary.NaN != 0 || summary.PosInf != 0 || summary.NegInf != 0 {
+			t.Fatalf("%T reset summary %v", buckets, summary)
+		}
+	}
+
+	cfg := BucketsCfg{KeepNonFinite: true}
+	for _, buckets := range []Buckets{NewUnSyncBuckets(cfg), NewSyncBuckets(cfg), NewSparseBuckets(cfg)} {
+		insert(buckets)
+		summary := buckets.Summary(nil)
+		if summary.Total != 6 || summary.NaN != 0 || !math.IsNaN(buckets.Sum()) {
+			t.Fatalf("%T summary %v", buckets, summary)
+		}
+	}
+}
+
+func TestBuckets_Moments(t *testing.T) {
+	data := []float64{2, 4, 4, 4, 5, 5, 7, 9}
+	for _, buckets := range []Buckets{new(UnSyncBuckets), new(SyncBuckets), new(SparseBuckets)} {
+		// shift far away from zero to make sure the variance survives large offsets
+		for _, val := range data {
+			buckets.Insert(val + 1e9)
+		}
+		summary := buckets.Summary(nil)
+		if !summary.Variance.AlmostEqualF64(4) || !summary.StdDev.AlmostEqualF64(2) {
+			t.Fatalf("%T variance %v, stddev %v", buckets, summary.Variance, summary.StdDev)
+		}
+		if !summary.Skewness.AlmostEqualF64(0.65625) || !summary.Kurtosis.AlmostEqualF64(-0.21875) {
+			t.Fatalf("%T skewness %v, kurtosis %v", buckets, summary.Skewness, summary.Kurtosis)
+		}
+	}
+}
+
+func TestBuckets_Remove(t *testing.T) {
+	data := randomData(2000, 1, 1000)
+	const window = 100
+	for _, buckets := range []RemovableBuckets{new(UnSyncBuckets), new(SyncBuckets), new(SparseBuckets)} {
+		for i, val := range data {
+			buckets.Insert(val)
+			if i >= window {
+				if err := buckets.Remove(data[i-window]); err != nil {
+					t.Fatalf("%T remove %v: %v", buckets, data[i-window], err)
+				}
+			}
+		}
+		expected := calPlainSummary(data[len(data)-window:], DefaultPercentilesCfg())
+		summary := buckets.Summary(DefaultPercentilesCfg())
+		if !reflect.DeepEqual(calPlainBuckets(data[len(data)-window:]), buckets.Buckets()) ||
+			summary.Total != window || summary.Min != expected.Min || summary.Max != expected.Max ||
+			!reflect.DeepEqual(expected.Percentiles, summary.Percentiles) {
+			t.Fatalf("%T sliding window, expected %v, actual %v", buckets, expected, summary)
+		}
+		if !summary.Sum.AlmostEqual(expected.Sum) || !summary.Variance.AlmostEqual(expected.Variance) {
+			t.Fatalf("%T sliding window sum %v, variance %v, expected %v, %v",
+				buckets, summary.Sum, summary.Variance, expected.Sum, expected.Variance)
+		}
+
+		total := buckets.Total()
+		for _, val := range []float64{data[len(data)-1] * 1e6, math.NaN(), -1} {
+			if err := buckets.Remove(val); !errors.Is(err, ErrCountUnderflow) {
+				t.Fatalf("%T remove %v: %v", buckets, val, err)
+			}
+		}
+		held := buckets.Count(data[len(data)-1])
+		if err := buckets.RemoveN(data[len(data)-1], held+1); !errors.Is(err, ErrCountUnderflow) ||
+			buckets.Total() != total || buckets.Count(data[len(data)-1]) != held {
+			t.Fatalf("%T remove too much: %v", buckets, err)
+		}
+		buckets.InsertN(math.Inf(1), 2)
+		if err := buckets.RemoveN(math.Inf(1), 2); err != nil || buckets.Summary(nil).PosInf != 0 {
+			t.Fatalf("%T remove +Inf: %v", buckets, err)
+		}
+	}
+}
+
+func TestBuckets_RemoveCollapsed(t *testing.T) {
+	cfg := BucketsCfg{MaxLayers: 2}
+	data := []float64{1, 2, 4, 8, 16, 0.5, 0.25}
+	for _, buckets := range []RemovableBuckets{NewUnSyncBuckets(cfg), NewSyncBuckets(cfg), NewSparseBuckets(cfg)} {
+		for _, val := range data {
+			buckets.InsertN(val, 2)
+		}
+		if summary := buckets.Summary(nil); summary.Underflow == 0 || summary.Overflow == 0 {
+			t.Fatalf("%T nothing collapsed, %v", buckets, summary)
+		}
+		for _, val := range data {
+			if err := buckets.Remove(val); err != nil {
+				t.Fatalf("%T remove %v: %v", buckets, val, err)
+			}
+		}
+		summary := buckets.Summary(nil)
+		expected := calPlainSummary(data, nil)
+		if summary.Total != uint64(len(data)) || !summary.Sum.AlmostEqualF64(31.75) ||
+			!summary.Variance.AlmostEqual(expected.Variance) || !summary.Skewness.AlmostEqual(expected.Skewness) ||
+			!summary.Kurtosis.AlmostEqual(expected.Kurtosis) {
+			t.Fatalf("%T half removed, %v", buckets, summary)
+		}
+		for _, val := range data {
+			if err := buckets.Remove(val); err != nil {
+				t.Fatalf("%T remove %v: %v", buckets, val, err)
+			}
+		}
+		if summary := buckets.Summary(nil); summary.Total != 0 || summary.Underflow != 0 || summary.Overflow != 0 {
+			t.Fatalf("%T all removed, %v", buckets, summary)
+		}
+	}
+}
+
+func TestWindowedBuckets(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	cfg := WindowCfg{Interval: 10 * time.Second, Intervals: 6, Now: func() time.Time { return now }}
+	type windowed interface {
+		Insert(float64)
+		SummaryOver(time.Duration, []float32) Summary
+		Summary([]float32) Summary
+		Reset()
+	}
+	for _, buckets := range []windowed{NewUnSyncWindowedBuckets(cfg), NewSyncWindowedBuckets(cfg)} {
+		now = time.Unix(1600000000, 0)
+		var data [][]float64
+		for i := 0; i < 8; i++ {
+			data = append(data, randomData(100, float64(i+1), float64(i+2)))
+			for _, val := range data[i] {
+				buckets.Insert(val)
+			}
+			now = now.Add(cfg.Interval)
+		}
+		now = now.Add(-time.Second) // still in the interval of data[7]
+
+		for _, c := range []struct {
+			last time.Duration
+			from int
+		}{{time.Second, 7}, {10 * time.Second, 7}, {11 * time.Second, 6}, {30 * time.Second, 5},
+			{0, 2}, {time.Hour, 2}} {
+			var expected []float64
+			for _, d := range data[c.from:] {
+				expected = append(expected, d...)
+			}
+			plain := calPlainSummary(expected, DefaultPercentilesCfg())
+			summary := buckets.SummaryOver(c.last, DefaultPercentilesCfg())
+			if summary.Total != plain.Total || summary.Min != plain.Min || summary.Max != plain.Max ||
+				!reflect.DeepEqual(plain.Percentiles, summary.Percentiles) ||
+				!summary.Sum.AlmostEqual(plain.Sum) || !summary.Variance.AlmostEqual(plain.Variance) {
+				t.Fatalf("%T last %v, expected %v, actual %v", buckets, c.last, plain, summary)
+			}
+		}
+
+		// intervals without inserts leave the window too
+		now = now.Add(5 * cfg.Interval)
+		if total := buckets.Summary(nil).Total; total != 100 {
+			t.Fatalf("%T %d observations left", buckets, total)
+		}
+		buckets.Insert(1)
+		buckets.Reset()
+		if total := buckets.Summary(nil).Total; total != 0 {
+			t.Fatalf("%T %d observations after reset", buckets, total)
+		}
+	}
+}
+
+func TestSyncWindowedBuckets_Concurrent(t *testing.T) {
+	var clock int64
+	cfg := WindowCfg{Interval: time.Second, Intervals: 4,
+		Now: func() time.Time { return time.Unix(atomic.LoadInt64(&clock), 0) }}
+	buckets := NewSyncWindowedBuckets(cfg)
+	data := wideRangeData(10000)
+	const writers = 4
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, val := range data {
+				buckets.Insert(val)
+			}
+		}()
+	}
+	wg.Wait()
+	if total := buckets.Summary(nil).Total; total != uint64(writers*len(data)) {
+		t.Fatalf("%d observations", total)
+	}
+	atomic.AddInt64(&clock, 1)
+	buckets.Insert(1)
+	if total := buckets.SummaryOver(time.Second, nil).Total; total != 1 {
+		t.Fatalf("%d observations in the last second", total)
+	}
+}
+
+func TestSyncWindowedBuckets_SnapshotRotate(t *testing.T) {
+	var clock int64
+	cfg := WindowCfg{Interval: time.Second, Intervals: 1,
+		Now: func() time.Time { return time.Unix(atomic.LoadInt64(&clock), 0) }}
+	buckets := NewSyncWindowedBuckets(cfg)
+	data := wideRangeData(1000)
+	for _, val := range data {
+		buckets.Insert(val)
+	}
+	// a rotation stalled halfway through resetting the slot by an insert holding a stripe
+	slot := buckets.slots[0]
+	layers := slot.buckets.loadTable().layers
+	stripe, _ := layers[len(layers)/2].lock()
+	rotated := make(chan struct{})
+	go func() {
+		defer close(rotated)
+		buckets.rotate(slot, 1)
+	}()
+	for layers[0].loadCount() != 0 {
+		runtime.Gosched()
+	}
+	snapshots := make(chan uint64, 1)
+	go func() {
+		snapshots <- buckets.Snapshot(0).Total()
+	}()
+	select {
+	case total := <-snapshots:
+		if total != 0 {
+			t.Fatalf("snapshot of %d observations in a half-reset slot", total)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("snapshot copying a half-reset slot")
+	}
+	stripe.unlock()
+	<-rotated
+	atomic.StoreInt64(&clock, 1)
+
+	// snapshots racing with rotations see the whole old interval or the new one
+	for round := 0; round < 100; round++ {
+		for _, val := range data {
+			buckets.Insert(val)
+		}
+		var done uint32
+		totals := make(chan uint64, 1)
+		go func() {
+			for atomic.LoadUint32(&done) == 0 {
+				if total := buckets.Snapshot(0).Total(); total != uint64(len(data)) && total > 1 {
+					totals <- total
+					return
+				}
+			}
+			totals <- 0
+		}()
+		atomic.AddInt64(&clock, 1)
+		buckets.Insert(1)
+		atomic.StoreUint32(&done, 1)
+		if total := <-totals; total != 0 {
+			t.Fatalf("round %d: snapshot of %d observations out of %d", round, total, len(data))
+		}
+	}
+}
+
+func TestDecayingBuckets(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	cfg := DecayCfg{HalfLife: time.Minute, Now: func() time.Time { return now }}
+	buckets := NewDecayingBuckets(cfg)
+	buckets.InsertN(1, 100)
+	now = now.Add(time.Minute)
+	for i := 0; i < 100; i++ {
+		buckets.Insert(2)
+	}
+	buckets.Insert(math.NaN())
+
+	summary := buckets.Summary([]float32{30, 50})
+	if summary.Total != 200 || summary.TotalWeight != 150 || summary.NaN != 1 ||
+		summary.Min != FromFloat64(1) || summary.Max != FromFloat64(2) {
+		t.Fatalf("summary %v", summary)
+	}
+	if !summary.Sum.AlmostEqualF64(250) || !summary.Avg.AlmostEqualF64(5.0/3) ||
+		!summary.Variance.AlmostEqualF64(2.0/9) {
+		t.Fatalf("weighted statistics %v", summary)
+	}
+	if summary.Percentiles[0].LessThan != FromFloat64(1) || summary.Percentiles[1].LessThan != FromFloat64(2) {
+		t.Fatalf("weighted percentiles %v", summary.Percentiles)
+	}
+
+	// far enough for a rescale
+	now = now.Add(decayRescaleHalfLives * 2 * time.Minute)
+	buckets.Insert(3)
+	if expected := 1 + 150*math.Exp2(-decayRescaleHalfLives*2); math.Abs(buckets.TotalWeight()-expected) > 1e-12 {
+		t.Fatalf("total weight %v after rescale, expected %v", buckets.TotalWeight(), expected)
+	}
+	now = now.Add(time.Minute)
+	summary = buckets.Summary(nil)
+	if summary.Total != 201 || math.Abs(summary.TotalWeight-0.5) > 1e-12 ||
+		summary.Percentiles[0].LessThan != FromFloat64(3) || !summary.Avg.AlmostEqualF64(3) {
+		t.Fatalf("summary %v after rescale", summary)
+	}
+
+	buckets.Reset()
+	if summary := buckets.Summary(nil); summary.Total != 0 || summary.TotalWeight != 0 {
+		t.Fatalf("summary %v after reset", summary)
+	}
+}
+
+func TestBuckets_InsertWeighted(t *testing.T) {
+	type weightedBuckets interface {
+		Buckets
+		InsertWeighted(float64, float64)
+		TotalWeight() float64
+	}
+	data := randomData(1000, -100, 100)
+	for _, buckets := range []weightedBuckets{new(UnSyncBuckets), new(SyncBuckets)} {
+		// integer weights must summarize like multiplicities
+		expected := new(UnSyncBuckets)
+		weight := 0.0
+		for i, val := range data {
+			w := float64(i%37 + 1)
+			buckets.InsertWeighted(val, w)
+			expected.InsertN(val, uint64(w))
+			weight += w
+		}
+		buckets.InsertWeighted(math.NaN(), 2)
+		plain, summary := expected.Summary(DefaultPercentilesCfg()), buckets.Summary(DefaultPercentilesCfg())
+		if summary.Total != uint64(len(data)) || summary.TotalWeight != weight || buckets.TotalWeight() != weight ||
+			summary.NaN != 1 || summary.Min != plain.Min || summary.Max != plain.Max ||
+			!reflect.DeepEqual(plain.Percentiles, summary.Percentiles) {
+			t.Fatalf("%T expected %v, actual %v", buckets, plain, summary)
+		}
+		if !summary.Sum.AlmostEqual(plain.Sum) || !summary.Avg.AlmostEqual(plain.Avg) ||
+			!summary.Variance.AlmostEqual(plain.Variance) || !summary.Skewness.AlmostEqual(plain.Skewness) {
+			t.Fatalf("%T weighted statistics, expected %v, actual %v", buckets, plain, summary)
+		}
+
+		buckets.Reset()
+		buckets.InsertWeighted(1, 0.5)
+		buckets.InsertWeighted(2, 1.5)
+		buckets.Insert(2)
+		summary = buckets.Summary([]float32{10, 50})
+		if summary.Total != 3 || summary.TotalWeight != 3 || !summary.Avg.AlmostEqualF64(5.5/3) ||
+			summary.Percentiles[0].LessThan != FromFloat64(1) || summary.Percentiles[1].LessThan != FromFloat64(2) {
+			t.Fatalf("%T fractional weights %v", buckets, summary)
+		}
+		buckets.Reset()
+		if summary := buckets.Summary(nil); summary.TotalWeight != 0 {
+			t.Fatalf("%T weighted after reset %v", buckets, summary)
+		}
+	}
+
+	cfg := BucketsCfg{MaxLayers: 1}
+	for _, buckets := range []weightedBuckets{NewUnSyncBuckets(cfg), NewSyncBuckets(cfg)} {
+		buckets.InsertWeighted(1, 3)
+		buckets.InsertWeighted(100, 5)
+		summary := buckets.Summary([]float32{50})
+		if summary.Overflow != 1 || summary.TotalWeight != 8 || !summary.Avg.AlmostEqualF64(503.0/8) ||
+			summary.Percentiles[0].LessThan != FromFloat64(100) {
+			t.Fatalf("%T collapsed weights %v", buckets, summary)
+		}
+	}
+
+	concurrent := new(SyncBuckets)
+	const writers = 4
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, val := range data {
+				concurrent.InsertWeighted(val, 2.5)
+			}
+		}()
+	}
+	wg.Wait()
+	if weight := concurrent.TotalWeight(); weight != writers*float64(len(data))*2.5 {
+		t.Fatalf("concurrent total weight %v", weight)
+	}
+}
+
+func TestBuckets_RemoveWeighted(t *testing.T) {
+	type weightedBuckets interface {
+		RemovableBuckets
+		InsertWeighted(float64, float64)
+	}
+	for _, cfg := range []BucketsCfg{{}, {MaxLayers: 1}} {
+		for _, buckets := range []weightedBuckets{NewUnSyncBuckets(cfg), NewSyncBuckets(cfg)} {
+			buckets.InsertWeighted(1.5, 2.5)
+			if err := buckets.RemoveN(1.5, 1); err != nil {
+				t.Fatalf("%T %+v: %v", buckets, cfg, err)
+			}
+			if summary := buckets.Summary(nil); summary.Total != 0 || summary.TotalWeight != 0 || buckets.Sum() != 0 {
+				t.Fatalf("%T %+v all removed, sum %g, %v", buckets, cfg, buckets.Sum(), summary)
+			}
+
+			// the observations of a bucket share its weight
+			buckets.Insert(0.5)
+			buckets.InsertWeighted(2, 3)
+			buckets.Insert(2)
+			if err := buckets.Remove(2); err != nil {
+				t.Fatalf("%T %+v: %v", buckets, cfg, err)
+			}
+			summary := buckets.Summary([]float32{50, 90})
+			if summary.Total != 2 || summary.TotalWeight != 3 || math.Abs(buckets.Sum()-4.5) > 1e-12 ||
+				!summary.Avg.AlmostEqualF64(1.5) || !summary.Variance.AlmostEqualF64(0.5) ||
+				summary.Percentiles[0].LessThan != FromFloat64(2) || summary.Percentiles[1].LessThan != FromFloat64(2) {
+				t.Fatalf("%T %+v half removed, sum %g, %v", buckets, cfg, buckets.Sum(), summary)
+			}
+		}
+	}
+}
+
+func TestBuckets_CountOverflow(t *testing.T) {
+	const max = math.MaxUint64
+	for _, c := range []struct {
+		policy  CountOverflowPolicy
+		count   uint64 // of 1 once overflowed
+		clamped bool
+	}{
+		{CountOverflowWrap, 3, false},
+		{CountOverflowSaturate, max, true},
+		{CountOverflowError, max - 1, true},
+		{CountOverflowPanic, max - 1, false},
+	} {
+		cfg := BucketsCfg{CountOverflow: c.policy}
+		for _, buckets := range []interface {
+			CheckedBuckets
+			RemoveN(float64, uint64) error
+		}{NewUnSyncBuckets(cfg), NewSyncBuckets(cfg), NewSparseBuckets(cfg)} {
+			buckets.InsertN(1, max-1)
+			if err := buckets.InsertNE(1.5, 1); err != nil {
+				t.Fatalf("%T %v: %v", buckets, c.policy, err)
+			}
+			_ = buckets.RemoveN(1.5, 1)
+			err := func() (err error) {
+				defer func() {
+					if r := recover(); r != nil {
+						err = r.(error)
+					}
+				}()
+				return buckets.InsertNE(1, 5)
+			}()
+			summary := buckets.Summary(nil)
+			if !errors.Is(err, ErrCountOverflow) || buckets.Count(1) != c.count || summary.Clamped != c.clamped {
+				t.Fatalf("%T %v: %v, count %d, %v", buckets, c.policy, err, buckets.Count(1), summary)
+			}
+			if c.policy == CountOverflowPanic {
+				continue
+			}
+
+			buckets.Reset()
+			buckets.InsertN(1, max)
+			buckets.InsertN(2, 10)
+			buckets.InsertN(math.NaN(), max)
+			buckets.Insert(math.NaN())
+			summary = buckets.Summary(nil)
+			if c.policy != CountOverflowWrap && (buckets.Total() != max || summary.Total != max ||
+				!summary.Clamped || summary.NaN != max) {
+				t.Fatalf("%T %v: total %d, %v", buckets, c.policy, buckets.Total(), summary)
+			}
+		}
+	}
+
+	cfg := BucketsCfg{MaxLayers: 1, CountOverflow: CountOverflowSaturate}
+	for _, buckets := range []CheckedBuckets{NewUnSyncBuckets(cfg), NewSyncBuckets(cfg), NewSparseBuckets(cfg)} {
+		buckets.Insert(1)
+		buckets.InsertN(100, max)
+		if err := buckets.InsertNE(200, 1); !errors.Is(err, ErrCountOverflow) {
+			t.Fatalf("%T collapsed: %v", buckets, err)
+		}
+		if summary := buckets.Summary(nil); summary.Overflow != max || !summary.Clamped {
+			t.Fatalf("%T collapsed: %v", buckets, summary)
+		}
+	}
+
+	// the count of the layer overflows through another bucket than the one holding most of it
+	for _, c := range []struct {
+		policy CountOverflowPolicy
+		count  uint64 // of 1.5 once overflowed
+	}{
+		{CountOverflowSaturate, 1},
+		{CountOverflowError, 0},
+	} {
+		cfg := BucketsCfg{CountOverflow: c.policy}
+		for _, buckets := range []CheckedBuckets{NewUnSyncBuckets(cfg), NewSyncBuckets(cfg), NewSparseBuckets(cfg)} {
+			if err := buckets.InsertNE(1, max-1); err != nil {
+				t.Fatalf("%T %v: %v", buckets, c.policy, err)
+			}
+			err := buckets.InsertNE(1.5, 10)
+			summary := buckets.Summary(nil)
+			if !errors.Is(err, ErrCountOverflow) || buckets.Count(1.5) != c.count || buckets.Total() != max-1+c.count ||
+				summary.Total != buckets.Total() || summary.Max.ToFloat64() != 1+0.5*float64(c.count) || !summary.Clamped {
+				t.Fatalf("%T %v: %v, count %d, total %d, %v", buckets, c.policy, err, buckets.Count(1.5), buckets.Total(), summary)
+			}
+		}
+	}
+}
+
+func TestBuckets_MarshalBinary(t *testing.T) {
+	cfgs := []BucketsCfg{
+		{},
+		{CompensatedSum: true, MaxLayers: 3, ZeroThreshold: 1e-6, CountOverflow: CountOverflowSaturate},
+		{KeepNonFinite: true},
+	}
+	pcfg := DefaultPercentilesCfg()
+	for _, cfg := range cfgs {
+		for _, buckets := range []interface {
+			RemovableBuckets
+			InsertWeighted(f, weight float64)
+			MarshalBinary() ([]byte, error)
+		}{NewUnSyncBuckets(cfg), NewSyncBuckets(cfg)} {
+			insertBuckets(buckets, wideRangeData(200))
+			buckets.InsertN(math.NaN(), 3)
+			buckets.Insert(math.Inf(-1))
+			buckets.InsertWeighted(42, 2.5)
+			buckets.Insert(1e-9)
+			_ = buckets.Remove(42)
+			data, err := buckets.MarshalBinary()
+			if err != nil {
+				t.Fatalf("%T %+v: %v", buckets, cfg, err)
+			}
+
+			var unSync UnSyncBuckets
+			var sync SyncBuckets
+			for _, decoded := range []interface {
+				Buckets
+				UnmarshalBinary([]byte) error
+			}{&unSync, &sync} {
+				if err := decoded.UnmarshalBinary(data); err != nil {
+					t.Fatalf("%T %+v: %v", decoded, cfg, err)
+				}
+				if expected, actual := buckets.Summary(pcfg), decoded.Summary(pcfg); !reflect.DeepEqual(expected, actual) {
+					t.Fatalf("%T %+v: expected %v, actual %v", decoded, cfg, expected, actual)
+				}
+				if !reflect.DeepEqual(buckets.Buckets(), decoded.Buckets()) {
+					t.Fatalf("%T %+v: buckets differ", decoded, cfg)
+				}
+			}
+			if reencoded, _ := unSync.MarshalBinary(); !reflect.DeepEqual(data, reencoded) {
+				t.Fatalf("%+v: re-encoded differently", cfg)
+			}
+
+			// the decoded buckets keep working
+			val := unSync.Buckets()[0].Value.ToFloat64()
+			held := unSync.Count(val)
+			sync.Insert(val)
+			unSync.Insert(val)
+			if err := sync.RemoveN(val, held+1); err != nil || sync.Count(val) != 0 || unSync.Count(val) != held+1 {
+				t.Fatalf("%+v: %v, counts %d %d", cfg, err, sync.Count(val), unSync.Count(val))
+			}
+
+			var buf bytes.Buffer
+			var gobDecoded UnSyncBuckets
+			if err := gob.NewEncoder(&buf).Encode(buckets); err != nil {
+				t.Fatalf("%T %+v: %v", buckets, cfg, err)
+			}
+			if err := gob.NewDecoder(&buf).Decode(&gobDecoded); err != nil {
+				t.Fatalf("%T %+v: %v", buckets, cfg, err)
+			}
+			if expected, actual := buckets.Summary(pcfg), gobDecoded.Summary(pcfg); !reflect.DeepEqual(expected, actual) {
+				t.Fatalf("%T %+v: gob expected %v, actual %v", buckets, cfg, expected, actual)
+			}
+
+			for _, i := range []int{0, 2, 3, len(data) / 3, len(data) / 2, len(data) - 1} {
+				if err := unSync.UnmarshalBinary(data[:i]); err == nil {
+					t.Fatalf("%+v: truncated to %d bytes decoded", cfg, i)
+				}
+			}
+			corrupted := append([]byte{encodingVersion + 1}, data[1:]...)
+			if err := unSync.UnmarshalBinary(corrupted); err == nil {
+				t.Fatalf("%+v: unknown version decoded", cfg)
+			}
+		}
+	}
+
+	// a batch of latencies in milliseconds
+	buckets := NewUnSyncBuckets(BucketsCfg{})
+	for _, val := range randomData(100, 1, 250) {
+		buckets.Insert(val)
+	}
+	if data, _ := buckets.MarshalBinary(); len(data) > 1024 {
+		t.Fatalf("encoded in %d bytes", len(data))
+	}
+	// log-normal latencies around 20ms
+	buckets.Reset()
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		buckets.Insert(math.Exp(3 + random.NormFloat64()))
+	}
+	if data, _ := buckets.MarshalBinary(); len(data) > 2600 {
+		t.Fatalf("10k observations encoded in %d bytes", len(data))
+	}
+
+	// written by version 1
+	expected := NewUnSyncBuckets(BucketsCfg{CompensatedSum: true})
+	expected.Insert(1)
+	expected.Insert(1.5)
+	expected.InsertN(3, 2)
+	expected.Insert(-0.25)
+	expected.InsertWeighted(100, 2.5)
+	v1, _ := hex.DecodeString("0108090000000000000004d0ff02000000000000d0bf0000000000000000000000000000d0bf00000000000000000000" +
+		"0000000000000000000000000000000000000000000001000100f07f0000000000000440000000000000000000000000" +
+		"0000f03f000000000000e03f000000000000d03f000000000000c03f000000000000b03f0200017f0100808001000000" +
+		"000000184000000000000000000000000000000840000000000000000000000000000000000000000000000000000000" +
+		"00000000000180010200d080010000000000406f40000000000000000000000000000059400000000000000000000000" +
+		"00000000000000000000000000000000000000000001900101019001000000000000f83f")
+	var decoded UnSyncBuckets
+	if err := decoded.UnmarshalBinary(v1); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Summary(pcfg), expected.Summary(pcfg)) ||
+		!reflect.DeepEqual(decoded.Buckets(), expected.Buckets()) || decoded.TotalWeight() != expected.TotalWeight() {
+		t.Fatalf("version 1 decoded as %v, expected %v", decoded.Summary(pcfg), expected.Summary(pcfg))
+	}
+	for _, data := range [][]byte{
+		// the low bits of the sign and exponent set
+		append(append(append([]byte{}, v1[:11]...), 0xd1), v1[12:]...),
+		// a sign and exponent beyond 12 bits
+		{2, 8, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x80, 0x40, 0, 0, 0},
+	} {
+		if err := decoded.UnmarshalBinary(data); err == nil || !strings.Contains(err.Error(), "sign and exponent") {
+			t.Fatalf("%x decoded: %v", data, err)
+		}
+	}
+}
+
+func TestBuckets_MarshalJSON(t *testing.T) {
+	cfgs := []BucketsCfg{
+		{},
+		{CompensatedSum: true, MaxLayers: 3, ZeroThreshold: 1e-6, CountOverflow: CountOverflowError},
+		{KeepNonFinite: true},
+	}
+	pcfg := DefaultPercentilesCfg()
+	for _, cfg := range cfgs {
+		for _, buckets := range []interface {
+			RemovableBuckets
+			InsertWeighted(f, weight float64)
+		}{NewUnSyncBuckets(cfg), NewSyncBuckets(cfg)} {
+			insertBuckets(buckets, wideRangeData(200))
+			buckets.InsertN(math.NaN(), 3)
+			buckets.Insert(math.Inf(-1))
+			buckets.InsertWeighted(42, 2.5)
+			_ = buckets.Remove(42)
+			data, err := json.Marshal(buckets)
+			if err != nil {
+				t.Fatalf("%T %+v: %v", buckets, cfg, err)
+			}
+
+			var unSync UnSyncBuckets
+			var sync SyncBuckets
+			for _, decoded := range []Buckets{&unSync, &sync} {
+				if err := json.Unmarshal(data, decoded); err != nil {
+					t.Fatalf("%T %+v: %v", decoded, cfg, err)
+				}
+				if expected, actual := buckets.Summary(pcfg), decoded.Summary(pcfg); !reflect.DeepEqual(expected, actual) {
+					t.Fatalf("%T %+v: expected %v, actual %v", decoded, cfg, expected, actual)
+				}
+				if !reflect.DeepEqual(buckets.Buckets(), decoded.Buckets()) {
+					t.Fatalf("%T %+v: buckets differ", decoded, cfg)
+				}
+			}
+			if reencoded, _ := json.Marshal(&unSync); string(data) != string(reencoded) {
+				t.Fatalf("%+v: re-encoded differently", cfg)
+			}
+		}
+	}
+
+	for _, cfg := range cfgs {
+		sparse := NewSparseBuckets(cfg)
+		insertBuckets(sparse, wideRangeData(200))
+		sparse.InsertN(math.NaN(), 3)
+		sparse.Insert(math.Inf(-1))
+		data, err := json.Marshal(sparse)
+		if err != nil {
+			t.Fatalf("%+v: %v", cfg, err)
+		}
+		decoded, unSync := &SparseBuckets{}, &UnSyncBuckets{}
+		if err := json.Unmarshal(data, decoded); err != nil || !reflect.DeepEqual(decoded.Buckets(), sparse.Buckets()) ||
+			!reflect.DeepEqual(decoded.Summary(pcfg), sparse.Summary(pcfg)) {
+			t.Fatalf("%+v: %v, decoded %v", cfg, err, decoded.Summary(pcfg))
+		}
+		if err := json.Unmarshal(data, unSync); err != nil || !reflect.DeepEqual(unSync.Buckets(), sparse.Buckets()) ||
+			!reflect.DeepEqual(unSync.Summary(pcfg), sparse.Summary(pcfg)) {
+			t.Fatalf("%+v: %v, decoded as unsync %v", cfg, err, unSync.Summary(pcfg))
+		}
+		if reencoded, _ := json.Marshal(unSync); string(data) != string(reencoded) {
+			t.Fatalf("%+v: re-encoded differently", cfg)
+		}
+
+		// sparse buckets have no weights
+		unSync.InsertWeighted(42, 2.5)
+		data, _ = json.Marshal(unSync)
+		if err := json.Unmarshal(data, decoded); err == nil || !strings.Contains(err.Error(), "weighted") {
+			t.Fatalf("%+v: weighted buckets decoded as sparse: %v", cfg, err)
+		}
+	}
+
+	for _, c := range []struct {
+		data string
+		err  string
+	}{
+		{`{"version":2,"precision":8,"layers":[]}`, "version"},
+		{`{"version":1,"precision":8,"settings":{"countOverflow":"ignore"},"layers":[]}`, "count overflow"},
+		{`{"version":1,"precision":8,"layers":[{"signAndExp":16384},{"signAndExp":16368}]}`, "layers out of order"},
+		{`{"version":1,"precision":8,"layers":[{"signAndExp":16368},{"signAndExp":16368}]}`, "layers out of order"},
+		{`{"version":1,"precision":8,"layers":[{"signAndExp":16369}]}`, "invalid sign and exponent"},
+		{`{"version":1,"precision":8,"layers":[{"signAndExp":16368,"buckets":[{"value":2,"count":1}]}]}`,
+			"out of its layer"},
+		{`{"version":1,"precision":8,"layers":[{"signAndExp":16368,"buckets":[{"value":1,"count":1},` +
+			`{"value":1,"count":2}]}]}`, "duplicated"},
+		{`{"version":1,"precision":8,"layers":[{"signAndExp":16368,"buckets":[{"value":1.5,"count":1},` +
+			`{"value":1,"count":2}]}]}`, "out of order"},
+	} {
+		if err := json.Unmarshal([]byte(c.data), &UnSyncBuckets{}); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("%s decoded: %v", c.data, err)
+		}
+	}
+
+	buckets := NewUnSyncBuckets(BucketsCfg{MaxLayers: 2})
+	summaries := []Summary{buckets.Summary(pcfg), buckets.Summary(nil)}
+	insertBuckets(buckets, randomData(100, 1, 250))
+	buckets.InsertWeighted(math.NaN(), 1)
+	buckets.InsertWeighted(0, 0.5)
+	summaries = append(summaries, buckets.Summary(pcfg))
+	for _, summary := range summaries {
+		data, err := json.Marshal(summary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Summary
+		if err := json.Unmarshal(data, &decoded); err != nil || !reflect.DeepEqual(summary, decoded) {
+			t.Fatalf("%s: %v, decoded %v", data, err, decoded)
+		}
+	}
+	// NaNs are all plain, whatever their signs
+	data, _ := json.Marshal(summaries[0])
+	if !strings.Contains(string(data), `"avg":"NaN"`) || strings.Contains(string(data), "-NaN") {
+		t.Fatalf("empty summary: %s", data)
+	}
+	if data, _ := json.Marshal(FromFloat64(math.Copysign(math.NaN(), -1))); string(data) != `"NaN"` {
+		t.Fatalf("negative NaN: %s", data)
+	}
+	data, _ = json.Marshal(buckets.Summary(pcfg))
+	if !strings.Contains(string(data), `"percentiles":{"p50":`) || !strings.Contains(string(data), `"p99.9":`) {
+		t.Fatalf("percentiles not keyed: %s", data)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "update the golden files of testdata")
+
+// checkGolden compares actual with the golden file testdata/name, which -update rewrites.
+func checkGolden(t *testing.T, name string, actual []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, actual, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, actual) {
+		t.Fatalf("%s: expected\n%s\nactual\n%s", path, expected, actual)
+	}
+}
+
+func TestPrometheusWriter(t *testing.T) {
+	latencies := []float64{0.003, 0.004, 0.012, 0.0125, 0.05, 0.07, 0.2, 0.9, 1.5, 7}
+	cfg := PrometheusCfg{
+		Name:       "http_request_duration_seconds",
+		Help:       "Request latency.\nIn \\seconds.",
+		Labels:     map[string]string{"path": `/api/"v1"`, "method": "GET"},
+		Boundaries: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}
+	for _, buckets := range []Buckets{NewUnSyncBuckets(BucketsCfg{}), NewSyncBuckets(BucketsCfg{}), NewSparseBuckets(BucketsCfg{})} {
+		for _, val := range latencies {
+			buckets.Insert(val)
+		}
+		buckets.InsertN(math.NaN(), 2)
+		buckets.Insert(math.Inf(1))
+
+		var buf bytes.Buffer
+		if err := NewPrometheusWriter(cfg).WriteHistogram(&buf, buckets); err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, "prometheus_histogram.golden", buf.Bytes())
+	}
+
+	values := []float64{-2, -1.5, 0, 1, 1.25, 1.25, 3, 100}
+	buckets := NewUnSyncBuckets(BucketsCfg{})
+	for _, val := range values {
+		buckets.Insert(val)
+	}
+	var buf bytes.Buffer
+	if err := NewPrometheusWriter(PrometheusCfg{Name: "values"}).WriteHistogram(&buf, buckets); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "prometheus_histogram_derived.golden", buf.Bytes())
+
+	// the zero bucket is bounded by the zero threshold
+	thresholded := NewUnSyncBuckets(BucketsCfg{ZeroThreshold: 1e-3})
+	for _, val := range values {
+		thresholded.Insert(val)
+	}
+	buf.Reset()
+	if err := NewPrometheusWriter(PrometheusCfg{Name: "values"}).WriteHistogram(&buf, thresholded); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "values_bucket{le=\"0.001\"} 3\n") {
+		t.Fatalf("zero bucket bound\n%s", buf.String())
+	}
+
+	// signed zeros share a boundary
+	for _, cfg := range []BucketsCfg{{}, {ZeroThreshold: 1e-3}} {
+		zeros := NewUnSyncBuckets(cfg)
+		zeros.Insert(math.Copysign(0, -1))
+		zeros.Insert(0)
+		zeros.Insert(1)
+		buf.Reset()
+		if err := NewPrometheusWriter(PrometheusCfg{Name: "x"}).WriteHistogram(&buf, zeros); err != nil {
+			t.Fatal(err)
+		}
+		le := fmt.Sprintf("x_bucket{le=\"%g\"} 2\n", cfg.ZeroThreshold)
+		if strings.Count(buf.String(), "le=") != 3 || strings.Count(buf.String(), le) != 1 {
+			t.Fatalf("%+v signed zeros\n%s", cfg, buf.String())
+		}
+	}
+
+	// the underflow counts from -2 and the overflow from 100
+	collapsed := NewUnSyncBuckets(BucketsCfg{MaxLayers: 2})
+	for _, val := range values {
+		collapsed.Insert(val)
+	}
+	buf.Reset()
+	err := NewPrometheusWriter(PrometheusCfg{Name: "values", Boundaries: []float64{-2, 0, 1, 2, 50, 100}}).
+		WriteHistogram(&buf, collapsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "prometheus_histogram_collapsed.golden", buf.Bytes())
+
+	buf.Reset()
+	summary := buckets.Summary([]float32{50, 90, 99.9})
+	if err := NewPrometheusWriter(PrometheusCfg{Name: "values", Labels: cfg.Labels}).WriteSummary(&buf, summary); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "prometheus_summary.golden", buf.Bytes())
+
+	for _, invalid := range []PrometheusCfg{
+		{Name: "0values"},
+		{Name: "values", Labels: map[string]string{"le": "1"}},
+		{Name: "values", Boundaries: []float64{1, 1}},
+		{Name: "values", Boundaries: []float64{math.Inf(1)}},
+	} {
+		if err := CheckPrometheusCfg(invalid); err == nil {
+			t.Fatalf("%+v accepted", invalid)
+		}
+	}
+}
+
+func TestToOTelExponentialHistogram(t *testing.T) {
+	// the bucket of index i holds (2^(i/128), 2^((i+1)/128)]
+	exactIndex := func(f float64) int32 {
+		return int32(math.Ceil(math.Log2(math.Abs(f))*128)) - 1
+	}
+	for _, val := range wideRangeData(1000) {
+		for _, buckets := range []Buckets{NewUnSyncBuckets(BucketsCfg{}), NewSyncBuckets(BucketsCfg{})} {
+			buckets.Insert(val)
+			h := ToOTelExponentialHistogram(buckets, OTelCfg{})
+			b := h.Positive
+			if val < 0 {
+				b = h.Negative
+			}
+			if h.Scale != OTelNativeScale || h.Count != 1 || len(b.BucketCounts) != 1 || b.BucketCounts[0] != 1 {
+				t.Fatalf("%T %g: %+v", buckets, val, h)
+			}
+			if diff := b.Offset - exactIndex(val); diff < -1 || diff > 1 {
+				t.Fatalf("%T %g: index %d, exact %d", buckets, val, b.Offset, exactIndex(val))
+			}
+		}
+	}
+
+	cfg := BucketsCfg{ZeroThreshold: 1e-3, MaxLayers: 20}
+	data := wideRangeData(10000)
+	for _, buckets := range []Buckets{NewUnSyncBuckets(cfg), NewSyncBuckets(cfg), NewSparseBuckets(cfg)} {
+		insertBuckets(buckets, data)
+		buckets.Insert(math.NaN())
+		summary := buckets.Summary(nil)
+		for _, maxSize := range []int{0, 160, 2} {
+			h := ToOTelExponentialHistogram(buckets, OTelCfg{MaxSize: maxSize})
+			total := h.ZeroCount
+			for _, b := range []OTelBuckets{h.Positive, h.Negative} {
+				if maxSize != 0 && len(b.BucketCounts) > maxSize {
+					t.Fatalf("%T %d: %d buckets", buckets, maxSize, len(b.BucketCounts))
+				}
+				for _, count := range b.BucketCounts {
+					total += count
+				}
+			}
+			if h.Count != summary.Total || total != summary.Total || h.ZeroCount != summary.Zero ||
+				h.ZeroThreshold != cfg.ZeroThreshold || h.Sum != buckets.Sum() ||
+				h.Min != summary.Min.ToFloat64() || h.Max != summary.Max.ToFloat64() {
+				t.Fatalf("%T %d: %+v, %v", buckets, maxSize, h, summary)
+			}
+			if maxSize == 160 && h.Scale >= OTelNativeScale || maxSize == 2 && h.Scale > -3 {
+				t.Fatalf("%T %d: scale %d", buckets, maxSize, h.Scale)
+			}
+		}
+	}
+
+	if h := ToOTelExponentialHistogram(NewUnSyncBuckets(BucketsCfg{}), OTelCfg{}); h.Count != 0 ||
+		!math.IsNaN(h.Min) || h.Positive.BucketCounts != nil {
+		t.Fatalf("empty: %+v", h)
+	}
+}
+
+func TestPushPrometheusWriteRequest(t *testing.T) {
+	cfg := BucketsCfg{ZeroThreshold: 1e-3, MaxLayers: 20}
+	data := wideRangeData(10000)
+	buckets := NewSyncBuckets(cfg)
+	insertBuckets(buckets, data)
+	var series []PrometheusSeries
+	for _, maxBuckets := range []int{0, 100} {
+		h := ToPrometheusNativeHistogram(buckets, PrometheusNativeCfg{MaxBuckets: maxBuckets})
+		h.Timestamp = 1700000000000
+		series = append(series, PrometheusSeries{
+			Labels:     map[string]string{"__name__": "latency_seconds", "max": strconv.Itoa(maxBuckets)},
+			Histograms: []PrometheusNativeHistogram{h},
+		})
+	}
+
+	var received []PrometheusSeries
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "unexpected headers", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if received, err = parseWriteRequest(decodeSnappyLiterals(t, body)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	if err := PushPrometheusWriteRequest(context.Background(), nil, server.URL, series); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(received, series) {
+		t.Fatalf("received %+v\nsent %+v", received, series)
+	}
+
+	summary := buckets.Summary([]float32{})
+	for _, s := range received {
+		h := s.Histograms[0]
+		total := h.ZeroCount
+		populated := 0
+		for _, side := range []struct {
+			spans  []PrometheusBucketSpan
+			deltas []int64
+		}{{h.PositiveSpans, h.PositiveDeltas}, {h.NegativeSpans, h.NegativeDeltas}} {
+			length, count := 0, int64(0)
+			for _, span := range side.spans {
+				length += int(span.Length)
+			}
+			if length != len(side.deltas) {
+				t.Fatalf("%v: spans of %d buckets, %d deltas", s.Labels, length, len(side.deltas))
+			}
+			for _, delta := range side.deltas {
+				if count += delta; count < 0 {
+					t.Fatalf("%v: negative count", s.Labels)
+				} else if count > 0 {
+					populated++
+				}
+				total += uint64(count)
+			}
+		}
+		if h.Count != summary.Total || total != summary.Total || h.ZeroCount != summary.Zero ||
+			h.ZeroThreshold != cfg.ZeroThreshold || h.Sum != buckets.Sum() {
+			t.Fatalf("%v: %+v, %v", s.Labels, h, summary)
+		}
+		if s.Labels["max"] == "0" && h.Schema != OTelNativeScale || s.Labels["max"] == "100" && populated > 100 {
+			t.Fatalf("%v: schema %d, %d buckets", s.Labels, h.Schema, populated)
+		}
+	}
+
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer server.Close()
+	if err := PushPrometheusWriteRequest(context.Background(), nil, server.URL, series); err == nil ||
+		!strings.Contains(err.Error(), "400") || !strings.Contains(err.Error(), "out of order sample") {
+		t.Fatalf("error %v", err)
+	}
+}
+
+func TestSnappyEncode(t *testing.T) {
+	long := bytes.Repeat([]byte{0xab}, 70000)
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	for _, c := range []struct {
+		data, expected []byte
+	}{
+		{nil, []byte{0x00}},
+		{[]byte("hello"), join([]byte{0x05, 0x10}, []byte("hello"))},
+		{long[:60], join([]byte{0x3c, 0xec}, long[:60])},
+		// tag 61, the length - 1 follows in 2 little-endian bytes
+		{long[:61], join([]byte{0x3d, 0xf4, 0x3c, 0x00}, long[:61])},
+		{long[:300], join([]byte{0xac, 0x02, 0xf4, 0x2b, 0x01}, long[:300])},
+		// literals of 64KiB at most
+		{long, join([]byte{0xf0, 0xa2, 0x04, 0xf4, 0xff, 0xff}, long[:1<<16], []byte{0xf4, 0x6f, 0x11}, long[1<<16:])},
+	} {
+		if encoded := snappyEncode(c.data); !bytes.Equal(encoded, c.expected) {
+			head := func(b []byte) []byte {
+				if len(b) > 8 {
+					return b[:8]
+				}
+				return b
+			}
+			t.Fatalf("%d bytes: % x..., expected % x...", len(c.data), head(encoded), head(c.expected))
+		}
+	}
+}
+
+func TestMarshalPrometheusWriteRequest(t *testing.T) {
+	series := []PrometheusSeries{{
+		Labels: map[string]string{"a": "b", "__name__": "x"},
+		Histograms: []PrometheusNativeHistogram{{
+			Count:          3,
+			Sum:            1.5,
+			Schema:         -1,
+			ZeroCount:      1,
+			PositiveSpans:  []PrometheusBucketSpan{{Offset: -2, Length: 2}},
+			PositiveDeltas: []int64{1, 0},
+			Timestamp:      1000,
+		}},
+	}}
+	expected := []byte{
+		0x0a, 0x35, // timeseries
+		0x0a, 0x0d, 0x0a, 0x08, '_', '_', 'n', 'a', 'm', 'e', '_', '_', 0x12, 0x01, 'x', // labels sorted by name
+		0x0a, 0x06, 0x0a, 0x01, 'a', 0x12, 0x01, 'b',
+		0x22, 0x1c, // histogram
+		0x08, 0x03, // count_int
+		0x19, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf8, 0x3f, // sum
+		0x20, 0x01, // schema, zigzag
+		0x30, 0x01, // zero_count_int, zero_threshold being 0 is left out
+		0x5a, 0x04, 0x08, 0x03, 0x10, 0x02, // positive_spans
+		0x62, 0x02, 0x02, 0x00, // positive_deltas, packed zigzag
+		0x78, 0xe8, 0x07, // timestamp
+	}
+	if data := MarshalPrometheusWriteRequest(series); !bytes.Equal(data, expected) {
+		t.Fatalf("% x\nexpected\n% x", data, expected)
+	}
+}
+
+// decodeSnappyLiterals decodes snappy blocks made only of literals, as snappyEncode writes them.
+func decodeSnappyLiterals(t *testing.T, block []byte) []byte {
+	length, n := binary.Uvarint(block)
+	block = block[n:]
+	var data []byte
+	for len(block) > 0 {
+		tag := block[0]
+		size := int(tag>>2) + 1
+		block = block[1:]
+		if tag&3 != 0 || tag>>2 > 61 {
+			t.Fatalf("unexpected snappy tag %#x", tag)
+		} else if tag>>2 == 61 {
+			size = int(binary.LittleEndian.Uint16(block)) + 1
+			block = block[2:]
+		}
+		data, block = append(data, block[:size]...), block[size:]
+	}
+	if uint64(len(data)) != length {
+		t.Fatalf("snappy length %d, decoded %d", length, len(data))
+	}
+	return data
+}
+
+// protoFields calls f with the fields of a protobuf message, the value of varints and fixed64s, the bytes of the rest.
+func protoFields(msg []byte, f func(field int, v uint64, b []byte) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errors.New("bad key")
+		}
+		msg = msg[n:]
+		var v uint64
+		var b []byte
+		switch key & 7 {
+		case 0:
+			if v, n = binary.Uvarint(msg); n <= 0 {
+				return errors.New("bad varint")
+			}
+			msg = msg[n:]
+		case 1:
+			if len(msg) < 8 {
+				return errors.New("bad fixed64")
+			}
+			v, msg = binary.LittleEndian.Uint64(msg), msg[8:]
+		case 2:
+			if v, n = binary.Uvarint(msg); n <= 0 || uint64(len(msg)-n) < v {
+				return errors.New("bad length")
+			}
+			b, msg = msg[n:n+int(v)], msg[n+int(v):]
+		default:
+			return fmt.Errorf("unexpected wire type %d", key&7)
+		}
+		if err := f(int(key>>3), v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseWriteRequest(msg []byte) ([]PrometheusSeries, error) {
+	var series []PrometheusSeries
+	err := protoFields(msg, func(field int, _ uint64, ts []byte) error {
+		s := PrometheusSeries{Labels: map[string]string{}}
+		series = append(series, s)
+		return protoFields(ts, func(field int, _ uint64, b []byte) error {
+			switch field {
+			case 1:
+				var name, value string
+				err := protoFields(b, func(field int, _ uint64, b []byte) error {
+					if field == 1 {
+						name = string(b)
+					} else {
+						value = string(b)
+					}
+					return nil
+				})
+				s.Labels[name] = value
+				return err
+			case 4:
+				h, err := parseHistogram(b)
+				series[len(series)-1].Histograms = append(series[len(series)-1].Histograms, h)
+				return err
+			}
+			return fmt.Errorf("unexpected time series field %d", field)
+		})
+	})
+	return series, err
+}
+
+func parseHistogram(msg []byte) (PrometheusNativeHistogram, error) {
+	var h PrometheusNativeHistogram
+	parseSpan := func(b []byte) (span PrometheusBucketSpan, err error) {
+		err = protoFields(b, func(field int, v uint64, _ []byte) error {
+			if field == 1 {
+				span.Offset = int32(unzigzag(v))
+			} else {
+				span.Length = uint32(v)
+			}
+			return nil
+		})
+		return span, err
+	}
+	parseDeltas := func(b []byte) (deltas []int64) {
+		for len(b) > 0 {
+			v, n := binary.Uvarint(b)
+			deltas, b = append(deltas, unzigzag(v)), b[n:]
+		}
+		return deltas
+	}
+	err := protoFields(msg, func(field int, v uint64, b []byte) error {
+		var err error
+		var span PrometheusBucketSpan
+		switch field {
+		case 1:
+			h.Count = v
+		case 3:
+			h.Sum = math.Float64frombits(v)
+		case 4:
+			h.Schema = int32(unzigzag(v))
+		case 5:
+			h.ZeroThreshold = math.Float64frombits(v)
+		case 6:
+			h.ZeroCount = v
+		case 8:
+			span, err = parseSpan(b)
+			h.NegativeSpans = append(h.NegativeSpans, span)
+		case 9:
+			h.NegativeDeltas = parseDeltas(b)
+		case 11:
+			span, err = parseSpan(b)
+			h.PositiveSpans = append(h.PositiveSpans, span)
+		case 12:
+			h.PositiveDeltas = parseDeltas(b)
+		case 15:
+			h.Timestamp = int64(v)
+		default:
+			err = fmt.Errorf("unexpected histogram field %d", field)
+		}
+		return err
+	})
+	return h, err
+}
+
+func TestDecodeHdrHistogram(t *testing.T) {
+	// 3 significant digits: the values below 2048 have indexes of their own,
+	// index 2524 holds 3000 and 3001, reported as 3001
+	counts := []byte{
+		0x00,       // index 0: 0
+		0x04,       // index 1: 2
+		0x05,       // indexes 2 to 4: -3, empty
+		0x06,       // index 5: 3
+		0xab, 0x27, // indexes 6 to 2523: -2518, empty
+		0x08, // index 2524: 4
+	}
+	payload := make([]byte, 40, 40+len(counts))
+	binary.BigEndian.PutUint32(payload[0:], 0x1c849313)
+	binary.BigEndian.PutUint32(payload[4:], uint32(len(counts)))
+	binary.BigEndian.PutUint32(payload[12:], 3)
+	binary.BigEndian.PutUint64(payload[16:], 1)
+	binary.BigEndian.PutUint64(payload[24:], 3600000000)
+	binary.BigEndian.PutUint64(payload[32:], math.Float64bits(1))
+	payload = append(payload, counts...)
+	var compressed bytes.Buffer
+	compressed.Write([]byte{0x1c, 0x84, 0x93, 0x14, 0, 0, 0, 0})
+	w := zlib.NewWriter(&compressed)
+	_, _ = w.Write(payload)
+	_ = w.Close()
+	binary.BigEndian.PutUint32(compressed.Bytes()[4:], uint32(compressed.Len()-8))
+	encoded := base64.StdEncoding.EncodeToString(compressed.Bytes())
+	if !strings.HasPrefix(encoded, "HISTFAAA") {
+		t.Fatalf("encoded %s", encoded)
+	}
+
+	for _, unit := range []float64{0, 1e-3} {
+		buckets, err := DecodeHdrHistogram(encoded, HdrCfg{Unit: unit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		scale := unit
+		if unit == 0 {
+			scale = 1
+		}
+		if buckets.Total() != 9 || buckets.Count(1*scale) != 2 || buckets.Count(5*scale) != 3 ||
+			buckets.Count(3001*scale) != 4 || math.Abs(buckets.Sum()-(2*1+3*5+4*3001)*scale) > 1e-9 {
+			t.Fatalf("unit %g: %v, sum %g", unit, buckets.Buckets(), buckets.Sum())
+		}
+	}
+
+	// encoded by github.com/HdrHistogram/hdrhistogram-go v1.1.2 from hdr.New(1, 3600000000, 3) recording
+	// 0 once, 1 twice, 5 3 times, 3000 4 times and 1500000 5 times, index 2524 holding 3000 and 3001
+	// and the index of 1500000 holding 1499136 to 1500159
+	golden := "HISTFAAAADh42pJpmSzMwMDAzcDAwMjAwMDMwMDAAGUzXJu8hMH+AwMDAwMDAxMLK9tqdY6t/YxcgAEAj5oGzQ=="
+	buckets, err := DecodeHdrHistogram(golden, HdrCfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buckets.Total() != 15 || buckets.Count(0) != 1 || buckets.Count(1) != 2 || buckets.Count(5) != 3 ||
+		buckets.Count(3001) != 4 || buckets.Count(1499648) != 5 {
+		t.Fatalf("golden: %v", buckets.Buckets())
+	}
+
+	// a payload length beyond what the counts up to the highest trackable value can take
+	binary.BigEndian.PutUint32(payload[4:], 9*2525+1)
+	binary.BigEndian.PutUint64(payload[24:], 3001)
+	compressed.Reset()
+	compressed.Write([]byte{0x1c, 0x84, 0x93, 0x14, 0, 0, 0, 0})
+	w = zlib.NewWriter(&compressed)
+	_, _ = w.Write(payload)
+	_ = w.Close()
+	binary.BigEndian.PutUint32(compressed.Bytes()[4:], uint32(compressed.Len()-8))
+	if _, err := DecodeHdrHistogram(base64.StdEncoding.EncodeToString(compressed.Bytes()), HdrCfg{}); err == nil ||
+		!strings.Contains(err.Error(), "at most") {
+		t.Fatalf("oversized payload length: %v", err)
+	}
+
+	truncated := base64.StdEncoding.EncodeToString(compressed.Bytes()[:compressed.Len()-3])
+	for _, encoded := range []string{"", "not base64", "AAAAAAAAAAA=", truncated} {
+		if _, err := DecodeHdrHistogram(encoded, HdrCfg{}); err == nil {
+			t.Fatalf("%q decoded", encoded)
+		}
+	}
+}
+
+func TestEncodeHdrHistogram(t *testing.T) {
+	var data []float64
+	for _, val := range wideRangeData(10000) {
+		if val = math.Abs(val); val > 1e-3 && val < 1e6 {
+			data = append(data, val)
+		}
+	}
+	data = append(data, 0, math.NaN())
+	cfg := HdrCfg{Unit: 1e-6}
+	for _, buckets := range []Buckets{NewUnSyncBuckets(cfg.Buckets), NewSyncBuckets(cfg.Buckets), NewSparseBuckets(cfg.Buckets)} {
+		insertBuckets(buckets, data)
+		encoded, err := EncodeHdrHistogram(buckets, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(encoded, "HISTFAAA") {
+			t.Fatalf("%T: encoded %s", buckets, encoded)
+		}
+		decoded, err := DecodeHdrHistogram(encoded, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, actual := buckets.Summary(nil), decoded.Summary(nil)
+		if actual.Total != expected.Total || actual.Zero != expected.Zero || actual.NaN != 0 {
+			t.Fatalf("%T: %v, expected %v", buckets, actual, expected)
+		}
+		for i, p := range expected.Percentiles {
+			if e, a := p.LessThan.ToFloat64(), actual.Percentiles[i].LessThan.ToFloat64(); math.Abs(a-e) > e/64 {
+				t.Fatalf("%T: p%g %g, expected %g", buckets, p.Percentile, a, e)
+			}
+		}
+	}
+
+	buckets := NewUnSyncBuckets(BucketsCfg{})
+	for _, val := range []float64{0, 1, 2, 2047} {
+		buckets.Insert(val)
+	}
+	encoded, err := EncodeHdrHistogram(buckets, HdrCfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeHdrHistogram(encoded, HdrCfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Buckets(), buckets.Buckets()) {
+		t.Fatalf("%v, expected %v", decoded.Buckets(), buckets.Buckets())
+	}
+
+	buckets.Insert(-1)
+	if _, err := EncodeHdrHistogram(buckets, HdrCfg{}); err == nil {
+		t.Fatal("negative value encoded")
+	}
+}
+
+func TestHdrLogWriter(t *testing.T) {
+	base := time.Unix(1700000000, 0).UTC()
+	var out bytes.Buffer
+	w := NewHdrLogWriter(&out, base, HdrCfg{Unit: 1e-9})
+	for i := 0; i < 2; i++ {
+		buckets := NewUnSyncBuckets(BucketsCfg{})
+		buckets.InsertN(0.25*float64(i+1), 10)
+		if err := w.WriteInterval(base.Add(time.Duration(i)*time.Second), time.Second, buckets); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	header := []string{
+		"#[Histogram log format version 1.3]",
+		"#[StartTime: 1700000000.000 (seconds since epoch), Tue Nov 14 22:13:20 UTC 2023]",
+		"#[BaseTime: 1700000000.000 (seconds since epoch)]",
+		`"StartTimestamp","Interval_Length","Interval_Max","Interval_Compressed_Histogram"`,
+	}
+	if len(lines) != len(header)+2 || !reflect.DeepEqual(lines[:len(header)], header) {
+		t.Fatalf("log\n%s", out.String())
+	}
+	for i, line := range lines[len(header):] {
+		fields := strings.Split(line, ",")
+		// the max is in milliseconds, the highest value of the HdrHistogram bucket of the LP bucket
+		// midpoint: 250488281 and 500976562 ns go to the buckets up to 250609663 and 501219327 ns
+		prefix := fmt.Sprintf("%d.000,1.000,%s", i, []string{"250.610", "501.219"}[i])
+		if len(fields) != 4 || strings.Join(fields[:3], ",") != prefix {
+			t.Fatalf("line %q", line)
+		}
+		buckets, err := DecodeHdrHistogram(fields[3], HdrCfg{Unit: 1e-9})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buckets.Count(0.25*float64(i+1)) != 10 {
+			t.Fatalf("line %q: %v", line, buckets.Buckets())
+		}
+	}
+}
+
+func TestRebucket(t *testing.T) {
+	// the LP bucket of 1 holds [1, 1+1/256)
+	buckets := NewUnSyncBuckets(BucketsCfg{})
+	buckets.InsertN(1, 1000)
+	buckets.InsertN(-2, 10)
+	buckets.InsertN(math.Inf(1), 3)
+	buckets.InsertN(math.NaN(), 5)
+	boundaries := []float64{-2, 1, 1.001, 5}
+	expected := map[SplitMode][]FixedBucket{
+		SplitLower: {
+			{UpperBound: -2, Count: 10}, {UpperBound: 1, Count: 1000}, {UpperBound: 1.001},
+			{UpperBound: 5}, {UpperBound: math.Inf(1), Count: 3},
+		},
+		SplitProportional: {
+			{UpperBound: -2, Count: 10}, {UpperBound: 1}, {UpperBound: 1.001, Count: 256},
+			{UpperBound: 5, Count: 744}, {UpperBound: math.Inf(1), Count: 3},
+		},
+		SplitBounds: {
+			{UpperBound: -2, Count: 10, MinCount: 10, MaxCount: 10}, {UpperBound: 1, MaxCount: 1000},
+			{UpperBound: 1.001, Count: 256, MaxCount: 1000}, {UpperBound: 5, Count: 744, MaxCount: 1000},
+			{UpperBound: math.Inf(1), Count: 3, MinCount: 3, MaxCount: 3},
+		},
+	}
+	for split, fixed := range expected {
+		actual := Rebucket(buckets, RebucketCfg{Boundaries: boundaries, Split: split})
+		for i := range actual {
+			actual[i].Count = math.Round(actual[i].Count*1e6) / 1e6
+		}
+		if !reflect.DeepEqual(actual, fixed) {
+			t.Fatalf("split %d: %+v, expected %+v", split, actual, fixed)
+		}
+	}
+
+	// the exact counts of the data are within the bounds, whatever the buckets lose
+	data := wideRangeData(10000)
+	boundaries = []float64{-1e3, -1, -1e-3, -1e-6, 0, 1e-6, 1e-3, 0.0025, 0.005, 0.01, 0.025, 1, 10, 1e3}
+	exact := make([]uint64, len(boundaries)+1)
+	for _, val := range data {
+		exact[sort.SearchFloat64s(boundaries, val)]++
+	}
+	cfgs := []BucketsCfg{{}, {ZeroThreshold: 1e-4}, {MaxLayers: 20}, {DroppedBits: 6}}
+	for _, cfg := range cfgs {
+		for _, buckets := range []Buckets{NewUnSyncBuckets(cfg), NewSyncBuckets(cfg), NewSparseBuckets(cfg)} {
+			for _, val := range data {
+				buckets.Insert(val)
+			}
+			for _, split := range []SplitMode{SplitLower, SplitProportional} {
+				total := 0.0
+				for _, fixed := range Rebucket(buckets, RebucketCfg{Boundaries: boundaries, Split: split}) {
+					total += fixed.Count
+				}
+				if math.Abs(total-float64(len(data))) > 1e-6 {
+					t.Fatalf("%T %+v split %d: total %g", buckets, cfg, split, total)
+				}
+			}
+			for i, fixed := range Rebucket(buckets, RebucketCfg{Boundaries: boundaries, Split: SplitBounds}) {
+				if exact[i] < fixed.MinCount || exact[i] > fixed.MaxCount ||
+					fixed.Count < float64(fixed.MinCount)-1e-6 || fixed.Count > float64(fixed.MaxCount)+1e-6 {
+					t.Fatalf("%T %+v: %d in %+v", buckets, cfg, exact[i], fixed)
+				}
+			}
+		}
+	}
+}
+
+func TestBuckets_Downsample(t *testing.T) {
+	data := append(wideRangeData(10000), 0, math.NaN(), math.Inf(1))
+	cfgs := []BucketsCfg{{}, {ZeroThreshold: 1e-6, MaxLayers: 30}, {KeepNonFinite: true}}
+	for _, cfg := range cfgs {
+		for _, bits := range []int{8, 7, 4, 0} {
+			unSync := NewUnSyncBuckets(cfg)
+			insertBuckets(unSync, data)
+			unSync.InsertWeighted(1.001, 2.5)
+			sync, sparse := NewSyncBuckets(cfg), NewSparseBuckets(cfg)
+			insertBuckets(sync, data)
+			insertBuckets(sparse, data)
+			cases := []struct {
+				buckets, downsampled Buckets
+			}{
+				{unSync, unSync.Downsample(bits)},
+				{sync, sync.Downsample(bits)},
+				{sparse, sparse.Downsample(bits)},
+			}
+			for _, c := range cases {
+				expected := map[LPFloat]uint64{}
+				c.buckets.Range(func(bucket Bucket) {
+					lpf := bucket.Value
+					if f := lpf.ToFloat64(); !math.IsNaN(f) && !math.IsInf(f, 0) {
+						lpf.Fraction &^= uint8(1<<uint(8-bits) - 1)
+					}
+					expected[lpf] += bucket.Count
+				})
+				actual := map[LPFloat]uint64{}
+				c.downsampled.Range(func(bucket Bucket) {
+					actual[bucket.Value] += bucket.Count
+				})
+				for lpf, count := range expected {
+					if count == 0 {
+						delete(expected, lpf)
+					}
+				}
+				if !reflect.DeepEqual(actual, expected) {
+					t.Fatalf("%T %+v %d bits: %v, expected %v", c.buckets, cfg, bits, actual, expected)
+				}
+				summary, downsampled := c.buckets.Summary([]float32{}), c.downsampled.Summary([]float32{})
+				if c.downsampled.Total() != c.buckets.Total() || math.Float64bits(c.downsampled.Sum()) != math.Float64bits(c.buckets.Sum()) ||
+					downsampled.Sum != summary.Sum || downsampled.Variance != summary.Variance ||
+					downsampled.TotalWeight != summary.TotalWeight || downsampled.NaN != summary.NaN ||
+					downsampled.Underflow != summary.Underflow || downsampled.Zero != summary.Zero {
+					t.Fatalf("%T %+v %d bits: %v, expected %v", c.buckets, cfg, bits, downsampled, summary)
+				}
+
+				if cfg.MaxLayers != 0 {
+					// the layer of 1.9 may be collapsed
+					continue
+				}
+				// inserts are coarsened too
+				held := c.downsampled.Count(1.9)
+				c.downsampled.Insert(1.9)
+				if c.downsampled.Count(1.9) != held+1 || bits == 0 && c.downsampled.Count(1) != held+1 {
+					t.Fatalf("%T %+v %d bits: %d observations of 1.9", c.buckets, cfg, bits, c.downsampled.Count(1.9))
+				}
+			}
+		}
+	}
+
+	buckets := NewUnSyncBuckets(BucketsCfg{})
+	buckets.InsertN(1, 2)
+	buckets.InsertN(1.9, 3)
+	downsampled := buckets.Downsample(0)
+	if !reflect.DeepEqual(downsampled.Buckets(), []Bucket{{Value: FromFloat64(1), Count: 5}}) {
+		t.Fatalf("%v", downsampled.Buckets())
+	}
+	if downsampled.Downsample(4).Downsample(8).cfg.DroppedBits != 8 {
+		t.Fatal("downsampling refined the buckets")
+	}
+	encoded, err := downsampled.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &UnSyncBuckets{}
+	if err := decoded.UnmarshalBinary(encoded); err != nil || encoded[1] != 0 || !reflect.DeepEqual(decoded, downsampled) {
+		t.Fatalf("%v: %+v", err, decoded)
+	}
+	encoded, err = json.Marshal(downsampled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded = &UnSyncBuckets{}
+	if err := json.Unmarshal(encoded, decoded); err != nil || decoded.cfg.DroppedBits != 8 ||
+		!reflect.DeepEqual(decoded.Buckets(), downsampled.Buckets()) {
+		t.Fatalf("%v: %+v", err, decoded)
+	}
+	// a bucket finer than the precision is rejected
+	encoded, _ = buckets.MarshalBinary()
+	encoded[1] = 0
+	if err := decoded.UnmarshalBinary(encoded); err == nil {
+		t.Fatal("fine bucket decoded")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("downsampled to 9 bits")
+			}
+		}()
+		buckets.Downsample(9)
+	}()
+}
+
+func TestBuckets_Scale(t *testing.T) {
+	data := append(wideRangeData(10000), 0, math.NaN(), math.Inf(1))
+	cfgs := []BucketsCfg{{}, {ZeroThreshold: 1e-6}, {MaxLayers: 20}, {DroppedBits: 4}}
+	percentiles := []float32{10, 50, 90, 99}
+	for _, cfg := range cfgs {
+		for _, factor := range []float64{1.0 / 1024, 1e-6, 1.1, 3} {
+			unSync, sync, sparse := NewUnSyncBuckets(cfg), NewSyncBuckets(cfg), NewSparseBuckets(cfg)
+			insertBuckets(unSync, data)
+			insertBuckets(sync, data)
+			insertBuckets(sparse, data)
+			cases := []struct {
+				buckets, scaled Buckets
+			}{
+				{unSync, unSync.Scale(factor)},
+				{sync, sync.Scale(factor)},
+				{sparse, sparse.Scale(factor)},
+			}
+			for _, c := range cases {
+				summary, scaled := c.buckets.Summary(percentiles), c.scaled.Summary(percentiles)
+				if c.scaled.Total() != c.buckets.Total() || scaled.NaN != summary.NaN || scaled.PosInf != summary.PosInf {
+					t.Fatalf("%T %+v x%g: %v, expected %v", c.buckets, cfg, factor, scaled, summary)
+				}
+				if sum := c.buckets.Sum() * factor; math.Abs(c.scaled.Sum()-sum) > 1e-9*math.Abs(sum) {
+					t.Fatalf("%T %+v x%g: sum %g, expected %g", c.buckets, cfg, factor, c.scaled.Sum(), sum)
+				}
+				variance := summary.Variance.ToFloat64() * factor * factor
+				if math.Abs(scaled.Variance.ToFloat64()-variance) > 0.01*variance || !scaled.Skewness.AlmostEqual(summary.Skewness) {
+					t.Fatalf("%T %+v x%g: variance %v, skewness %v, expected %g, %v",
+						c.buckets, cfg, factor, scaled.Variance, scaled.Skewness, variance, summary.Skewness)
+				}
+				checkScaledLayers(t, c.scaled)
+				if bucketsCfgOf(c.scaled).ZeroThreshold != cfg.ZeroThreshold*factor {
+					t.Fatalf("%T %+v x%g: zero threshold %g", c.buckets, cfg, factor, bucketsCfgOf(c.scaled).ZeroThreshold)
+				}
+				if _, ok := c.scaled.(*UnSyncBuckets); ok && cfg.MaxLayers != 0 && len(c.scaled.(*UnSyncBuckets).layers) > cfg.MaxLayers {
+					t.Fatalf("%T %+v x%g: %d layers", c.buckets, cfg, factor, len(c.scaled.(*UnSyncBuckets).layers))
+				}
+				if factor == 1.0/1024 {
+					// an exponent shift moves the buckets exactly
+					var expected, actual []Bucket
+					c.buckets.Range(func(bucket Bucket) {
+						bucket.Value = FromFloat64(bucket.Value.ToFloat64() * factor)
+						expected = append(expected, bucket)
+					})
+					c.scaled.Range(func(bucket Bucket) {
+						actual = append(actual, bucket)
+					})
+					if fmt.Sprint(actual) != fmt.Sprint(expected) || c.scaled.Sum() != c.buckets.Sum()*factor {
+						t.Fatalf("%T %+v x%g: %v, expected %v", c.buckets, cfg, factor, actual, expected)
+					}
+				}
+				if cfg.MaxLayers != 0 {
+					continue
+				}
+				for i, p := range summary.Percentiles {
+					expected, actual := p.LessThan.ToFloat64()*factor, scaled.Percentiles[i].LessThan.ToFloat64()
+					if math.Abs(actual-expected) > math.Ldexp(2, cfg.DroppedBits-8)*math.Abs(expected) {
+						t.Fatalf("%T %+v x%g: P%g %g, expected %g", c.buckets, cfg, factor, p.Percentile, actual, expected)
+					}
+				}
+			}
+		}
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("scaled by 0")
+			}
+		}()
+		NewUnSyncBuckets(BucketsCfg{}).Scale(0)
+	}()
+}
+
+// checkScaledLayers checks that the statistics of each layer match the counts of its buckets.
+func checkScaledLayers(t *testing.T, buckets Buckets) {
+	check := func(signAndExp int16, stats *layerStats, count uint64) {
+		negative := signAndExp < 0
+		if stats.count != count || count != 0 && signAndExp&0x7ff0 != 0 && (stats.sum == 0 || negative != (stats.sum < 0)) {
+			t.Fatalf("%T layer %#x: %d observations summing to %g, %d in buckets",
+				buckets, uint16(signAndExp), stats.count, stats.sum, count)
+		}
+	}
+	switch b := buckets.(type) {
+	case *UnSyncBuckets:
+		for i := range b.layers {
+			count := uint64(0)
+			for _, c := range b.layers[i].buckets {
+				count += c
+			}
+			check(b.layers[i].signAndExp, &b.layers[i].layerStats, count)
+		}
+	case *SyncBuckets:
+		checkScaledLayers(t, b.Snapshot())
+	case *SparseBuckets:
+		for i := range b.layers {
+			count := uint64(0)
+			for j := 0; j < b.layers[i].len(); j++ {
+				count += b.layers[i].bucketAt(j).Count
+			}
+			check(b.layers[i].signAndExp, &b.layers[i].layerStats, count)
+		}
+	}
+}
+
+func TestSummary_InUnit(t *testing.T) {
+	buckets := NewUnSyncBuckets(BucketsCfg{})
+	for _, size := range []float64{1024, 2048, 3072, 4096} {
+		buckets.Insert(size)
+	}
+	summary := buckets.Summary([]float32{50})
+	kib := summary.InUnit("KiB", 1024)
+	if kib.Total != 4 || kib.Sum != summary.Sum || kib.Kurtosis != summary.Kurtosis || kib.Percentiles[0] != summary.Percentiles[0] {
+		t.Fatalf("%v", kib)
+	}
+	for _, s := range []string{kib.String(), fmt.Sprintf("%v", kib)} {
+		if !strings.Contains(s, "Sum: 10KiB") || !strings.Contains(s, "Max: 4KiB") ||
+			!strings.Contains(s, "Variance: 1.25KiB^2") || !strings.Contains(s, "P50: 2KiB") {
+			t.Fatalf("%s", s)
+		}
+	}
+	// the values are divided when printed, without truncating them again
+	nanos := NewUnSyncBuckets(BucketsCfg{})
+	nanos.Insert(1.5e6)
+	nanos.Insert(2.5e6)
+	ns := nanos.Summary([]float32{50})
+	ms := ns.InUnit("ms", 1e6)
+	for _, s := range []string{ms.String(), fmt.Sprintf("%v", ms)} {
+		if !strings.Contains(s, fmt.Sprintf("Max: %vms", ns.Max.ToFloat64()/1e6)) ||
+			!strings.Contains(s, fmt.Sprintf("P50: %vms", ns.Percentiles[0].LessThan.ToFloat64()/1e6)) ||
+			!strings.Contains(s, fmt.Sprintf("Variance: %vms^2", ns.Variance.ToFloat64()/1e12)) {
+			t.Fatalf("%v: %s", ns, s)
+		}
+	}
+	encoded, err := json.Marshal(kib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Summary
+	if err := json.Unmarshal(encoded, &decoded); err != nil || decoded.Unit != "KiB" || decoded.UnitSize != 1024 ||
+		decoded.Sum != summary.Sum {
+		t.Fatalf("%v: %s", err, encoded)
+	}
+}
+
+// TestBuckets_CompensatedSum inserts 10^9 values into each implementation with LPFLOAT_LONG_TESTS set,
+// which takes a few minutes, and 10^7 otherwise.
+func TestBuckets_CompensatedSum(t *testing.T) {
+	values := []float64{0.1, 3.3e-5, 7.7, 1234.5678, 1e-3, 0.3}
+	inserts := 10000000
+	if os.Getenv("LPFLOAT_LONG_TESTS") != "" {
+		inserts = 1000000000
+	}
+	expected := new(big.Float)
+	for i, val := range values {
+		count := inserts / len(values)
+		if i < inserts%len(values) {
+			count++
+		}
+		expected.Add(expected, new(big.Float).Mul(big.NewFloat(val), big.NewFloat(float64(count))))
+	}
+	exp, _ := expected.Float64()
+	relErr := func(buckets Buckets) float64 {
+		for i := 0; i < inserts; i++ {
+			buckets.Insert(values[i%len(values)])
+		}
+		return math.Abs(buckets.Sum()-exp) / exp
+	}
+
+	cfg := BucketsCfg{CompensatedSum: true}
+	for _, buckets := range []Buckets{NewUnSyncBuckets(cfg), NewSyncBuckets(cfg), NewSparseBuckets(cfg)} {
+		if err := relErr(buckets); err > 1e-15 {
+			t.Fatalf("%T sum after %d inserts, expected %.17g, actual %.17g", buckets, inserts, exp, buckets.Sum())
+		}
+	}
+	// the inserts are enough for the naive sum to drift, or the bound above would tell nothing
+	if err := relErr(NewUnSyncBuckets(BucketsCfg{})); err < 1e-13 {
+		t.Fatalf("naive sum after %d inserts only %g off", inserts, err)
+	}
+}
+
 func BenchmarkLPFloat_FromFloat64(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		_ = FromFloat64(float64(i))
@@ -196,6 +2431,16 @@ func BenchmarkUnSyncBuckets_Insert(b *testing.B) {
 	//b.Logf("%.3g", buckets.Summary(DefaultPercentilesCfg()))
 }
 
+func BenchmarkSparseBuckets_Insert(b *testing.B) {
+	var buckets SparseBuckets
+	data := randomData(10000, 0.01, 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buckets.Insert(data[i%len(data)])
+	}
+}
+
 func BenchmarkSyncBuckets_Insert(b *testing.B) {
 	var buckets SyncBuckets
 	b.ReportAllocs()
@@ -223,6 +2468,36 @@ func BenchmarkSyncBuckets_Insert_Parallel(b *testing.B) {
 	})
 }
 
+func BenchmarkUnSyncBuckets_Insert_WideRange(b *testing.B) {
+	var buckets UnSyncBuckets
+	data := wideRangeData(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buckets.Insert(data[i%len(data)])
+	}
+}
+
+func BenchmarkSyncBuckets_Insert_WideRange(b *testing.B) {
+	var buckets SyncBuckets
+	data := wideRangeData(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buckets.Insert(data[i%len(data)])
+	}
+}
+
+func BenchmarkUnSyncBuckets_Count_WideRange(b *testing.B) {
+	var buckets UnSyncBuckets
+	data := wideRangeData(10000)
+	insertBuckets(&buckets, data)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = buckets.Count(data[i%len(data)])
+	}
+}
+
 func insertBuckets(buckets Buckets, data []float64) {
 	for _, val := range data {
 		buckets.InsertN(val, 2)
@@ -242,6 +2517,30 @@ func randomData(size int, min, max float64) []float64 {
 	return buckets
 }
 
+// wideRangeData returns signed values whose magnitudes spread from nanoseconds to hours.
+func wideRangeData(size int) []float64 {
+	rand.Seed(int64(time.Now().Nanosecond()))
+	data := make([]float64, 0, size)
+	for i := 0; i < size; i++ {
+		val := math.Pow(10, -9+rand.Float64()*13)
+		if rand.Intn(2) == 0 {
+			val = -val
+		}
+		data = append(data, val)
+	}
+	return data
+}
+
+func plainCount(buckets []Bucket, val float64) uint64 {
+	lpf := FromFloat64(val)
+	for _, bucket := range buckets {
+		if bucket.Value == lpf {
+			return bucket.Count
+		}
+	}
+	return 0
+}
+
 func calPlainSummary(data []float64, percentilesCfg []float32) Summary {
 	summary := makeSummary(percentilesCfg)
 	if len(data) == 0 {
@@ -256,6 +2555,20 @@ func calPlainSummary(data []float64, percentilesCfg []float32) Summary {
 	summary.Sum = FromFloat64(sum)
 	summary.Avg = FromFloat64(sum / float64(len(data)))
 
+	n := float64(len(data))
+	mean := sum / n
+	var m2, m3, m4 float64
+	for _, val := range data {
+		d := val - mean
+		m2 += d * d
+		m3 += d * d * d
+		m4 += d * d * d * d
+	}
+	summary.Variance = FromFloat64(m2 / n)
+	summary.StdDev = FromFloat64(math.Sqrt(m2 / n))
+	summary.Skewness = FromFloat64(math.Sqrt(n) * m3 / math.Pow(m2, 1.5))
+	summary.Kurtosis = FromFloat64(n*m4/(m2*m2) - 3)
+
 	summary.Min = buckets[0].Value
 	summary.Max = buckets[len(buckets)-1].Value
 
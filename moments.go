@@ -0,0 +1,151 @@
+package lpfloat
+
+import (
+	"math"
+)
+
+// layerMoments accumulates the power sums of the values inserted into a layer,
+// shifted by the first value the layer ever saw. Values of a layer share their exponent,
+// so the pivot stays close to the layer mean and the shifted sums don't suffer from the
+// catastrophic cancellation of plain sums of squares.
+type layerMoments struct {
+	pivot float64
+	s     [4]float64 // sum of (x-pivot)^1..4
+}
+
+func makeLayerMoments(pivot float64) layerMoments {
+	return layerMoments{pivot: pivot}
+}
+
+func (m *layerMoments) add(f float64, count uint64) {
+	m.addWeight(f, float64(count))
+}
+
+// addWeight adds f with weight n, a negative weight takes it back out.
+func (m *layerMoments) addWeight(f float64, n float64) {
+	d := f - m.pivot
+	d2 := d * d
+	m.s[0] += n * d
+	m.s[1] += n * d2
+	m.s[2] += n * d2 * d
+	m.s[3] += n * d2 * d2
+}
+
+// merge adds the sums of o, which must share the pivot of m.
+func (m *layerMoments) merge(o *layerMoments) {
+	for i := range m.s {
+		m.s[i] += o.s[i]
+	}
+}
+
+// rebase returns the sums of values weighing n altogether shifted by another pivot.
+func (m *layerMoments) rebase(pivot float64, n float64) layerMoments {
+	d := m.pivot - pivot
+	s1, s2, s3, s4 := m.s[0], m.s[1], m.s[2], m.s[3]
+	return layerMoments{pivot: pivot, s: [4]float64{
+		s1 + n*d,
+		s2 + 2*d*s1 + n*d*d,
+		s3 + 3*d*s2 + 3*d*d*s1 + n*d*d*d,
+		s4 + 4*d*s3 + 6*d*d*s2 + 4*d*d*d*s1 + n*d*d*d*d,
+	}}
+}
+
+func (m *layerMoments) reset() {
+	m.s = [4]float64{}
+}
+
+// central converts the shifted power sums into central moments.
+func (m *layerMoments) central(count uint64) centralMoments {
+	return m.centralWeight(float64(count))
+}
+
+// centralWeight is central for sums of weighted values, n being the sum of the weights.
+func (m *layerMoments) centralWeight(n float64) centralMoments {
+	if n == 0 {
+		return centralMoments{}
+	}
+	s1, s2, s3, s4 := m.s[0], m.s[1], m.s[2], m.s[3]
+	mean := s1 / n
+	return centralMoments{
+		n:    n,
+		mean: m.pivot + mean,
+		m2:   s2 - s1*mean,
+		m3:   s3 - 3*mean*s2 + 2*n*mean*mean*mean,
+		m4:   s4 - 4*mean*s3 + 6*mean*mean*s2 - 3*n*mean*mean*mean*mean,
+	}
+}
+
+// centralMoments holds the mean and the sums of 2nd to 4th powers of deviations from the mean.
+type centralMoments struct {
+	n    float64
+	mean float64
+	m2   float64
+	m3   float64
+	m4   float64
+}
+
+// merge combines two sets of central moments, see Pébay, "Formulas for Robust, One-Pass Parallel
+// Computation of Covariances and Arbitrary-Order Statistical Moments", 2008.
+func (c *centralMoments) merge(o centralMoments) {
+	if o.n == 0 {
+		return
+	}
+	if c.n == 0 {
+		*c = o
+		return
+	}
+	na, nb := c.n, o.n
+	n := na + nb
+	delta := o.mean - c.mean
+	delta2 := delta * delta
+
+	m2 := c.m2 + o.m2 + delta2*na*nb/n
+	m3 := c.m3 + o.m3 + delta2*delta*na*nb*(na-nb)/(n*n) +
+		3*delta*(na*o.m2-nb*c.m2)/n
+	m4 := c.m4 + o.m4 + delta2*delta2*na*nb*(na*na-na*nb+nb*nb)/(n*n*n) +
+		6*delta2*(na*na*o.m2+nb*nb*c.m2)/(n*n) +
+		4*delta*(na*o.m3-nb*c.m3)/n
+
+	c.mean += delta * nb / n
+	c.n = n
+	c.m2, c.m3, c.m4 = m2, m3, m4
+}
+
+// unmerge takes the moments of o, which were merged before, back out of c.
+func (c *centralMoments) unmerge(o centralMoments) {
+	if o.n == 0 {
+		return
+	}
+	if o.n >= c.n {
+		*c = centralMoments{}
+		return
+	}
+	n, nb := c.n, o.n
+	na := n - nb
+	mean := (c.mean*n - o.mean*nb) / na
+	delta := o.mean - mean
+	delta2 := delta * delta
+
+	m2 := c.m2 - o.m2 - delta2*na*nb/n
+	m3 := c.m3 - o.m3 - delta2*delta*na*nb*(na-nb)/(n*n) -
+		3*delta*(na*o.m2-nb*m2)/n
+	m4 := c.m4 - o.m4 - delta2*delta2*na*nb*(na*na-na*nb+nb*nb)/(n*n*n) -
+		6*delta2*(na*na*o.m2+nb*nb*m2)/(n*n) -
+		4*delta*(na*o.m3-nb*m3)/n
+
+	c.n, c.mean = na, mean
+	c.m2, c.m3, c.m4 = m2, m3, m4
+}
+
+// fill sets the spread measures of the summary: population variance, standard deviation,
+// skewness and excess kurtosis.
+func (c *centralMoments) fill(s *Summary) {
+	if c.n == 0 {
+		return
+	}
+	variance := c.m2 / c.n
+	s.Variance = statistic(variance)
+	s.StdDev = statistic(math.Sqrt(variance))
+	s.Skewness = statistic(math.Sqrt(c.n) * c.m3 / math.Pow(c.m2, 1.5))
+	s.Kurtosis = statistic(c.n*c.m4/(c.m2*c.m2) - 3)
+}
@@ -0,0 +1,66 @@
+package lpfloat
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// nonFiniteCounts counts the NaNs and infinities kept out of the layers.
+type nonFiniteCounts struct {
+	nan    uint64
+	posInf uint64
+	negInf uint64
+}
+
+func (c *nonFiniteCounts) counter(f float64) *uint64 {
+	switch {
+	case math.IsNaN(f):
+		return &c.nan
+	case f > 0:
+		return &c.posInf
+	default:
+		return &c.negInf
+	}
+}
+
+func (c *nonFiniteCounts) add(f float64, count uint64) {
+	*c.counter(f) += count
+}
+
+func (c *nonFiniteCounts) atomicAdd(f float64, count uint64) {
+	atomic.AddUint64(c.counter(f), count)
+}
+
+func (c *nonFiniteCounts) merge(o *nonFiniteCounts) {
+	c.nan += o.nan
+	c.posInf += o.posInf
+	c.negInf += o.negInf
+}
+
+func (c *nonFiniteCounts) remove(f float64, count uint64) error {
+	counter := c.counter(f)
+	if *counter < count {
+		return countUnderflowError(f, count, *counter)
+	}
+	*counter -= count
+	return nil
+}
+
+func (c *nonFiniteCounts) atomicRemove(f float64, count uint64) error {
+	_, err := atomicSubUint64(c.counter(f), f, count)
+	return err
+}
+
+func (c *nonFiniteCounts) atomicLoad() nonFiniteCounts {
+	return nonFiniteCounts{
+		nan:    atomic.LoadUint64(&c.nan),
+		posInf: atomic.LoadUint64(&c.posInf),
+		negInf: atomic.LoadUint64(&c.negInf),
+	}
+}
+
+func (c *nonFiniteCounts) atomicReset() {
+	atomic.StoreUint64(&c.nan, 0)
+	atomic.StoreUint64(&c.posInf, 0)
+	atomic.StoreUint64(&c.negInf, 0)
+}
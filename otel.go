@@ -0,0 +1,214 @@
+package lpfloat
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// OTelNativeScale is the scale of the OpenTelemetry exponential histograms converted from buckets
+// unless OTelCfg.MaxSize makes them coarser. Its buckets grow by 2^(1/128), about 0.54%, a bit more
+// than the 0.2% to 0.39% LP buckets grow by, so every LP bucket overlaps at most two of them.
+const OTelNativeScale = 7
+
+// OTelCfg configures the conversion of buckets to OpenTelemetry exponential histograms.
+type OTelCfg struct {
+	// MaxSize caps the number of positive buckets and the number of negative ones, the scale is lowered
+	// until both fit, 0 means unlimited. It should be at least 2, OpenTelemetry SDKs default to 160.
+	MaxSize int
+}
+
+func CheckOTelCfg(cfg OTelCfg) error {
+	if cfg.MaxSize < 0 || cfg.MaxSize == 1 {
+		return errors.New("the max size should be 0 or at least 2")
+	}
+	return nil
+}
+
+func mustCheckOTelCfg(cfg OTelCfg) {
+	if err := CheckOTelCfg(cfg); err != nil {
+		panic(fmt.Errorf("invalid otel cfg %+v: %s", cfg, err))
+	}
+}
+
+// OTelExponentialHistogram is the data point of the OpenTelemetry base-2 exponential histogram data
+// model, where the bucket of index i at scale s holds the magnitudes in (2^(i*2^-s), 2^((i+1)*2^-s)].
+type OTelExponentialHistogram struct {
+	// Count is the number of observations in the buckets and the zero bucket.
+	Count uint64
+	Sum   float64
+	// Min and Max are the ones of Summary, NaN if there are no observations.
+	Min           float64
+	Max           float64
+	Scale         int32
+	ZeroCount     uint64
+	ZeroThreshold float64
+	Positive      OTelBuckets
+	Negative      OTelBuckets
+}
+
+// OTelBuckets are the buckets of one sign, BucketCounts[i] being the count of the bucket of index Offset+i.
+type OTelBuckets struct {
+	Offset       int32
+	BucketCounts []uint64
+}
+
+// ToOTelExponentialHistogram converts the buckets to an OpenTelemetry exponential histogram.
+//
+// LP buckets split every power of 2 in 256 linear steps while exponential buckets grow geometrically,
+// so their boundaries only meet at powers of 2. Every LP bucket goes whole into the exponential bucket
+// of its midpoint: an observation lands at most one bucket away from where an OpenTelemetry SDK
+// would have put it. The values of the zero bucket, see BucketsCfg.ZeroThreshold, go into ZeroCount.
+// The observations collapsed by BucketsCfg.MaxLayers go into the buckets of Min for the underflow and
+// Max for the overflow. NaNs and infinities have no place in exponential histograms and are left out.
+func ToOTelExponentialHistogram(buckets Buckets, cfg OTelCfg) OTelExponentialHistogram {
+	mustCheckOTelCfg(cfg)
+	e := newExponentialHistogram(buckets)
+	h := OTelExponentialHistogram{
+		Count:         e.count,
+		Sum:           e.sum,
+		Min:           e.min,
+		Max:           e.max,
+		Scale:         OTelNativeScale,
+		ZeroCount:     e.zeroCount,
+		ZeroThreshold: e.zeroThreshold,
+	}
+	for cfg.MaxSize != 0 && (e.positive.size() > cfg.MaxSize || e.negative.size() > cfg.MaxSize) {
+		e.positive.downscale()
+		e.negative.downscale()
+		h.Scale--
+	}
+	h.Positive = e.positive.buckets()
+	h.Negative = e.negative.buckets()
+	return h
+}
+
+// exponentialHistogram holds buckets mapped to exponential buckets at OTelNativeScale,
+// see ToOTelExponentialHistogram.
+type exponentialHistogram struct {
+	count         uint64
+	sum           float64
+	min           float64
+	max           float64
+	zeroCount     uint64
+	zeroThreshold float64
+	positive      exponentialIndexes
+	negative      exponentialIndexes
+}
+
+func newExponentialHistogram(buckets Buckets) *exponentialHistogram {
+	if snapshotter, ok := buckets.(interface{ Snapshot() *UnSyncBuckets }); ok {
+		buckets = snapshotter.Snapshot()
+	}
+	cfg := bucketsCfgOf(buckets)
+	summary := buckets.Summary([]float32{})
+	e := &exponentialHistogram{
+		sum:           buckets.Sum(),
+		min:           math.NaN(),
+		max:           math.NaN(),
+		zeroThreshold: cfg.ZeroThreshold,
+	}
+	e.add(summary.Min.ToFloat64(), summary.Min.ToFloat64(), summary.Underflow)
+	buckets.Range(func(bucket Bucket) {
+		e.add(bucket.Value.ToFloat64(), cfg.bucketMidpoint(bucket.Value), bucket.Count)
+	})
+	e.add(summary.Max.ToFloat64(), summary.Max.ToFloat64(), summary.Overflow)
+	return e
+}
+
+// add adds count observations of value, placed at the magnitude of at.
+func (e *exponentialHistogram) add(value, at float64, count uint64) {
+	switch {
+	case count == 0 || math.IsNaN(at) || math.IsInf(at, 0):
+		return
+	case at == 0:
+		e.zeroCount += count
+	case at > 0:
+		e.positive.add(exponentialIndex(at), count)
+	default:
+		e.negative.add(exponentialIndex(-at), count)
+	}
+	e.count += count
+	if math.IsNaN(e.min) {
+		e.min = value
+	}
+	e.max = value
+}
+
+func bucketsCfgOf(buckets Buckets) BucketsCfg {
+	switch b := buckets.(type) {
+	case *UnSyncBuckets:
+		return b.cfg
+	case *SyncBuckets:
+		return b.cfg
+	case *SparseBuckets:
+		return b.cfg
+	default:
+		return BucketsCfg{}
+	}
+}
+
+// bucketMidpoint returns the middle of the values an LP bucket holds, 0 for the zero bucket.
+func (cfg *BucketsCfg) bucketMidpoint(lpf LPFloat) float64 {
+	f := lpf.ToFloat64()
+	if f == 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+		return f
+	}
+	next := math.Float64frombits(math.Float64bits(f) + cfg.bucketStep())
+	return f + (next-f)/2
+}
+
+// exponentialIndex returns the index at OTelNativeScale of the exponential bucket holding the magnitude f.
+func exponentialIndex(f float64) int32 {
+	return int32(math.Ceil(math.Log2(f)*(1<<OTelNativeScale))) - 1
+}
+
+// exponentialIndexes accumulates the counts of exponential buckets of one sign.
+type exponentialIndexes struct {
+	counts   map[int32]uint64
+	min, max int32
+}
+
+func (x *exponentialIndexes) add(index int32, count uint64) {
+	if x.counts == nil {
+		x.counts = make(map[int32]uint64)
+		x.min, x.max = index, index
+	}
+	x.counts[index] += count
+	if index < x.min {
+		x.min = index
+	}
+	if index > x.max {
+		x.max = index
+	}
+}
+
+func (x *exponentialIndexes) size() int {
+	if x.counts == nil {
+		return 0
+	}
+	return int(x.max-x.min) + 1
+}
+
+// downscale halves the scale, merging pairs of buckets.
+func (x *exponentialIndexes) downscale() {
+	if x.counts == nil {
+		return
+	}
+	counts := make(map[int32]uint64, len(x.counts))
+	for index, count := range x.counts {
+		counts[index>>1] += count
+	}
+	x.counts, x.min, x.max = counts, x.min>>1, x.max>>1
+}
+
+func (x *exponentialIndexes) buckets() OTelBuckets {
+	if x.counts == nil {
+		return OTelBuckets{}
+	}
+	b := OTelBuckets{Offset: x.min, BucketCounts: make([]uint64, x.size())}
+	for index, count := range x.counts {
+		b.BucketCounts[index-x.min] = count
+	}
+	return b
+}
@@ -0,0 +1,221 @@
+package lpfloat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PrometheusCfg configures the exposition of buckets and summaries in the Prometheus text format.
+type PrometheusCfg struct {
+	// Name is the metric name, histograms add the _bucket, _sum and _count suffixes to it.
+	Name string
+	// Help is the text of the HELP line, which is left out if empty.
+	Help string
+	// Labels are added to every series, in the order of their names.
+	Labels map[string]string
+	// Boundaries are the le upper bounds of the histogram buckets, ascending and finite, +Inf being
+	// implicit. If empty, every populated LP bucket gets its own boundary, its upper bound.
+	Boundaries []float64
+}
+
+func CheckPrometheusCfg(cfg PrometheusCfg) error {
+	if !validPrometheusName(cfg.Name, true) {
+		return errors.New("the name should match [a-zA-Z_:][a-zA-Z0-9_:]*")
+	}
+	for name := range cfg.Labels {
+		if !validPrometheusName(name, false) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("the label name %q should match [a-zA-Z_][a-zA-Z0-9_]* without a leading __", name)
+		}
+		if name == "le" || name == "quantile" {
+			return fmt.Errorf("the label name %q is reserved", name)
+		}
+	}
+	for i, boundary := range cfg.Boundaries {
+		if math.IsNaN(boundary) || math.IsInf(boundary, 0) || i > 0 && boundary <= cfg.Boundaries[i-1] {
+			return errors.New("the boundaries should be ascending finite numbers")
+		}
+	}
+	return nil
+}
+
+func mustCheckPrometheusCfg(cfg PrometheusCfg) {
+	if err := CheckPrometheusCfg(cfg); err != nil {
+		panic(fmt.Errorf("invalid prometheus cfg %+v: %s", cfg, err))
+	}
+}
+
+func validPrometheusName(name string, colons bool) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		case c == ':' && colons:
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// PrometheusWriter writes buckets and summaries in the Prometheus text exposition format,
+// without depending on a client library.
+type PrometheusWriter struct {
+	cfg    PrometheusCfg
+	labels string // rendered labels followed by a comma, empty without labels
+}
+
+func NewPrometheusWriter(cfg PrometheusCfg) *PrometheusWriter {
+	mustCheckPrometheusCfg(cfg)
+	names := make([]string, 0, len(cfg.Labels))
+	for name := range cfg.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var labels strings.Builder
+	for _, name := range names {
+		labels.WriteString(name + "=" + quotePrometheusLabel(cfg.Labels[name]) + ",")
+	}
+	return &PrometheusWriter{cfg: cfg, labels: labels.String()}
+}
+
+// WriteHistogram writes the buckets as a histogram: the cumulative _bucket{le="..."} series, _sum and _count.
+//
+// An LP bucket counts toward the boundaries not below its value, so the count of a boundary falling
+// into an LP bucket is off by the observations of this bucket above the boundary. The observations
+// collapsed by BucketsCfg.MaxLayers count as if they were all at Summary.Min for the underflow and
+// Summary.Max for the overflow. NaNs and infinities counted apart by the buckets only count toward
+// the +Inf boundary and _count, except -Inf which counts toward every boundary. They are left out of _sum.
+// SyncBuckets are written from a snapshot, so the series are consistent with each other.
+func (w *PrometheusWriter) WriteHistogram(out io.Writer, buckets Buckets) error {
+	if snapshotter, ok := buckets.(interface{ Snapshot() *UnSyncBuckets }); ok {
+		buckets = snapshotter.Snapshot()
+	}
+	summary := buckets.Summary([]float32{})
+	var lpBuckets []Bucket
+	buckets.Range(func(bucket Bucket) {
+		// kept NaNs have layers of their own, on both ends
+		if math.IsNaN(bucket.Value.ToFloat64()) {
+			summary.NaN += bucket.Count
+		} else {
+			lpBuckets = append(lpBuckets, bucket)
+		}
+	})
+
+	boundaries := w.cfg.Boundaries
+	if len(boundaries) == 0 {
+		cfg := bucketsCfgOf(buckets)
+		boundaries = make([]float64, 0, len(lpBuckets))
+		for _, bucket := range lpBuckets {
+			// both signed zeros are bounded by the zero threshold
+			upper := cfg.bucketUpperBound(bucket.Value)
+			if !math.IsInf(upper, 0) && (len(boundaries) == 0 || upper != boundaries[len(boundaries)-1]) {
+				boundaries = append(boundaries, upper)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	w.writeHeader(&buf, "histogram")
+	cumulative, next := summary.NegInf, 0
+	for _, boundary := range boundaries {
+		for ; next < len(lpBuckets) && lpBuckets[next].Value.ToFloat64() <= boundary; next++ {
+			cumulative += lpBuckets[next].Count
+		}
+		if summary.Underflow != 0 && summary.Min.ToFloat64() <= boundary {
+			cumulative += summary.Underflow
+			summary.Underflow = 0
+		}
+		if summary.Overflow != 0 && summary.Max.ToFloat64() <= boundary {
+			cumulative += summary.Overflow
+			summary.Overflow = 0
+		}
+		w.writeSample(&buf, "_bucket", "le", formatPrometheusFloat(boundary), cumulative)
+	}
+	for ; next < len(lpBuckets); next++ {
+		cumulative += lpBuckets[next].Count
+	}
+	cumulative += summary.Underflow + summary.Overflow + summary.NaN + summary.PosInf
+	w.writeSample(&buf, "_bucket", "le", "+Inf", cumulative)
+	w.writeValue(&buf, "_sum", formatPrometheusFloat(buckets.Sum()))
+	w.writeValue(&buf, "_count", strconv.FormatUint(cumulative, 10))
+	_, err := out.Write(buf.Bytes())
+	return err
+}
+
+// WriteSummary writes the summary as a Prometheus summary: a {quantile="..."} series per percentile,
+// _sum and _count. Non-finite observations counted apart by the buckets are left out of _count.
+func (w *PrometheusWriter) WriteSummary(out io.Writer, summary Summary) error {
+	var buf bytes.Buffer
+	w.writeHeader(&buf, "summary")
+	for _, p := range summary.Percentiles {
+		// shifting the decimal point of the shortest representation keeps 99.9 from becoming 0.9990000000000001
+		quantile, _ := strconv.ParseFloat(strconv.FormatFloat(float64(p.Percentile), 'g', -1, 32)+"e-2", 64)
+		buf.WriteString(w.cfg.Name + "{" + w.labels + `quantile="` + formatPrometheusFloat(quantile) + `"} ` +
+			formatPrometheusFloat(p.LessThan.ToFloat64()) + "\n")
+	}
+	w.writeValue(&buf, "_sum", formatPrometheusFloat(summary.Sum.ToFloat64()))
+	w.writeValue(&buf, "_count", strconv.FormatUint(summary.Total, 10))
+	_, err := out.Write(buf.Bytes())
+	return err
+}
+
+func (w *PrometheusWriter) writeHeader(buf *bytes.Buffer, typ string) {
+	if w.cfg.Help != "" {
+		help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(w.cfg.Help)
+		buf.WriteString("# HELP " + w.cfg.Name + " " + help + "\n")
+	}
+	buf.WriteString("# TYPE " + w.cfg.Name + " " + typ + "\n")
+}
+
+func (w *PrometheusWriter) writeSample(buf *bytes.Buffer, suffix, label, labelValue string, count uint64) {
+	buf.WriteString(w.cfg.Name + suffix + "{" + w.labels + label + `="` + labelValue + `"} ` +
+		strconv.FormatUint(count, 10) + "\n")
+}
+
+func (w *PrometheusWriter) writeValue(buf *bytes.Buffer, suffix, value string) {
+	buf.WriteString(w.cfg.Name + suffix)
+	if w.labels != "" {
+		buf.WriteString("{" + strings.TrimSuffix(w.labels, ",") + "}")
+	}
+	buf.WriteString(" " + value + "\n")
+}
+
+func quotePrometheusLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+func formatPrometheusFloat(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+// bucketUpperBound returns the upper bound of an LP bucket: values are truncated toward 0,
+// so a positive bucket holds values below the next bucket value and a negative one values up to its own.
+// The zero bucket is bounded by BucketsCfg.ZeroThreshold, 0 without one.
+func (cfg *BucketsCfg) bucketUpperBound(lpf LPFloat) float64 {
+	f := lpf.ToFloat64()
+	if f == 0 {
+		return cfg.ZeroThreshold
+	}
+	if math.Signbit(f) || math.IsInf(f, 1) {
+		return f
+	}
+	return math.Float64frombits(math.Float64bits(f) + cfg.bucketStep())
+}
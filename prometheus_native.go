@@ -0,0 +1,284 @@
+package lpfloat
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// Prometheus native histograms have the buckets of OpenTelemetry exponential histograms,
+// the schema being the scale, but index them from 1: bucket i holds (2^((i-1)*2^-s), 2^(i*2^-s)].
+// Schemas go down to prometheusMinSchema.
+const prometheusMinSchema = -4
+
+// PrometheusNativeCfg configures the conversion of buckets to Prometheus native histograms.
+type PrometheusNativeCfg struct {
+	// MaxBuckets caps the number of populated buckets, both signs included: the schema is lowered
+	// until they fit or it reaches -4, the lowest Prometheus accepts. 0 means unlimited.
+	MaxBuckets int
+}
+
+func CheckPrometheusNativeCfg(cfg PrometheusNativeCfg) error {
+	if cfg.MaxBuckets < 0 {
+		return errors.New("the max buckets should not be negative")
+	}
+	return nil
+}
+
+func mustCheckPrometheusNativeCfg(cfg PrometheusNativeCfg) {
+	if err := CheckPrometheusNativeCfg(cfg); err != nil {
+		panic(fmt.Errorf("invalid prometheus native cfg %+v: %s", cfg, err))
+	}
+}
+
+// PrometheusNativeHistogram is a Prometheus native histogram with integer counts,
+// shaped like the Histogram message of remote write.
+type PrometheusNativeHistogram struct {
+	Count         uint64
+	Sum           float64
+	Schema        int32
+	ZeroThreshold float64
+	ZeroCount     uint64
+	// NegativeSpans and PositiveSpans locate the buckets, NegativeDeltas and PositiveDeltas hold their
+	// counts, each one as the difference to the previous bucket, the first one to 0.
+	NegativeSpans  []PrometheusBucketSpan
+	NegativeDeltas []int64
+	PositiveSpans  []PrometheusBucketSpan
+	PositiveDeltas []int64
+	// Timestamp is in milliseconds since the epoch, left to the caller.
+	Timestamp int64
+}
+
+// PrometheusBucketSpan is a run of Length consecutive buckets, starting Offset buckets after the end
+// of the previous span, or at the bucket of index Offset for the first span.
+type PrometheusBucketSpan struct {
+	Offset int32
+	Length uint32
+}
+
+// ToPrometheusNativeHistogram converts the buckets to a Prometheus native histogram, starting from
+// schema OTelNativeScale. See ToOTelExponentialHistogram for how the LP buckets are mapped.
+// Gaps of up to 2 empty buckets are spanned over with zero counts, which takes fewer bytes than new spans.
+func ToPrometheusNativeHistogram(buckets Buckets, cfg PrometheusNativeCfg) PrometheusNativeHistogram {
+	mustCheckPrometheusNativeCfg(cfg)
+	e := newExponentialHistogram(buckets)
+	h := PrometheusNativeHistogram{
+		Count:         e.count,
+		Sum:           e.sum,
+		Schema:        OTelNativeScale,
+		ZeroThreshold: e.zeroThreshold,
+		ZeroCount:     e.zeroCount,
+	}
+	for cfg.MaxBuckets != 0 && h.Schema > prometheusMinSchema &&
+		len(e.positive.counts)+len(e.negative.counts) > cfg.MaxBuckets {
+		e.positive.downscale()
+		e.negative.downscale()
+		h.Schema--
+	}
+	h.NegativeSpans, h.NegativeDeltas = e.negative.spans()
+	h.PositiveSpans, h.PositiveDeltas = e.positive.spans()
+	return h
+}
+
+// spans encodes the buckets the way Prometheus native histograms do.
+func (x *exponentialIndexes) spans() ([]PrometheusBucketSpan, []int64) {
+	indexes := make([]int, 0, len(x.counts))
+	for index := range x.counts {
+		indexes = append(indexes, int(index))
+	}
+	sort.Ints(indexes)
+
+	var spans []PrometheusBucketSpan
+	var deltas []int64
+	var prevCount int64
+	for i, index := range indexes {
+		gap := 0
+		if i > 0 {
+			gap = index - indexes[i-1] - 1
+		}
+		switch {
+		case i == 0:
+			spans = append(spans, PrometheusBucketSpan{Offset: int32(index) + 1, Length: 1})
+		case gap <= 2:
+			for ; gap > 0; gap-- {
+				deltas = append(deltas, -prevCount)
+				prevCount = 0
+			}
+			spans[len(spans)-1].Length += uint32(index - indexes[i-1])
+		default:
+			spans = append(spans, PrometheusBucketSpan{Offset: int32(gap), Length: 1})
+		}
+		count := int64(x.counts[int32(index)])
+		deltas = append(deltas, count-prevCount)
+		prevCount = count
+	}
+	return spans, deltas
+}
+
+// PrometheusSeries is a time series of Prometheus remote write.
+type PrometheusSeries struct {
+	// Labels name the series, the metric name being the __name__ label.
+	Labels     map[string]string
+	Histograms []PrometheusNativeHistogram
+}
+
+// MarshalPrometheusWriteRequest encodes series as the protobuf WriteRequest of Prometheus remote write 1.0.
+func MarshalPrometheusWriteRequest(series []PrometheusSeries) []byte {
+	var req protoEncoder
+	for i := range series {
+		req.message(1, func(ts *protoEncoder) {
+			names := make([]string, 0, len(series[i].Labels))
+			for name := range series[i].Labels {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				ts.message(1, func(label *protoEncoder) {
+					label.bytes(1, []byte(name))
+					label.bytes(2, []byte(series[i].Labels[name]))
+				})
+			}
+			for j := range series[i].Histograms {
+				ts.message(4, series[i].Histograms[j].marshalProtobuf)
+			}
+		})
+	}
+	return req.buf
+}
+
+func (h *PrometheusNativeHistogram) marshalProtobuf(e *protoEncoder) {
+	e.uvarint(1, h.Count)
+	e.double(3, h.Sum)
+	e.uvarint(4, zigzag(int64(h.Schema)))
+	e.double(5, h.ZeroThreshold)
+	e.uvarint(6, h.ZeroCount)
+	for _, span := range h.NegativeSpans {
+		e.message(8, span.marshalProtobuf)
+	}
+	e.packedSint64(9, h.NegativeDeltas)
+	for _, span := range h.PositiveSpans {
+		e.message(11, span.marshalProtobuf)
+	}
+	e.packedSint64(12, h.PositiveDeltas)
+	e.uvarint(15, uint64(h.Timestamp))
+}
+
+func (s PrometheusBucketSpan) marshalProtobuf(e *protoEncoder) {
+	e.uvarint(1, zigzag(int64(s.Offset)))
+	e.uvarint(2, uint64(s.Length))
+}
+
+// PushPrometheusWriteRequest sends series to a Prometheus remote write 1.0 endpoint such as
+// /api/v1/write, with http.DefaultClient if client is nil.
+func PushPrometheusWriteRequest(ctx context.Context, client *http.Client, url string, series []PrometheusSeries) error {
+	body := snappyEncode(MarshalPrometheusWriteRequest(series))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("push to %s: %s: %s", url, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// protoEncoder writes protobuf fields, leaving out the ones of zero value as proto3 does.
+type protoEncoder struct {
+	buf []byte
+}
+
+func (e *protoEncoder) tag(field, wireType int) {
+	e.rawUvarint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (e *protoEncoder) rawUvarint(v uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], v)
+	e.buf = append(e.buf, scratch[:n]...)
+}
+
+func (e *protoEncoder) uvarint(field int, v uint64) {
+	if v != 0 {
+		e.tag(field, 0)
+		e.rawUvarint(v)
+	}
+}
+
+func (e *protoEncoder) double(field int, f float64) {
+	if f != 0 || math.Signbit(f) {
+		e.tag(field, 1)
+		var scratch [8]byte
+		binary.LittleEndian.PutUint64(scratch[:], math.Float64bits(f))
+		e.buf = append(e.buf, scratch[:]...)
+	}
+}
+
+func (e *protoEncoder) bytes(field int, b []byte) {
+	e.tag(field, 2)
+	e.rawUvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *protoEncoder) message(field int, encode func(*protoEncoder)) {
+	var m protoEncoder
+	encode(&m)
+	e.bytes(field, m.buf)
+}
+
+func (e *protoEncoder) packedSint64(field int, values []int64) {
+	if len(values) == 0 {
+		return
+	}
+	var packed protoEncoder
+	for _, v := range values {
+		packed.rawUvarint(zigzag(v))
+	}
+	e.bytes(field, packed.buf)
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+// snappyEncode frames data in the snappy block format without compressing it: the uncompressed
+// length followed by literals, which any snappy decoder accepts. Histograms hardly repeat themselves.
+func snappyEncode(data []byte) []byte {
+	var buf []byte
+	var scratch [binary.MaxVarintLen64]byte
+	buf = append(buf, scratch[:binary.PutUvarint(scratch[:], uint64(len(data)))]...)
+	for len(data) > 0 {
+		n := len(data)
+		if n > 1<<16 {
+			n = 1 << 16
+		}
+		if n <= 60 {
+			buf = append(buf, byte(n-1)<<2)
+		} else {
+			// tag 61: the length - 1 follows in 2 bytes
+			buf = append(buf, 61<<2, byte(n-1), byte((n-1)>>8))
+		}
+		buf = append(buf, data[:n]...)
+		data = data[n:]
+	}
+	return buf
+}
@@ -0,0 +1,196 @@
+package lpfloat
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// SplitMode tells how Rebucket counts an LP bucket which straddles boundaries.
+type SplitMode int
+
+const (
+	// SplitLower counts the whole bucket in the lowest interval it overlaps.
+	SplitLower SplitMode = iota
+	// SplitProportional splits the bucket between the intervals it overlaps in proportion to the overlaps,
+	// as if its observations were evenly spread.
+	SplitProportional
+	// SplitBounds reports the range each interval count can be in, see FixedBucket.MinCount,
+	// besides the proportional estimate.
+	SplitBounds
+)
+
+// RebucketCfg configures Rebucket.
+type RebucketCfg struct {
+	// Boundaries are the upper bounds of the intervals, ascending and finite, +Inf being implicit.
+	// An interval holds the values above the previous boundary up to its own, as Prometheus le does.
+	Boundaries []float64
+	Split      SplitMode
+}
+
+func CheckRebucketCfg(cfg RebucketCfg) error {
+	for i, boundary := range cfg.Boundaries {
+		if math.IsNaN(boundary) || math.IsInf(boundary, 0) || i > 0 && boundary <= cfg.Boundaries[i-1] {
+			return errors.New("the boundaries should be ascending finite numbers")
+		}
+	}
+	if cfg.Split < SplitLower || cfg.Split > SplitBounds {
+		return errors.New("unknown split mode")
+	}
+	return nil
+}
+
+func mustCheckRebucketCfg(cfg RebucketCfg) {
+	if err := CheckRebucketCfg(cfg); err != nil {
+		panic(fmt.Errorf("invalid rebucket cfg %+v: %s", cfg, err))
+	}
+}
+
+// FixedBucket is the count of an interval of Rebucket.
+type FixedBucket struct {
+	// UpperBound is the boundary closing the interval, +Inf for the last one.
+	UpperBound float64
+	// Count is a whole number with SplitLower, an estimate with the other modes.
+	Count float64
+	// MinCount and MaxCount are only set with SplitBounds: the interval holds at least the observations
+	// of the LP buckets it wholly covers and at most those of the LP buckets it overlaps.
+	MinCount uint64
+	MaxCount uint64
+}
+
+// Rebucket counts the observations of the buckets in the intervals between cfg.Boundaries.
+//
+// The observations collapsed by BucketsCfg.MaxLayers count at Summary.Min for the underflow and
+// Summary.Max for the overflow, while their bounds span all the values between there and the layers.
+// NaNs are left out, infinities count in the first and last intervals. SyncBuckets are rebucketed from a snapshot.
+func Rebucket(buckets Buckets, cfg RebucketCfg) []FixedBucket {
+	mustCheckRebucketCfg(cfg)
+	if snapshotter, ok := buckets.(interface{ Snapshot() *UnSyncBuckets }); ok {
+		buckets = snapshotter.Snapshot()
+	}
+	r := rebucketer{cfg: cfg, fixed: make([]FixedBucket, len(cfg.Boundaries)+1)}
+	for i := range r.fixed {
+		r.fixed[i].UpperBound = math.Inf(1)
+		if i < len(cfg.Boundaries) {
+			r.fixed[i].UpperBound = cfg.Boundaries[i]
+		}
+	}
+
+	bucketsCfg := bucketsCfgOf(buckets)
+	summary := buckets.Summary([]float32{})
+	var layers []valueRange
+	buckets.Range(func(bucket Bucket) {
+		if !math.IsNaN(bucket.Value.ToFloat64()) {
+			layers = append(layers, bucketsCfg.bucketRange(bucket.Value).withCount(bucket.Count))
+		}
+	})
+	if summary.Underflow != 0 {
+		// the underflow is somewhere from the bucket of Summary.Min up to the layers
+		bounds := valueRange{lo: bucketsCfg.bucketRange(summary.Min).lo}
+		bounds.hi = bucketsCfg.bucketRange(summary.Max).hi
+		if len(layers) > 0 {
+			bounds.hi = layers[0].lo
+		}
+		r.add(pointRange(summary.Min.ToFloat64()).withCount(summary.Underflow), bounds)
+	}
+	for _, layer := range layers {
+		r.add(layer, layer)
+	}
+	if summary.Overflow != 0 {
+		bounds := valueRange{hi: bucketsCfg.bucketRange(summary.Max).hi}
+		bounds.lo = bucketsCfg.bucketRange(summary.Min).lo
+		if len(layers) > 0 {
+			bounds.lo = layers[len(layers)-1].hi
+		}
+		r.add(pointRange(summary.Max.ToFloat64()).withCount(summary.Overflow), bounds)
+	}
+	r.add(pointRange(math.Inf(-1)).withCount(summary.NegInf), pointRange(math.Inf(-1)))
+	r.add(pointRange(math.Inf(1)).withCount(summary.PosInf), pointRange(math.Inf(1)))
+	return r.fixed
+}
+
+// valueRange holds count observations between lo and hi, which are excluded if loOpen or hiOpen.
+type valueRange struct {
+	lo, hi         float64
+	loOpen, hiOpen bool
+	count          uint64
+}
+
+func pointRange(f float64) valueRange {
+	return valueRange{lo: f, hi: f}
+}
+
+func (r valueRange) withCount(count uint64) valueRange {
+	r.count = count
+	return r
+}
+
+// bucketRange returns the values an LP bucket holds: values are truncated toward 0, so a positive
+// bucket holds values from its own up to the next bucket value and a negative one the other way around.
+func (cfg *BucketsCfg) bucketRange(lpf LPFloat) valueRange {
+	f := lpf.ToFloat64()
+	switch {
+	case f == 0 && cfg.ZeroThreshold > 0:
+		return valueRange{lo: -cfg.ZeroThreshold, hi: cfg.ZeroThreshold, loOpen: true, hiOpen: true}
+	case f == 0 || math.IsInf(f, 0):
+		return pointRange(f)
+	case f > 0:
+		return valueRange{lo: f, hi: cfg.bucketUpperBound(lpf), hiOpen: true}
+	default:
+		return valueRange{lo: math.Float64frombits(math.Float64bits(f) + cfg.bucketStep()), hi: f, loOpen: true}
+	}
+}
+
+type rebucketer struct {
+	cfg   RebucketCfg
+	fixed []FixedBucket
+}
+
+// interval returns the index of the interval holding f, or of the one holding the values just above it.
+func (r *rebucketer) interval(f float64, above bool) int {
+	return sort.Search(len(r.cfg.Boundaries), func(i int) bool {
+		return r.cfg.Boundaries[i] > f || !above && r.cfg.Boundaries[i] == f
+	})
+}
+
+// add counts the observations of counted, whose values are somewhere in bounds.
+func (r *rebucketer) add(counted, bounds valueRange) {
+	if counted.count == 0 {
+		return
+	}
+	first := r.interval(counted.lo, counted.loOpen)
+	switch {
+	case r.cfg.Split == SplitLower || counted.lo == counted.hi:
+		r.fixed[first].Count += float64(counted.count)
+	default:
+		width := counted.hi - counted.lo
+		for i := first; i < len(r.fixed); i++ {
+			lo, hi := counted.lo, counted.hi
+			if i > 0 && r.fixed[i-1].UpperBound > lo {
+				lo = r.fixed[i-1].UpperBound
+			}
+			if r.fixed[i].UpperBound < hi {
+				hi = r.fixed[i].UpperBound
+			}
+			if lo >= counted.hi {
+				break
+			}
+			r.fixed[i].Count += float64(counted.count) * (hi - lo) / width
+		}
+	}
+	if r.cfg.Split != SplitBounds {
+		return
+	}
+	first, last := r.interval(bounds.lo, bounds.loOpen), r.interval(bounds.hi, false)
+	if bounds.hiOpen && last > 0 && r.fixed[last-1].UpperBound >= math.Nextafter(bounds.hi, math.Inf(-1)) {
+		// the values up to the boundary below hi are all in the interval below
+		last--
+	}
+	if first == last {
+		r.fixed[first].MinCount += counted.count
+	}
+	for i := first; i <= last; i++ {
+		r.fixed[i].MaxCount += counted.count
+	}
+}
@@ -0,0 +1,286 @@
+package lpfloat
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Scale returns a copy of the buckets with all values multiplied by factor, a positive finite number,
+// e.g. 1e-6 to turn nanoseconds into milliseconds. BucketsCfg.ZeroThreshold is scaled along.
+//
+// Powers of 2 shift the exponents of the buckets, which is exact as long as the values stay normal.
+// Other factors re-bucket: the observations of a bucket are split between the buckets its scaled range
+// overlaps in proportion to the overlaps, as if they were evenly spread, so no bucket boundary is
+// smeared the way inserting the scaled bucket values would. Totals are kept exactly, sums and moments
+// are scaled, up to a rounding, and split between the layers along with the observations.
+func (b *UnSyncBuckets) Scale(factor float64) *UnSyncBuckets {
+	s := newScaler(&b.cfg, factor)
+	for i := range b.layers {
+		layer := &b.layers[i]
+		for fraction, count := range layer.buckets {
+			if count != 0 || layer.extra.get(uint8(fraction)) != 0 {
+				s.addBucket(compose(layer.signAndExp, uint8(fraction)), count, layer.extra.get(uint8(fraction)))
+			}
+		}
+		s.addStats(&layer.layerStats)
+	}
+
+	d := &UnSyncBuckets{
+		cfg:       s.cfg,
+		collapsed: s.scaleCollapsed(&b.collapsed),
+		nonFinite: b.nonFinite,
+		weighted:  b.weighted,
+		clamped:   b.clamped,
+	}
+	for i, signAndExp := range s.order() {
+		scaled := s.layers[signAndExp]
+		layer := f64BucketsLayer{layerStats: scaled.stats, signAndExp: signAndExp, buckets: scaled.buckets, extra: scaled.extra}
+		layer.count = 0
+		for _, count := range layer.buckets {
+			layer.count = d.cfg.addTotal(layer.count, count)
+		}
+		d.layers = append(d.layers, layer)
+		d.index.set(signAndExp, i)
+	}
+	// a layer can spread over two, evict the extra ones as inserts would
+	for d.cfg.MaxLayers != 0 && len(d.layers) > d.cfg.MaxLayers {
+		lowest, highest := &d.layers[0], &d.layers[len(d.layers)-1]
+		if lowest.count <= highest.count {
+			min, max := lowest.valueRange()
+			d.collapsed.underflow.addLayer(&lowest.layerStats, lowest.extra.sum(), min, max)
+			d.layers = removeLayer(d.layers, &d.index, 0)
+		} else {
+			min, max := highest.valueRange()
+			d.collapsed.overflow.addLayer(&highest.layerStats, highest.extra.sum(), min, max)
+			d.layers = removeLayer(d.layers, &d.index, len(d.layers)-1)
+		}
+	}
+	return d
+}
+
+// Scale returns a scaled copy of a snapshot of the buckets, see UnSyncBuckets.Scale.
+func (b *SyncBuckets) Scale(factor float64) *SyncBuckets {
+	d := NewSyncBuckets(b.cfg)
+	d.replace(b.Snapshot().Scale(factor))
+	return d
+}
+
+// Scale returns a scaled copy of the buckets, see UnSyncBuckets.Scale.
+// The layers spreading over two are kept whatever BucketsCfg.MaxLayers, as SparseBuckets don't evict layers.
+func (b *SparseBuckets) Scale(factor float64) *SparseBuckets {
+	s := newScaler(&b.cfg, factor)
+	for i := range b.layers {
+		layer := &b.layers[i]
+		for j := 0; j < layer.len(); j++ {
+			if bucket := layer.bucketAt(j); bucket.Count != 0 {
+				s.addBucket(bucket.Value, bucket.Count, 0)
+			}
+		}
+		s.addStats(&layer.layerStats)
+	}
+
+	d := &SparseBuckets{
+		cfg:       s.cfg,
+		collapsed: s.scaleCollapsed(&b.collapsed),
+		nonFinite: b.nonFinite,
+		clamped:   b.clamped,
+	}
+	for _, signAndExp := range s.order() {
+		scaled := s.layers[signAndExp]
+		layer := sparseLayer{layerStats: scaled.stats, signAndExp: signAndExp}
+		layer.count = 0
+		for fraction, count := range scaled.buckets {
+			if count != 0 {
+				layer.addBucket(uint8(fraction), count)
+				layer.count = d.cfg.addTotal(layer.count, count)
+			}
+		}
+		d.layers = append(d.layers, layer)
+	}
+	return d
+}
+
+// scaler accumulates the scaled layers of buckets.
+type scaler struct {
+	src    *BucketsCfg
+	cfg    BucketsCfg // of the scaled buckets
+	factor float64
+	shift  int // the power of 2 of factor, if it is one
+	exact  bool
+	layers map[int16]*scaledLayer
+	moved  []movedShare // of the layer being scaled
+}
+
+// movedShare is what the buckets of a layer moved to a scaled layer.
+type movedShare struct {
+	signAndExp int16
+	count      uint64
+	weight     float64
+}
+
+type scaledLayer struct {
+	stats   layerStats
+	buckets [256]uint64
+	extra   *extraWeights
+}
+
+func newScaler(cfg *BucketsCfg, factor float64) *scaler {
+	if !(factor > 0) || math.IsInf(factor, 1) {
+		panic(fmt.Errorf("invalid scale factor %g: the factor should be a positive finite number", factor))
+	}
+	s := &scaler{src: cfg, cfg: *cfg, factor: factor, layers: make(map[int16]*scaledLayer)}
+	s.cfg.ZeroThreshold *= factor
+	frac, exp := math.Frexp(factor)
+	s.shift, s.exact = exp-1, frac == 0.5
+	return s
+}
+
+// shifted returns the layer of signAndExp shifted by the power of 2 of the factor,
+// ok is false if the factor isn't one or the layer isn't normal before and after.
+func (s *scaler) shifted(signAndExp int16) (shifted int16, ok bool) {
+	exp := int(uint16(signAndExp)>>4) & 0x7ff
+	if !s.exact || exp == 0 || exp == 0x7ff || exp+s.shift <= 0 || exp+s.shift >= 0x7ff {
+		return 0, false
+	}
+	return signAndExp + int16(s.shift<<4), true
+}
+
+func (s *scaler) layer(signAndExp int16, pivot float64) *scaledLayer {
+	layer := s.layers[signAndExp]
+	if layer == nil {
+		layer = &scaledLayer{stats: makeLayerStats(pivot)}
+		s.layers[signAndExp] = layer
+	}
+	return layer
+}
+
+// addStats scales the statistics of a layer once its buckets are added, splitting them between the
+// scaled layers its buckets moved to in proportion to the weights moved, so the statistics of each
+// scaled layer match its counts.
+func (s *scaler) addStats(stats *layerStats) {
+	var weight float64
+	for _, moved := range s.moved {
+		weight += moved.weight
+	}
+	for _, moved := range s.moved {
+		share := moved.weight / weight
+		part := layerStats{
+			count:   moved.count,
+			sum:     stats.sum * s.factor * share,
+			sumComp: stats.sumComp * s.factor * share,
+			moments: layerMoments{pivot: stats.moments.pivot * s.factor},
+		}
+		power := s.factor
+		for i := range stats.moments.s {
+			part.moments.s[i] = stats.moments.s[i] * power * share
+			power *= s.factor
+		}
+		target := &s.layers[moved.signAndExp].stats
+		part.moments = part.moments.rebase(target.moments.pivot, moved.weight)
+		target.merge(&part)
+	}
+	s.moved = s.moved[:0]
+}
+
+// addBucket splits the observations of a bucket between the scaled buckets.
+func (s *scaler) addBucket(lpf LPFloat, count uint64, extra float64) {
+	if shifted, ok := s.shifted(lpf.SignAndExp); ok {
+		s.add(compose(shifted, lpf.Fraction), count, extra)
+		return
+	}
+	f := lpf.ToFloat64()
+	if f == 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+		// the zero bucket scales along with the zero threshold
+		s.add(lpf, count, extra)
+		return
+	}
+	r := s.src.bucketRange(lpf)
+	lo, hi := r.lo*s.factor, r.hi*s.factor
+	if width := hi - lo; !(width > 0) || math.IsInf(width, 1) {
+		// the range overflowed or underflowed
+		s.add(s.cfg.lpFloat(f*s.factor), count, extra)
+		return
+	}
+	assigned, overlapped := uint64(0), 0.0
+	for target := s.cfg.lpFloat(lo); ; {
+		t := s.cfg.bucketRange(target)
+		last := t.hi >= hi
+		overlap := math.Min(t.hi, hi) - math.Max(t.lo, lo)
+		overlapped += overlap
+		share := count - assigned
+		if rounded := uint64(math.Round(float64(count) * overlapped / (hi - lo))); !last && rounded < assigned+share {
+			share = 0
+			if rounded > assigned {
+				share = rounded - assigned
+			}
+		}
+		s.add(target, share, extra*overlap/(hi-lo))
+		assigned += share
+		if last {
+			return
+		}
+		if t.hiOpen {
+			target = s.cfg.lpFloat(t.hi)
+		} else {
+			target = s.cfg.lpFloat(math.Nextafter(t.hi, math.Inf(1)))
+		}
+	}
+}
+
+func (s *scaler) add(lpf LPFloat, count uint64, extra float64) {
+	if count == 0 && extra == 0 {
+		return
+	}
+	layer := s.layer(lpf.SignAndExp, lpf.ToFloat64())
+	layer.buckets[lpf.Fraction] = s.cfg.addTotal(layer.buckets[lpf.Fraction], count)
+	s.move(lpf.SignAndExp, count, float64(count)+extra)
+	if extra != 0 {
+		if layer.extra == nil {
+			layer.extra = new(extraWeights)
+		}
+		layer.extra[lpf.Fraction] += extra
+	}
+}
+
+func (s *scaler) move(signAndExp int16, count uint64, weight float64) {
+	for i := range s.moved {
+		if s.moved[i].signAndExp == signAndExp {
+			s.moved[i].count += count
+			s.moved[i].weight += weight
+			return
+		}
+	}
+	s.moved = append(s.moved, movedShare{signAndExp: signAndExp, count: count, weight: weight})
+}
+
+func (s *scaler) scaleCollapsed(c *collapsedBuckets) collapsedBuckets {
+	scaled := *c
+	for _, bucket := range []*collapsedBucket{&scaled.underflow, &scaled.overflow} {
+		if bucket.count == 0 {
+			continue
+		}
+		f := s.factor
+		bucket.sum.sum *= f
+		bucket.sum.comp *= f
+		bucket.moments.mean *= f
+		bucket.moments.m2 *= f * f
+		bucket.moments.m3 *= f * f * f
+		bucket.moments.m4 *= f * f * f * f
+		bucket.min *= f
+		bucket.max *= f
+	}
+	return scaled
+}
+
+// order returns the scaled layers in value order.
+func (s *scaler) order() []int16 {
+	order := make([]int16, 0, len(s.layers))
+	for signAndExp := range s.layers {
+		order = append(order, signAndExp)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return layerRank(order[i]) < layerRank(order[j])
+	})
+	return order
+}
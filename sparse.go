@@ -0,0 +1,461 @@
+package lpfloat
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// SparseBuckets is an UnSyncBuckets alternative for keeping many histograms in memory.
+// It only stores the populated buckets of each layer, with counters as narrow as their values
+// allow, and finds layers by binary search instead of an index. It implements Buckets and the
+// optional interfaces of buckets.go, but holds no weights, so it has no InsertWeighted, and has
+// no binary encoding: it round-trips through JSON, see MarshalJSON.
+type SparseBuckets struct {
+	cfg       BucketsCfg
+	layers    []sparseLayer // ordered by value
+	collapsed collapsedBuckets
+	nonFinite nonFiniteCounts
+	clamped   bool // set when BucketsCfg.CountOverflow dropped observations
+}
+
+func NewSparseBuckets(cfg BucketsCfg) *SparseBuckets {
+	mustCheckBucketsCfg(cfg)
+	return &SparseBuckets{cfg: cfg}
+}
+
+type sparseLayer struct {
+	layerStats
+	signAndExp int16
+	// fractions of the populated buckets in ascending order, counts are parallel to them.
+	// Once the layer gets too crowded for that to save memory it turns dense:
+	// fractions is dropped and counts holds all the 256 buckets.
+	fractions []uint8
+	dense     bool
+	counts    counters
+}
+
+func (l *sparseLayer) search(fraction uint8) int {
+	lo, hi := 0, len(l.fractions)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if l.fractions[mid] < fraction {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+func (l *sparseLayer) addBucket(fraction uint8, count uint64) {
+	if l.dense {
+		l.counts.set(int(fraction), l.counts.get(int(fraction))+count)
+		return
+	}
+	i := l.search(fraction)
+	if i < len(l.fractions) && l.fractions[i] == fraction {
+		l.counts.set(i, l.counts.get(i)+count)
+		return
+	}
+	l.fractions = append(l.fractions, 0)
+	copy(l.fractions[i+1:], l.fractions[i:])
+	l.fractions[i] = fraction
+	l.counts.insert(i, count)
+	if width := l.counts.width; len(l.fractions)*(1+width) > 256*width {
+		l.densify()
+	}
+}
+
+// removeBucket reports whether the bucket of fraction held count observations to remove.
+func (l *sparseLayer) removeBucket(fraction uint8, count uint64) (held uint64, ok bool) {
+	i := int(fraction)
+	if !l.dense {
+		if i = l.search(fraction); i == len(l.fractions) || l.fractions[i] != fraction {
+			return 0, count == 0
+		}
+	}
+	if held = l.counts.get(i); held < count {
+		return held, false
+	}
+	l.counts.set(i, held-count)
+	return held, true
+}
+
+func (l *sparseLayer) densify() {
+	var dense counters
+	dense.widen(l.counts.width)
+	dense.data = make([]byte, 256*dense.width)
+	for i, fraction := range l.fractions {
+		dense.set(int(fraction), l.counts.get(i))
+	}
+	l.fractions = nil
+	l.dense = true
+	l.counts = dense
+}
+
+func (l *sparseLayer) bucketCount(fraction uint8) uint64 {
+	if l.dense {
+		return l.counts.get(int(fraction))
+	}
+	i := l.search(fraction)
+	if i < len(l.fractions) && l.fractions[i] == fraction {
+		return l.counts.get(i)
+	}
+	return 0
+}
+
+// valueRange returns the values of the lowest and the highest non-empty buckets.
+func (l *sparseLayer) valueRange() (min, max float64) {
+	for i := 0; i < l.len(); i++ {
+		if bucket := l.bucketAt(i); bucket.Count != 0 {
+			min = bucket.Value.ToFloat64()
+			break
+		}
+	}
+	for i := l.len() - 1; i >= 0; i-- {
+		if bucket := l.bucketAt(i); bucket.Count != 0 {
+			max = bucket.Value.ToFloat64()
+			break
+		}
+	}
+	return min, max
+}
+
+// len returns the number of buckets which bucketAt can access.
+func (l *sparseLayer) len() int {
+	return l.counts.len()
+}
+
+// bucketAt returns the i-th stored bucket in value order, it may be empty.
+func (l *sparseLayer) bucketAt(i int) Bucket {
+	if l.signAndExp < 0 {
+		i = l.len() - 1 - i
+	}
+	fraction := uint8(i)
+	if !l.dense {
+		fraction = l.fractions[i]
+	}
+	return Bucket{Value: compose(l.signAndExp, fraction), Count: l.counts.get(i)}
+}
+
+func (b *SparseBuckets) search(signAndExp int16) int {
+	rank := layerRank(signAndExp)
+	lo, hi := 0, len(b.layers)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if layerRank(b.layers[mid].signAndExp) < rank {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+func (b *SparseBuckets) layer(signAndExp int16) *sparseLayer {
+	i := b.search(signAndExp)
+	if i < len(b.layers) && b.layers[i].signAndExp == signAndExp {
+		return &b.layers[i]
+	}
+	return nil
+}
+
+func (b *SparseBuckets) Insert(f float64) {
+	b.InsertN(f, 1)
+}
+
+func (b *SparseBuckets) InsertN(f float64, count uint64) {
+	_ = b.InsertNE(f, count)
+}
+
+func (b *SparseBuckets) InsertNE(f float64, count uint64) error {
+	if b.cfg.nonFinite(f) {
+		counter := b.nonFinite.counter(f)
+		fit, overflow := b.cfg.fitCount(*counter, count)
+		*counter += fit
+		return b.overflowed(f, count, overflow)
+	}
+	lpf := b.cfg.lpFloat(f)
+	i := b.search(lpf.SignAndExp)
+	if i == len(b.layers) || b.layers[i].signAndExp != lpf.SignAndExp {
+		// cold path
+		if c := b.collapse(lpf); c != nil {
+			fit, overflow := b.cfg.fitCount(c.count, count)
+			if fit != 0 {
+				c.add(f, fit, float64(fit))
+			}
+			return b.overflowed(f, count, overflow)
+		}
+		i = b.search(lpf.SignAndExp)
+		b.layers = append(b.layers, sparseLayer{})
+		copy(b.layers[i+1:], b.layers[i:])
+		b.layers[i] = sparseLayer{layerStats: makeLayerStats(f), signAndExp: lpf.SignAndExp}
+	}
+	layer := &b.layers[i]
+	fit, overflow := b.cfg.fitCounts(layer.bucketCount(lpf.Fraction), layer.count, count)
+	if fit != 0 {
+		layer.add(f, fit, b.cfg.CompensatedSum)
+		layer.addBucket(lpf.Fraction, fit)
+	}
+	return b.overflowed(f, count, overflow)
+}
+
+func (b *SparseBuckets) overflowed(f float64, count uint64, overflow bool) error {
+	if !overflow {
+		return nil
+	}
+	b.clamped = b.clamped || b.cfg.clamps()
+	return b.cfg.overflowed(f, count)
+}
+
+func (b *SparseBuckets) Remove(f float64) error {
+	return b.RemoveN(f, 1)
+}
+
+func (b *SparseBuckets) RemoveN(f float64, count uint64) error {
+	if b.cfg.nonFinite(f) {
+		return b.nonFinite.remove(f, count)
+	}
+	lpf := b.cfg.lpFloat(f)
+	i := b.search(lpf.SignAndExp)
+	if i == len(b.layers) || b.layers[i].signAndExp != lpf.SignAndExp {
+		return b.collapsed.remove(f, lpf, count)
+	}
+	layer := &b.layers[i]
+	if held, ok := layer.removeBucket(lpf.Fraction, count); !ok {
+		return countUnderflowError(f, count, held)
+	}
+	layer.remove(f, count, float64(count), b.cfg.CompensatedSum)
+	return nil
+}
+
+// collapse applies BucketsCfg.MaxLayers before adding the layer of lpf,
+// it returns the underflow or overflow bucket if the value has to be collapsed into it.
+func (b *SparseBuckets) collapse(lpf LPFloat) *collapsedBucket {
+	if b.cfg.MaxLayers == 0 || len(b.layers) < b.cfg.MaxLayers {
+		return nil
+	}
+	if b.collapsed.admits(lpf.SignAndExp) {
+		// empty layers, e.g. kept by Reset, make room first
+		for i := range b.layers {
+			if b.layers[i].count == 0 {
+				b.removeLayer(i)
+				return nil
+			}
+		}
+	}
+	lowest, highest := &b.layers[0], &b.layers[len(b.layers)-1]
+	switch decideCollapse(lpf.SignAndExp, lowest.signAndExp, highest.signAndExp, lowest.count, highest.count) {
+	case collapseUnderflow:
+		return &b.collapsed.underflow
+	case collapseOverflow:
+		return &b.collapsed.overflow
+	case collapseEvictLowest:
+		min, max := lowest.valueRange()
+		b.collapsed.underflow.addLayer(&lowest.layerStats, 0, min, max)
+		b.removeLayer(0)
+	case collapseEvictHighest:
+		min, max := highest.valueRange()
+		b.collapsed.overflow.addLayer(&highest.layerStats, 0, min, max)
+		b.removeLayer(len(b.layers) - 1)
+	}
+	return nil
+}
+
+// unSync returns a copy of the buckets as UnSyncBuckets.
+func (b *SparseBuckets) unSync() *UnSyncBuckets {
+	u := &UnSyncBuckets{
+		cfg:       b.cfg,
+		layers:    make([]f64BucketsLayer, len(b.layers)),
+		collapsed: b.collapsed,
+		nonFinite: b.nonFinite,
+		clamped:   b.clamped,
+	}
+	for i := range b.layers {
+		src, dst := &b.layers[i], &u.layers[i]
+		dst.layerStats, dst.signAndExp = src.layerStats, src.signAndExp
+		for j := 0; j < src.len(); j++ {
+			bucket := src.bucketAt(j)
+			dst.buckets[bucket.Value.Fraction] = bucket.Count
+		}
+		u.index.set(dst.signAndExp, i)
+	}
+	return u
+}
+
+// sparseBucketsOf returns a copy of UnSyncBuckets as SparseBuckets, which fails on weighted observations.
+func sparseBucketsOf(u *UnSyncBuckets) (*SparseBuckets, error) {
+	if u.weighted || u.collapsed.underflow.extra != 0 || u.collapsed.overflow.extra != 0 {
+		return nil, errors.New("sparse buckets can't hold weighted observations")
+	}
+	b := &SparseBuckets{
+		cfg:       u.cfg,
+		layers:    make([]sparseLayer, len(u.layers)),
+		collapsed: u.collapsed,
+		nonFinite: u.nonFinite,
+		clamped:   u.clamped,
+	}
+	for i := range u.layers {
+		src, dst := &u.layers[i], &b.layers[i]
+		if src.extra != nil {
+			return nil, errors.New("sparse buckets can't hold weighted observations")
+		}
+		dst.layerStats, dst.signAndExp = src.layerStats, src.signAndExp
+		for fraction, count := range src.buckets {
+			if count != 0 {
+				dst.addBucket(uint8(fraction), count)
+			}
+		}
+	}
+	return b, nil
+}
+
+func (b *SparseBuckets) removeLayer(pos int) {
+	copy(b.layers[pos:], b.layers[pos+1:])
+	b.layers[len(b.layers)-1] = sparseLayer{} // releases the slices
+	b.layers = b.layers[:len(b.layers)-1]
+}
+
+func (b *SparseBuckets) Total() uint64 {
+	total := b.cfg.addTotal(b.collapsed.underflow.count, b.collapsed.overflow.count)
+	for i := range b.layers {
+		total = b.cfg.addTotal(total, b.layers[i].count)
+	}
+	return total
+}
+
+func (b *SparseBuckets) Sum() float64 {
+	sum := b.collapsed.sum()
+	for i := range b.layers {
+		sum.add(b.layers[i].sum)
+		sum.add(b.layers[i].sumComp)
+	}
+	return sum.value()
+}
+
+func (b *SparseBuckets) Count(f float64) uint64 {
+	if b.cfg.nonFinite(f) {
+		return *b.nonFinite.counter(f)
+	}
+	lpf := b.cfg.lpFloat(f)
+	if layer := b.layer(lpf.SignAndExp); layer != nil {
+		return layer.bucketCount(lpf.Fraction)
+	}
+	return 0
+}
+
+func (b *SparseBuckets) Range(do func(Bucket)) {
+	b.RangeWhile(func(bucket Bucket) bool {
+		do(bucket)
+		return true
+	})
+}
+
+func (b *SparseBuckets) ReverseRange(do func(Bucket)) {
+	b.ReverseRangeWhile(func(bucket Bucket) bool {
+		do(bucket)
+		return true
+	})
+}
+
+func (b *SparseBuckets) RangeWhile(do func(Bucket) bool) {
+	rangeWhile(b, false, do)
+}
+
+func (b *SparseBuckets) ReverseRangeWhile(do func(Bucket) bool) {
+	rangeWhile(b, true, do)
+}
+
+func (b *SparseBuckets) RangeBetween(lo, hi float64, do func(Bucket) bool) {
+	rangeBetween(b, b.cfg.lpFloat(lo), b.cfg.lpFloat(hi), do)
+}
+
+func (b *SparseBuckets) Iterator() *Iterator {
+	return &Iterator{cursor: newLayersCursor(b, false)}
+}
+
+func (b *SparseBuckets) ReverseIterator() *Iterator {
+	return &Iterator{cursor: newLayersCursor(b, true)}
+}
+
+func (b *SparseBuckets) layersLen() int {
+	return len(b.layers)
+}
+
+func (b *SparseBuckets) layerRankAt(layer int) int32 {
+	return layerRank(b.layers[layer].signAndExp)
+}
+
+func (b *SparseBuckets) layerLen(layer int) int {
+	return b.layers[layer].len()
+}
+
+func (b *SparseBuckets) bucketAt(layer, i int) Bucket {
+	return b.layers[layer].bucketAt(i)
+}
+
+func (b *SparseBuckets) Buckets() []Bucket {
+	var buckets []Bucket
+	b.Range(func(bucket Bucket) {
+		buckets = append(buckets, bucket)
+	})
+	return buckets
+}
+
+func (b *SparseBuckets) Summary(percentilesCfg []float32) Summary {
+	builder := newSummaryBuilder(percentilesCfg, b.Total())
+	builder.addUnderflow(&b.collapsed.underflow)
+	for i := range b.layers {
+		layer := &b.layers[i]
+		builder.addLayer(&layer.layerStats, 0)
+		for j := 0; j < layer.len(); j++ {
+			if bucket := layer.bucketAt(j); bucket.Count != 0 {
+				builder.addBucket(bucket.Value, bucket.Count)
+			}
+		}
+	}
+	builder.addOverflow(&b.collapsed.overflow)
+	builder.addNonFinite(&b.nonFinite)
+	builder.addClamped(b.clamped)
+	return builder.build()
+}
+
+func (b *SparseBuckets) Reset() {
+	b.ResetWith(ResetKeepLayers)
+}
+
+func (b *SparseBuckets) ResetWith(mode ResetMode) {
+	b.collapsed.reset()
+	b.nonFinite = nonFiniteCounts{}
+	b.clamped = false
+	if mode == ResetReleaseLayers {
+		b.layers = nil
+		return
+	}
+	for i := range b.layers {
+		layer := &b.layers[i]
+		layer.fractions = layer.fractions[:0]
+		layer.dense = false
+		layer.counts.reset()
+		layer.reset()
+	}
+}
+
+func (b *SparseBuckets) Compact() {
+	var layers []sparseLayer
+	for i := range b.layers {
+		if b.layers[i].count != 0 {
+			layers = append(layers, b.layers[i])
+		}
+	}
+	b.layers = layers
+}
+
+// MemoryUsage returns the approximate number of bytes held by the buckets.
+func (b *SparseBuckets) MemoryUsage() uint64 {
+	usage := uint64(unsafe.Sizeof(*b)) + uint64(cap(b.layers))*uint64(unsafe.Sizeof(sparseLayer{}))
+	for i := range b.layers {
+		usage += uint64(cap(b.layers[i].fractions) + cap(b.layers[i].counts.data))
+	}
+	return usage
+}
@@ -0,0 +1,30 @@
+package lpfloat
+
+import "math"
+
+// twoSumErr returns the rounding error of s = a + b, so that a + b == s + err exactly.
+func twoSumErr(a, b, s float64) float64 {
+	bb := s - a
+	err := (a - (s - bb)) + (b - bb)
+	if math.IsNaN(err) {
+		// infinities have no meaningful rounding error
+		return 0
+	}
+	return err
+}
+
+// neumaierSum is a compensated float64 accumulator.
+type neumaierSum struct {
+	sum  float64
+	comp float64
+}
+
+func (s *neumaierSum) add(f float64) {
+	t := s.sum + f
+	s.comp += twoSumErr(s.sum, f, t)
+	s.sum = t
+}
+
+func (s *neumaierSum) value() float64 {
+	return s.sum + s.comp
+}
@@ -1,17 +1,377 @@
 package lpfloat
 
 import (
-	"fmt"
 	"math"
+	"runtime"
 	"sort"
 	"sync"
 	"sync/atomic"
 	"unsafe"
 )
 
+// SyncBuckets is safe for concurrent use. Inserting into an existing layer is lock-free:
+// the layers live in a copy-on-write table behind an atomic pointer, and only adding or dropping
+// layers takes a lock to publish the new table.
 type SyncBuckets struct {
-	m      sync.RWMutex
-	layers []f64BucketsLayer
+	nonFinite nonFiniteCounts
+	m         sync.Mutex // serializes updates of the table
+	cfg       BucketsCfg
+	table     atomic.Value     // *syncLayerTable
+	collapsed collapsedBuckets // guarded by m
+	weighted  uint32           // atomic, set by InsertWeighted
+	clamped   uint32           // atomic, set when BucketsCfg.CountOverflow dropped observations
+}
+
+func NewSyncBuckets(cfg BucketsCfg) *SyncBuckets {
+	mustCheckBucketsCfg(cfg)
+	return &SyncBuckets{cfg: cfg}
+}
+
+// syncLayerTable is never modified once published, the layers are shared by the following tables.
+type syncLayerTable struct {
+	layers []*syncLayer // ordered by value
+	index  layerIndex
+}
+
+var emptySyncLayerTable = &syncLayerTable{}
+
+func makeSyncLayerTable(layers []*syncLayer) *syncLayerTable {
+	table := &syncLayerTable{layers: layers}
+	for i, layer := range layers {
+		table.index.set(layer.signAndExp, i)
+	}
+	return table
+}
+
+func (t *syncLayerTable) get(signAndExp int16) *syncLayer {
+	if i := t.index.get(signAndExp); i >= 0 {
+		return t.layers[i]
+	}
+	return nil
+}
+
+func (t *syncLayerTable) with(layer *syncLayer) *syncLayerTable {
+	rank := layerRank(layer.signAndExp)
+	pos := sort.Search(len(t.layers), func(i int) bool {
+		return layerRank(t.layers[i].signAndExp) > rank
+	})
+	layers := make([]*syncLayer, 0, len(t.layers)+1)
+	layers = append(layers, t.layers[:pos]...)
+	layers = append(layers, layer)
+	layers = append(layers, t.layers[pos:]...)
+	return makeSyncLayerTable(layers)
+}
+
+func (t *syncLayerTable) without(pos int) *syncLayerTable {
+	layers := make([]*syncLayer, 0, len(t.layers)-1)
+	layers = append(layers, t.layers[:pos]...)
+	layers = append(layers, t.layers[pos+1:]...)
+	return makeSyncLayerTable(layers)
+}
+
+// syncLayerStripes spreads the statistics of a layer over several cache lines,
+// so concurrent inserts don't fight over the same sum.
+const syncLayerStripes = 8
+
+// stripeHints holds the stripe each P starts locking at. The per-P caches of sync.Pool keep
+// handing a P the same hint, so inserts running on different Ps mostly lock different stripes.
+var (
+	stripeHints    = sync.Pool{New: newStripeHint}
+	stripeHintNext uint32 // atomic
+)
+
+func newStripeHint() interface{} {
+	hint := atomic.AddUint32(&stripeHintNext, 1) % syncLayerStripes
+	return &hint
+}
+
+type syncLayer struct {
+	stripes    [syncLayerStripes]syncLayerStripe
+	retired    uint32 // set once dropped from the table
+	signAndExp int16
+	buckets    [256]uint64
+	extra      unsafe.Pointer // *extraWeights, allocated by the first weighted insert
+}
+
+// syncLayerStripe holds a share of the statistics of a layer, updated without atomics under its lock.
+// The shares only add up: a stripe may even count fewer observations than were removed from it.
+type syncLayerStripe struct {
+	locked uint32
+	layerStats
+	_ [(64 - (unsafe.Sizeof(layerStats{})+8)%64) % 64]byte
+}
+
+// wait locks the stripe, yielding while an insert holds it.
+func (s *syncLayerStripe) wait() {
+	for !atomic.CompareAndSwapUint32(&s.locked, 0, 1) {
+		runtime.Gosched()
+	}
+}
+
+func (s *syncLayerStripe) unlock() {
+	atomic.StoreUint32(&s.locked, 0)
+}
+
+func newSyncLayer(signAndExp int16, pivot float64) *syncLayer {
+	layer := &syncLayer{signAndExp: signAndExp}
+	for i := range layer.stripes {
+		layer.stripes[i].layerStats = makeLayerStats(pivot)
+	}
+	return layer
+}
+
+// add adds count observations of f weighing weight altogether, which is count unless inserted weighted,
+// to the locked stripe and to the bucket of fraction.
+func (l *syncLayer) add(stripe *syncLayerStripe, f float64, fraction uint8, count uint64, weight float64, compensated bool) {
+	l.addCounted(stripe, f, fraction, count, weight, compensated)
+	atomic.AddUint64(&l.buckets[fraction], count)
+}
+
+// addChecked is add applying the BucketsCfg.CountOverflow policy to the counts of the layer and of
+// the bucket, it reports whether a count overflowed. The count of the layer, total, is loaded before
+// locking the stripe, the count of the bucket is checked exactly.
+func (l *syncLayer) addChecked(cfg *BucketsCfg, stripe *syncLayerStripe, total uint64, f float64, fraction uint8,
+	count uint64, weight float64) bool {
+	fit, overflow := cfg.fitCount(total, count)
+	if fit != 0 {
+		var bucketOverflow bool
+		fit, bucketOverflow = atomicFitAdd(cfg, &l.buckets[fraction], fit)
+		overflow = overflow || bucketOverflow
+	}
+	if fit != 0 {
+		l.addCounted(stripe, f, fraction, fit, fitWeight(weight, fit, count), cfg.CompensatedSum)
+	}
+	return overflow
+}
+
+// addCounted adds observations to the statistics of the locked stripe, the count of the bucket is left to the caller.
+func (l *syncLayer) addCounted(stripe *syncLayerStripe, f float64, fraction uint8, count uint64, weight float64,
+	compensated bool) {
+	stripe.addWeight(f, count, weight, compensated)
+	if extra := weight - float64(count); extra != 0 {
+		atomicAddFloat64(&l.loadExtra(true)[fraction], extra)
+	}
+}
+
+// loadExtra returns the extra weights of the layer, allocating them if alloc is set.
+func (l *syncLayer) loadExtra(alloc bool) *extraWeights {
+	extra := (*extraWeights)(atomic.LoadPointer(&l.extra))
+	if extra != nil || !alloc {
+		return extra
+	}
+	extra = new(extraWeights)
+	if atomic.CompareAndSwapPointer(&l.extra, nil, unsafe.Pointer(extra)) {
+		return extra
+	}
+	return (*extraWeights)(atomic.LoadPointer(&l.extra))
+}
+
+// copyExtra returns a copy of the extra weights, nil if there are none.
+func (l *syncLayer) copyExtra() *extraWeights {
+	extra := l.loadExtra(false)
+	if extra == nil {
+		return nil
+	}
+	copied := new(extraWeights)
+	for i := range extra {
+		copied[i] = atomicLoadFloat64(&extra[i])
+	}
+	return copied
+}
+
+// loadStats merges the stripes.
+func (l *syncLayer) loadStats() layerStats {
+	stats := makeLayerStats(l.stripes[0].moments.pivot)
+	for i := range l.stripes {
+		l.stripes[i].wait()
+		stripe := l.stripes[i].layerStats
+		l.stripes[i].unlock()
+		stats.count += stripe.count
+		stats.addSum(stripe.sum, true)
+		stats.addSum(stripe.sumComp, true)
+		stats.moments.merge(&stripe.moments)
+	}
+	return stats
+}
+
+// remove takes observations out of the locked stripe and of the bucket of fraction,
+// it fails without changing anything if the bucket holds fewer than count observations.
+func (l *syncLayer) remove(stripe *syncLayerStripe, f float64, fraction uint8, count uint64, compensated bool) error {
+	held, err := atomicSubUint64(&l.buckets[fraction], f, count)
+	if err != nil {
+		return err
+	}
+	weight := float64(count)
+	if extra := l.loadExtra(false); extra != nil {
+		// see extraWeights.take
+		if share := atomicLoadFloat64(&extra[fraction]) * float64(count) / float64(held); share != 0 {
+			atomicAddFloat64(&extra[fraction], -share)
+			weight += share
+		}
+	}
+	stripe.remove(f, count, weight, compensated)
+	return nil
+}
+
+// lock locks a stripe of the layer for an insert or a removal, starting at the hint of the current P
+// and trying the next stripes while they are busy. It fails once the layer has been dropped:
+// retire sets retired before taking every lock in turn, so either it waits for the insert
+// or the insert sees the layer retired.
+func (l *syncLayer) lock() (*syncLayerStripe, bool) {
+	hint := stripeHints.Get().(*uint32)
+	i := *hint
+	for tries := 1; !atomic.CompareAndSwapUint32(&l.stripes[i].locked, 0, 1); tries++ {
+		i = (i + 1) % syncLayerStripes
+		if tries%syncLayerStripes == 0 {
+			runtime.Gosched()
+		}
+	}
+	*hint = i
+	stripeHints.Put(hint)
+
+	stripe := &l.stripes[i]
+	if atomic.LoadUint32(&l.retired) != 0 {
+		stripe.unlock()
+		return nil, false
+	}
+	return stripe, true
+}
+
+// retire waits for the inserts in progress once the layer has been dropped from the table.
+func (l *syncLayer) retire() {
+	atomic.StoreUint32(&l.retired, 1)
+	for i := range l.stripes {
+		l.stripes[i].wait()
+		l.stripes[i].unlock()
+	}
+}
+
+// revive returns a live copy of a retired layer.
+func (l *syncLayer) revive() *syncLayer {
+	layer := &syncLayer{signAndExp: l.signAndExp, buckets: l.buckets, extra: l.extra}
+	for i := range layer.stripes {
+		layer.stripes[i].layerStats = l.stripes[i].layerStats
+	}
+	return layer
+}
+
+// loadCount sums the counts of the stripes, it must not be called holding one of them.
+func (l *syncLayer) loadCount() uint64 {
+	count := uint64(0)
+	for i := range l.stripes {
+		l.stripes[i].wait()
+		count += l.stripes[i].count
+		l.stripes[i].unlock()
+	}
+	return count
+}
+
+// valueRange returns the values of the lowest and the highest non-empty buckets.
+func (l *syncLayer) valueRange() (min, max float64) {
+	layer := f64BucketsLayer{signAndExp: l.signAndExp}
+	for i := range l.buckets {
+		layer.buckets[i] = atomic.LoadUint64(&l.buckets[i])
+	}
+	return layer.valueRange()
+}
+
+func (l *syncLayer) reset() {
+	for i := range l.stripes {
+		l.stripes[i].wait()
+		l.stripes[i].reset()
+		l.stripes[i].unlock()
+	}
+	for i := range l.buckets {
+		atomic.StoreUint64(&l.buckets[i], 0)
+	}
+	atomic.StorePointer(&l.extra, nil)
+}
+
+func (b *SyncBuckets) loadTable() *syncLayerTable {
+	if table, _ := b.table.Load().(*syncLayerTable); table != nil {
+		return table
+	}
+	return emptySyncLayerTable
+}
+
+// layer returns the layer of f, publishing a new table with it if it doesn't exist yet.
+// With BucketsCfg.MaxLayers, it returns nil if f has been collapsed into the underflow or overflow bucket,
+// along with whether the count of that bucket overflowed.
+func (b *SyncBuckets) layer(f float64, lpf LPFloat, count uint64, weight float64) (*syncLayer, bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	table := b.loadTable()
+	if layer := table.get(lpf.SignAndExp); layer != nil {
+		return layer, false
+	}
+
+	if b.cfg.MaxLayers > 0 && len(table.layers) >= b.cfg.MaxLayers {
+		table = b.dropEmpty(table, lpf.SignAndExp)
+	}
+	if layers := len(table.layers); b.cfg.MaxLayers > 0 && layers >= b.cfg.MaxLayers {
+		lowest, highest := table.layers[0], table.layers[layers-1]
+		switch decideCollapse(lpf.SignAndExp, lowest.signAndExp, highest.signAndExp,
+			lowest.loadCount(), highest.loadCount()) {
+		case collapseUnderflow:
+			return nil, b.collapse(&b.collapsed.underflow, f, count, weight)
+		case collapseOverflow:
+			return nil, b.collapse(&b.collapsed.overflow, f, count, weight)
+		case collapseEvictLowest:
+			table = b.evict(table, 0, &b.collapsed.underflow)
+		case collapseEvictHighest:
+			table = b.evict(table, layers-1, &b.collapsed.overflow)
+		}
+	}
+
+	layer := newSyncLayer(lpf.SignAndExp, f)
+	b.table.Store(table.with(layer))
+	return layer, false
+}
+
+// dropEmpty publishes a table without an empty layer, e.g. kept by Reset, to make room for the layer
+// signAndExp, see collapsedBuckets.admits. The layer is kept if an insert filled it meanwhile.
+func (b *SyncBuckets) dropEmpty(table *syncLayerTable, signAndExp int16) *syncLayerTable {
+	if !b.collapsed.admits(signAndExp) {
+		return table
+	}
+	for pos, layer := range table.layers {
+		if layer.loadCount() != 0 {
+			continue
+		}
+		dropped := table.without(pos)
+		b.table.Store(dropped)
+		layer.retire()
+		if layer.loadCount() == 0 {
+			return dropped
+		}
+		table = dropped.with(layer.revive())
+		b.table.Store(table)
+		return table
+	}
+	return table
+}
+
+// collapse adds f to c, it reports whether the count of c overflowed.
+func (b *SyncBuckets) collapse(c *collapsedBucket, f float64, count uint64, weight float64) bool {
+	fit, overflow := b.cfg.fitCount(c.count, count)
+	if fit != 0 {
+		c.add(f, fit, fitWeight(weight, fit, count))
+	}
+	return overflow
+}
+
+// evict publishes a table without the layer at pos, then collapses it into c once no insert uses it.
+func (b *SyncBuckets) evict(table *syncLayerTable, pos int, c *collapsedBucket) *syncLayerTable {
+	layer := table.layers[pos]
+	table = table.without(pos)
+	b.table.Store(table)
+	layer.retire()
+
+	stats := layer.loadStats()
+	min, max := layer.valueRange()
+	c.addLayer(&stats, layer.loadExtra(false).sum(), min, max)
+	return table
 }
 
 func (b *SyncBuckets) Insert(f float64) {
@@ -19,113 +379,195 @@ func (b *SyncBuckets) Insert(f float64) {
 }
 
 func (b *SyncBuckets) InsertN(f float64, count uint64) {
-	lpf := FromFloat64(f)
-	b.m.RLock()
-	for i := range b.layers {
-		layer := &b.layers[i]
-		if layer.signAndExp == lpf.SignAndExp {
-			atomic.AddUint64(&layer.count, count)
-			atomicAddFloat64(&layer.sum, f*float64(count))
-			atomic.AddUint64(&b.layers[i].buckets[lpf.Fraction], count)
-			b.m.RUnlock()
-			return
+	_ = b.insert(f, count, float64(count), b.cfg.CountOverflow != CountOverflowWrap)
+}
+
+func (b *SyncBuckets) InsertNE(f float64, count uint64) error {
+	return b.insert(f, count, float64(count), true)
+}
+
+// InsertWeighted inserts an observation of f weighing weight, see UnSyncBuckets.InsertWeighted.
+func (b *SyncBuckets) InsertWeighted(f, weight float64) {
+	mustCheckWeight(weight)
+	if atomic.LoadUint32(&b.weighted) == 0 {
+		atomic.StoreUint32(&b.weighted, 1)
+	}
+	_ = b.insert(f, 1, weight, b.cfg.CountOverflow != CountOverflowWrap)
+}
+
+// insert adds count observations of f weighing weight altogether,
+// checked tells whether to apply BucketsCfg.CountOverflow.
+func (b *SyncBuckets) insert(f float64, count uint64, weight float64, checked bool) error {
+	if b.cfg.nonFinite(f) {
+		if !checked {
+			b.nonFinite.atomicAdd(f, count)
+			return nil
+		}
+		_, overflow := atomicFitAdd(&b.cfg, b.nonFinite.counter(f), count)
+		return b.overflowed(f, count, overflow)
+	}
+	lpf := b.cfg.lpFloat(f)
+	// layers may be evicted or compacted concurrently
+	for {
+		layer := b.loadTable().get(lpf.SignAndExp)
+		if layer == nil {
+			// cold path
+			var overflow bool
+			if layer, overflow = b.layer(f, lpf, count, weight); layer == nil {
+				return b.overflowed(f, count, overflow)
+			}
+		}
+		var total uint64
+		if checked {
+			total = layer.loadCount()
+		}
+		if stripe, ok := layer.lock(); ok {
+			overflow := false
+			if checked {
+				overflow = layer.addChecked(&b.cfg, stripe, total, f, lpf.Fraction, count, weight)
+			} else {
+				layer.add(stripe, f, lpf.Fraction, count, weight, b.cfg.CompensatedSum)
+			}
+			stripe.unlock()
+			return b.overflowed(f, count, overflow)
+		}
+		// dropped meanwhile, retry with the new table
+	}
+}
+
+func (b *SyncBuckets) overflowed(f float64, count uint64, overflow bool) error {
+	if !overflow {
+		return nil
+	}
+	if b.cfg.clamps() {
+		atomic.StoreUint32(&b.clamped, 1)
+	}
+	return b.cfg.overflowed(f, count)
+}
+
+func (b *SyncBuckets) Remove(f float64) error {
+	return b.RemoveN(f, 1)
+}
+
+func (b *SyncBuckets) RemoveN(f float64, count uint64) error {
+	if b.cfg.nonFinite(f) {
+		return b.nonFinite.atomicRemove(f, count)
+	}
+	lpf := b.cfg.lpFloat(f)
+	for {
+		layer := b.loadTable().get(lpf.SignAndExp)
+		if layer == nil {
+			if done, err := b.removeCollapsed(f, lpf, count); done {
+				return err
+			}
+			continue
+		}
+		if stripe, ok := layer.lock(); ok {
+			err := layer.remove(stripe, f, lpf.Fraction, count, b.cfg.CompensatedSum)
+			stripe.unlock()
+			return err
 		}
+		// dropped meanwhile, retry with the new table
 	}
+}
 
-	// cold path
-	b.m.RUnlock()
+// removeCollapsed removes f from the underflow or overflow bucket,
+// it does nothing if f got a layer meanwhile.
+func (b *SyncBuckets) removeCollapsed(f float64, lpf LPFloat, count uint64) (done bool, err error) {
 	b.m.Lock()
-	for i := range b.layers {
-		layer := &b.layers[i]
-		if layer.signAndExp == lpf.SignAndExp {
-			atomic.AddUint64(&layer.count, count)
-			atomicAddFloat64(&layer.sum, f*float64(count))
-			atomic.AddUint64(&b.layers[i].buckets[lpf.Fraction], count)
-			b.m.Unlock()
-			return
-		}
-	}
-
-	newLayer := f64BucketsLayer{signAndExp: lpf.SignAndExp}
-	newLayer.buckets[lpf.Fraction] = count
-	newLayer.count = count
-	newLayer.sum = f * float64(count)
-	b.layers = append(b.layers, newLayer)
-	sort.Slice(b.layers, func(i, j int) bool {
-		return b.layers[i].unit() < b.layers[j].unit()
-	})
-	b.m.Unlock()
+	defer b.m.Unlock()
+
+	if b.loadTable().get(lpf.SignAndExp) != nil {
+		return false, nil
+	}
+	return true, b.collapsed.remove(f, lpf, count)
+}
+
+// load returns the table along with a copy of the underflow and overflow buckets consistent with it.
+func (b *SyncBuckets) load() (*syncLayerTable, collapsedBuckets) {
+	if b.cfg.MaxLayers == 0 {
+		return b.loadTable(), collapsedBuckets{}
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.loadTable(), b.collapsed
 }
 
 func (b *SyncBuckets) Total() uint64 {
-	total := uint64(0)
-	b.m.RLock()
-	for i := range b.layers {
-		total += atomic.LoadUint64(&b.layers[i].count)
+	table, collapsed := b.load()
+	total := b.cfg.addTotal(collapsed.underflow.count, collapsed.overflow.count)
+	for _, layer := range table.layers {
+		total = b.cfg.addTotal(total, layer.loadCount())
 	}
-	b.m.RUnlock()
 	return total
 }
 
+// TotalWeight returns the weight of all the observations, see UnSyncBuckets.InsertWeighted.
+func (b *SyncBuckets) TotalWeight() float64 {
+	table, collapsed := b.load()
+	var weight neumaierSum
+	weight.add(float64(collapsed.underflow.count) + collapsed.underflow.extra)
+	weight.add(float64(collapsed.overflow.count) + collapsed.overflow.extra)
+	for _, layer := range table.layers {
+		weight.add(float64(layer.loadCount()))
+		weight.add(layer.copyExtra().sum())
+	}
+	return weight.value()
+}
+
 func (b *SyncBuckets) Sum() float64 {
-	sum := 0.0
-	b.m.RLock()
-	for i := range b.layers {
-		sum += atomicLoadFloat64(&b.layers[i].sum)
+	table, collapsed := b.load()
+	sum := collapsed.sum()
+	for _, layer := range table.layers {
+		stats := layer.loadStats()
+		sum.add(stats.sum)
+		sum.add(stats.sumComp)
 	}
-	b.m.RUnlock()
-	return sum
+	return sum.value()
 }
 
 func (b *SyncBuckets) Count(f float64) uint64 {
-	lpf := FromFloat64(f)
-	b.m.RLock()
-	for i := range b.layers {
-		layer := &b.layers[i]
-		if layer.signAndExp != lpf.SignAndExp {
-			continue
-		}
-		count := atomic.LoadUint64(&layer.buckets[lpf.Fraction])
-		b.m.RUnlock()
-		return count
+	if b.cfg.nonFinite(f) {
+		nonFinite := b.nonFinite.atomicLoad()
+		return *nonFinite.counter(f)
+	}
+	lpf := b.cfg.lpFloat(f)
+	if layer := b.loadTable().get(lpf.SignAndExp); layer != nil {
+		return atomic.LoadUint64(&layer.buckets[lpf.Fraction])
 	}
-	b.m.RUnlock()
 	return 0
 }
 
+// Range visits the buckets of a snapshot, so do never blocks writers and may insert into b.
 func (b *SyncBuckets) Range(do func(Bucket)) {
-	//  locks writing to ensure consistency
-	b.m.Lock()
-	defer b.m.Unlock()
-
-	for i := range b.layers {
-		layer := &b.layers[i]
-		for fraction, count := range layer.buckets {
-			if count == 0 {
-				continue
-			}
-			do(Bucket{Value: compose(layer.signAndExp, uint8(fraction)), Count: count})
-		}
-	}
+	b.Snapshot().Range(do)
 }
 
+// ReverseRange visits the buckets of a snapshot, so do never blocks writers and may insert into b.
 func (b *SyncBuckets) ReverseRange(do func(Bucket)) {
-	//  locks writing to ensure consistency
-	b.m.Lock()
-	defer b.m.Unlock()
+	b.Snapshot().ReverseRange(do)
+}
 
-	layersLen := len(b.layers)
-	for i := range b.layers {
-		layer := &b.layers[layersLen-i-1]
-		for i := range layer.buckets {
-			fraction := 0xff - i
-			count := layer.buckets[fraction]
-			if count == 0 {
-				continue
-			}
-			do(Bucket{Value: compose(layer.signAndExp, uint8(fraction)), Count: count})
-		}
-	}
+func (b *SyncBuckets) RangeWhile(do func(Bucket) bool) {
+	b.Snapshot().RangeWhile(do)
+}
+
+func (b *SyncBuckets) ReverseRangeWhile(do func(Bucket) bool) {
+	b.Snapshot().ReverseRangeWhile(do)
+}
+
+func (b *SyncBuckets) RangeBetween(lo, hi float64, do func(Bucket) bool) {
+	b.Snapshot().RangeBetween(lo, hi, do)
+}
+
+// Iterator walks a snapshot of the buckets.
+func (b *SyncBuckets) Iterator() *Iterator {
+	return b.Snapshot().Iterator()
+}
+
+// ReverseIterator walks a snapshot of the buckets.
+func (b *SyncBuckets) ReverseIterator() *Iterator {
+	return b.Snapshot().ReverseIterator()
 }
 
 func (b *SyncBuckets) Buckets() []Bucket {
@@ -136,64 +578,108 @@ func (b *SyncBuckets) Buckets() []Bucket {
 	return buckets
 }
 
-func (b *SyncBuckets) Summary(percentilesCfg []float32) Summary {
-	if percentilesCfg == nil {
-		percentilesCfg = DefaultPercentilesCfg()
+// Snapshot returns a copy of the buckets taken without blocking writers.
+// The counts of each layer are consistent with its buckets,
+// but the sums may partially reflect inserts running meanwhile.
+func (b *SyncBuckets) Snapshot() *UnSyncBuckets {
+	table, collapsed := b.load()
+	snapshot := &UnSyncBuckets{
+		cfg:       b.cfg,
+		layers:    make([]f64BucketsLayer, len(table.layers)),
+		collapsed: collapsed,
+		nonFinite: b.nonFinite.atomicLoad(),
+		weighted:  atomic.LoadUint32(&b.weighted) != 0,
+		clamped:   atomic.LoadUint32(&b.clamped) != 0,
 	}
-	if err := CheckPercentilesCfg(percentilesCfg); err != nil {
-		panic(fmt.Errorf("invalid percentiles cfg %v: %s", percentilesCfg, err))
+	for i, layer := range table.layers {
+		copied := &snapshot.layers[i]
+		copied.signAndExp = layer.signAndExp
+		copied.layerStats = layer.loadStats()
+		copied.count = 0
+		for j := range layer.buckets {
+			copied.buckets[j] = atomic.LoadUint64(&layer.buckets[j])
+			copied.count = b.cfg.addTotal(copied.count, copied.buckets[j])
+		}
+		copied.extra = layer.copyExtra()
+		snapshot.index.set(copied.signAndExp, i)
 	}
+	return snapshot
+}
 
-	summary := makeSummary(percentilesCfg)
-	var sum float64
-	var percentileIdx int
+func (b *SyncBuckets) Summary(percentilesCfg []float32) Summary {
+	return b.Snapshot().Summary(percentilesCfg)
+}
+
+// Reset clears the buckets, inserts running meanwhile may be partially kept.
+func (b *SyncBuckets) Reset() {
+	b.ResetWith(ResetKeepLayers)
+}
 
-	//  locks writing to ensure consistency
+// ResetWith clears the buckets, inserts running meanwhile may be partially kept.
+// With ResetReleaseLayers, the inserts still holding a released layer move to the new ones.
+func (b *SyncBuckets) ResetWith(mode ResetMode) {
 	b.m.Lock()
-	total := uint64(0)
-	for i := range b.layers {
-		total += b.layers[i].count
-	}
-	for i := range b.layers {
-		layer := &b.layers[i]
-		sum += layer.sum
-		for fraction, count := range layer.buckets {
-			if count == 0 {
-				continue
-			}
+	defer b.m.Unlock()
 
-			lpf := compose(layer.signAndExp, uint8(fraction))
-			if summary.Total == 0 {
-				summary.Min = lpf
-			}
-			summary.Total += count
-			if summary.Total == total {
-				summary.Max = lpf
-			}
-			for percentileIdx < len(percentilesCfg) &&
-				float64(summary.Total)*100 >= float64(total)*float64(percentilesCfg[percentileIdx]) {
-				summary.Percentiles[percentileIdx].LessThan = lpf
-				percentileIdx++
-			}
+	if mode == ResetReleaseLayers {
+		released := b.loadTable().layers
+		b.table.Store(emptySyncLayerTable)
+		for _, layer := range released {
+			layer.retire()
+		}
+	} else {
+		for _, layer := range b.loadTable().layers {
+			layer.reset()
 		}
 	}
-	b.m.Unlock()
-
-	summary.Sum = FromFloat64(sum)
-	summary.Avg = FromFloat64(sum / float64(summary.Total))
-	return summary
+	b.collapsed.reset()
+	b.nonFinite.atomicReset()
+	atomic.StoreUint32(&b.weighted, 0)
+	atomic.StoreUint32(&b.clamped, 0)
 }
 
-func (b *SyncBuckets) Reset() {
+// Compact drops the empty layers without losing the inserts running meanwhile:
+// a dropped layer which got some before retiring is put back.
+func (b *SyncBuckets) Compact() {
 	b.m.Lock()
 	defer b.m.Unlock()
 
-	for i := range b.layers {
-		layer := &b.layers[i]
-		layer.buckets = emptyBuckets
-		layer.count = 0
-		layer.sum = 0
+	table := b.loadTable()
+	kept := make([]*syncLayer, 0, len(table.layers))
+	var dropped []*syncLayer
+	for _, layer := range table.layers {
+		if layer.loadCount() == 0 {
+			dropped = append(dropped, layer)
+		} else {
+			kept = append(kept, layer)
+		}
 	}
+	if len(dropped) == 0 {
+		return
+	}
+	table = makeSyncLayerTable(kept)
+	b.table.Store(table)
+	for _, layer := range dropped {
+		layer.retire()
+		if layer.loadCount() != 0 {
+			table = table.with(layer.revive())
+		}
+	}
+	b.table.Store(table)
+}
+
+// MemoryUsage returns the approximate number of bytes held by the buckets.
+func (b *SyncBuckets) MemoryUsage() uint64 {
+	table := b.loadTable()
+	usage := uint64(unsafe.Sizeof(*b)) + uint64(unsafe.Sizeof(*table)) +
+		uint64(cap(table.layers))*uint64(unsafe.Sizeof(&syncLayer{})+unsafe.Sizeof(syncLayer{})) +
+		table.index.memoryUsage()
+	for _, layer := range table.layers {
+		if layer.loadExtra(false) != nil {
+			usage += uint64(unsafe.Sizeof(extraWeights{}))
+		}
+	}
+	return usage
 }
 
 func atomicAddFloat64(p *float64, val float64) {
@@ -207,6 +693,31 @@ func atomicAddFloat64(p *float64, val float64) {
 	}
 }
 
+// atomicFitAdd adds count to *p as told by BucketsCfg.CountOverflow,
+// it returns how many have been added and whether *p overflowed.
+func atomicFitAdd(cfg *BucketsCfg, p *uint64, count uint64) (fit uint64, overflow bool) {
+	for {
+		held := atomic.LoadUint64(p)
+		fit, overflow = cfg.fitCount(held, count)
+		if fit == 0 || atomic.CompareAndSwapUint64(p, held, held+fit) {
+			return fit, overflow
+		}
+	}
+}
+
+// atomicSubUint64 subtracts count from *p unless it would go below zero, it returns the value subtracted from.
+func atomicSubUint64(p *uint64, f float64, count uint64) (held uint64, err error) {
+	for {
+		held = atomic.LoadUint64(p)
+		if held < count {
+			return held, countUnderflowError(f, count, held)
+		}
+		if atomic.CompareAndSwapUint64(p, held, held-count) {
+			return held, nil
+		}
+	}
+}
+
 func atomicLoadFloat64(p *float64) float64 {
 	return math.Float64frombits(atomic.LoadUint64((*uint64)(unsafe.Pointer(p))))
 }
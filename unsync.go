@@ -1,124 +1,310 @@
 package lpfloat
 
-import (
-	"fmt"
-	"sort"
-)
+import "unsafe"
 
 type UnSyncBuckets struct {
-	layers []f64BucketsLayer
+	cfg       BucketsCfg
+	layers    []f64BucketsLayer // ordered by value
+	index     layerIndex
+	collapsed collapsedBuckets
+	nonFinite nonFiniteCounts
+	weighted  bool // set by InsertWeighted
+	clamped   bool // set when BucketsCfg.CountOverflow dropped observations
 }
 
-type f64BucketsLayer struct {
-	count      uint64
-	sum        float64
-	signAndExp int16
-	buckets    [256]uint64
-}
-
-func (l *f64BucketsLayer) unit() float64 {
-	return compose(l.signAndExp, _One.Fraction).ToFloat64()
+func NewUnSyncBuckets(cfg BucketsCfg) *UnSyncBuckets {
+	mustCheckBucketsCfg(cfg)
+	return &UnSyncBuckets{cfg: cfg}
 }
 
 func (b *UnSyncBuckets) Insert(f float64) {
-	lpf := FromFloat64(f)
-	for i := range b.layers {
+	if b.cfg.CountOverflow != CountOverflowWrap {
+		_ = b.insert(f, 1, 1)
+		return
+	}
+	if b.cfg.nonFinite(f) {
+		b.nonFinite.add(f, 1)
+		return
+	}
+	lpf := b.cfg.lpFloat(f)
+	if i := b.index.get(lpf.SignAndExp); i >= 0 {
 		layer := &b.layers[i]
-		if layer.signAndExp == lpf.SignAndExp {
-			layer.count++
-			layer.sum += f
-			layer.buckets[lpf.Fraction]++
-			return
-		}
+		layer.add(f, 1, b.cfg.CompensatedSum)
+		layer.buckets[lpf.Fraction]++
+		return
 	}
 
 	// cold path
-	newLayer := f64BucketsLayer{signAndExp: lpf.SignAndExp}
+	if c := b.collapse(lpf); c != nil {
+		c.add(f, 1, 1)
+		return
+	}
+	newLayer := f64BucketsLayer{layerStats: makeLayerStats(f), signAndExp: lpf.SignAndExp}
+	newLayer.add(f, 1, b.cfg.CompensatedSum)
 	newLayer.buckets[lpf.Fraction]++
-	newLayer.count++
-	newLayer.sum += f
-	b.layers = append(b.layers, newLayer)
-	sort.Slice(b.layers, func(i, j int) bool {
-		return b.layers[i].unit() < b.layers[j].unit()
-	})
+	b.layers = insertLayer(b.layers, &b.index, newLayer)
 }
 
 func (b *UnSyncBuckets) InsertN(f float64, count uint64) {
-	lpf := FromFloat64(f)
-	for i := range b.layers {
+	if b.cfg.CountOverflow != CountOverflowWrap {
+		_ = b.insert(f, count, float64(count))
+		return
+	}
+	if b.cfg.nonFinite(f) {
+		b.nonFinite.add(f, count)
+		return
+	}
+	lpf := b.cfg.lpFloat(f)
+	if i := b.index.get(lpf.SignAndExp); i >= 0 {
 		layer := &b.layers[i]
-		if layer.signAndExp == lpf.SignAndExp {
-			layer.buckets[lpf.Fraction] += count
-			layer.count += count
-			layer.sum += float64(count) * f
-			return
-		}
+		layer.add(f, count, b.cfg.CompensatedSum)
+		layer.buckets[lpf.Fraction] += count
+		return
 	}
 
 	// cold path
-	newLayer := f64BucketsLayer{signAndExp: lpf.SignAndExp}
+	if c := b.collapse(lpf); c != nil {
+		c.add(f, count, float64(count))
+		return
+	}
+	newLayer := f64BucketsLayer{layerStats: makeLayerStats(f), signAndExp: lpf.SignAndExp}
+	newLayer.add(f, count, b.cfg.CompensatedSum)
 	newLayer.buckets[lpf.Fraction] += count
-	newLayer.count += count
-	newLayer.sum += float64(count) * f
-	b.layers = append(b.layers, newLayer)
-	sort.Slice(b.layers, func(i, j int) bool {
-		return b.layers[i].unit() < b.layers[j].unit()
-	})
+	b.layers = insertLayer(b.layers, &b.index, newLayer)
+}
+
+// InsertWeighted inserts an observation of f weighing weight, e.g. the sampling rate of sampled
+// traffic, where the other observations weigh 1. Sum becomes the weighted sum, and once weighted
+// observations are inserted Summary reports their TotalWeight and weighted Avg, moments and percentiles.
+// The weight must be positive and finite.
+func (b *UnSyncBuckets) InsertWeighted(f, weight float64) {
+	mustCheckWeight(weight)
+	b.weighted = true
+	_ = b.insert(f, 1, weight)
+}
+
+func (b *UnSyncBuckets) InsertNE(f float64, count uint64) error {
+	return b.insert(f, count, float64(count))
+}
+
+// insert adds count observations of f weighing weight altogether,
+// checking the counters as told by BucketsCfg.CountOverflow.
+func (b *UnSyncBuckets) insert(f float64, count uint64, weight float64) error {
+	if b.cfg.nonFinite(f) {
+		counter := b.nonFinite.counter(f)
+		fit, overflow := b.cfg.fitCount(*counter, count)
+		*counter += fit
+		return b.overflowed(f, count, overflow)
+	}
+	lpf := b.cfg.lpFloat(f)
+	if i := b.index.get(lpf.SignAndExp); i >= 0 {
+		layer := &b.layers[i]
+		fit, overflow := b.cfg.fitCounts(layer.buckets[lpf.Fraction], layer.count, count)
+		if fit != 0 {
+			layer.addWeight(f, lpf.Fraction, fit, fitWeight(weight, fit, count), b.cfg.CompensatedSum)
+		}
+		return b.overflowed(f, count, overflow)
+	}
+
+	// cold path
+	if c := b.collapse(lpf); c != nil {
+		fit, overflow := b.cfg.fitCount(c.count, count)
+		if fit != 0 {
+			c.add(f, fit, fitWeight(weight, fit, count))
+		}
+		return b.overflowed(f, count, overflow)
+	}
+	newLayer := f64BucketsLayer{layerStats: makeLayerStats(f), signAndExp: lpf.SignAndExp}
+	newLayer.addWeight(f, lpf.Fraction, count, weight, b.cfg.CompensatedSum)
+	b.layers = insertLayer(b.layers, &b.index, newLayer)
+	return nil
+}
+
+func (b *UnSyncBuckets) overflowed(f float64, count uint64, overflow bool) error {
+	if !overflow {
+		return nil
+	}
+	b.clamped = b.clamped || b.cfg.clamps()
+	return b.cfg.overflowed(f, count)
+}
+
+func (b *UnSyncBuckets) Remove(f float64) error {
+	return b.RemoveN(f, 1)
+}
+
+func (b *UnSyncBuckets) RemoveN(f float64, count uint64) error {
+	if b.cfg.nonFinite(f) {
+		return b.nonFinite.remove(f, count)
+	}
+	lpf := b.cfg.lpFloat(f)
+	if i := b.index.get(lpf.SignAndExp); i >= 0 {
+		layer := &b.layers[i]
+		if held := layer.buckets[lpf.Fraction]; held < count {
+			return countUnderflowError(f, count, held)
+		}
+		extra := layer.extra.take(lpf.Fraction, count, layer.buckets[lpf.Fraction])
+		layer.buckets[lpf.Fraction] -= count
+		layer.remove(f, count, float64(count)+extra, b.cfg.CompensatedSum)
+		return nil
+	}
+	return b.collapsed.remove(f, lpf, count)
+}
+
+// collapse applies BucketsCfg.MaxLayers before adding the layer of lpf,
+// it returns the underflow or overflow bucket if the value has to be collapsed into it.
+func (b *UnSyncBuckets) collapse(lpf LPFloat) *collapsedBucket {
+	if b.cfg.MaxLayers == 0 || len(b.layers) < b.cfg.MaxLayers {
+		return nil
+	}
+	if b.collapsed.admits(lpf.SignAndExp) {
+		// empty layers, e.g. kept by Reset, make room first
+		for i := range b.layers {
+			if b.layers[i].count == 0 {
+				b.layers = removeLayer(b.layers, &b.index, i)
+				return nil
+			}
+		}
+	}
+	lowest, highest := &b.layers[0], &b.layers[len(b.layers)-1]
+	switch decideCollapse(lpf.SignAndExp, lowest.signAndExp, highest.signAndExp, lowest.count, highest.count) {
+	case collapseUnderflow:
+		return &b.collapsed.underflow
+	case collapseOverflow:
+		return &b.collapsed.overflow
+	case collapseEvictLowest:
+		min, max := lowest.valueRange()
+		b.collapsed.underflow.addLayer(&lowest.layerStats, lowest.extra.sum(), min, max)
+		b.layers = removeLayer(b.layers, &b.index, 0)
+	case collapseEvictHighest:
+		min, max := highest.valueRange()
+		b.collapsed.overflow.addLayer(&highest.layerStats, highest.extra.sum(), min, max)
+		b.layers = removeLayer(b.layers, &b.index, len(b.layers)-1)
+	}
+	return nil
+}
+
+// merge adds the observations of o, ignoring BucketsCfg.MaxLayers.
+func (b *UnSyncBuckets) merge(o *UnSyncBuckets) {
+	b.collapsed.underflow.mergeBucket(&o.collapsed.underflow)
+	b.collapsed.overflow.mergeBucket(&o.collapsed.overflow)
+	b.nonFinite.merge(&o.nonFinite)
+	b.weighted = b.weighted || o.weighted
+	b.clamped = b.clamped || o.clamped
+	for i := range o.layers {
+		src := &o.layers[i]
+		j := b.index.get(src.signAndExp)
+		if j < 0 {
+			b.layers = insertLayer(b.layers, &b.index, *src)
+			j = b.index.get(src.signAndExp)
+			b.layers[j].extra = nil
+		} else {
+			b.layers[j].merge(&src.layerStats)
+			for fraction := range src.buckets {
+				b.layers[j].buckets[fraction] += src.buckets[fraction]
+			}
+		}
+		if src.extra != nil {
+			dst := &b.layers[j]
+			if dst.extra == nil {
+				dst.extra = new(extraWeights)
+			}
+			for fraction := range src.extra {
+				dst.extra[fraction] += src.extra[fraction]
+			}
+		}
+	}
 }
 
 func (b *UnSyncBuckets) Total() uint64 {
-	total := uint64(0)
+	total := b.cfg.addTotal(b.collapsed.underflow.count, b.collapsed.overflow.count)
 	for i := range b.layers {
-		total += b.layers[i].count
+		total = b.cfg.addTotal(total, b.layers[i].count)
 	}
 	return total
 }
 
+// TotalWeight returns the weight of all the observations, see InsertWeighted.
+func (b *UnSyncBuckets) TotalWeight() float64 {
+	var weight neumaierSum
+	weight.add(float64(b.collapsed.underflow.count) + b.collapsed.underflow.extra)
+	weight.add(float64(b.collapsed.overflow.count) + b.collapsed.overflow.extra)
+	for i := range b.layers {
+		weight.add(float64(b.layers[i].count))
+		weight.add(b.layers[i].extra.sum())
+	}
+	return weight.value()
+}
+
 func (b *UnSyncBuckets) Sum() float64 {
-	sum := 0.0
+	sum := b.collapsed.sum()
 	for i := range b.layers {
-		sum += b.layers[i].sum
+		sum.add(b.layers[i].sum)
+		sum.add(b.layers[i].sumComp)
 	}
-	return sum
+	return sum.value()
 }
 
 func (b *UnSyncBuckets) Count(f float64) uint64 {
-	lpf := FromFloat64(f)
-	for i := range b.layers {
-		layer := &b.layers[i]
-		if layer.signAndExp != lpf.SignAndExp {
-			continue
-		}
-		return layer.buckets[lpf.Fraction]
+	if b.cfg.nonFinite(f) {
+		return *b.nonFinite.counter(f)
+	}
+	lpf := b.cfg.lpFloat(f)
+	if i := b.index.get(lpf.SignAndExp); i >= 0 {
+		return b.layers[i].buckets[lpf.Fraction]
 	}
 	return 0
 }
 
 func (b *UnSyncBuckets) Range(do func(Bucket)) {
-	for i := range b.layers {
-		layer := &b.layers[i]
-		for fraction, count := range layer.buckets {
-			if count == 0 {
-				continue
-			}
-			do(Bucket{Value: compose(layer.signAndExp, uint8(fraction)), Count: count})
-		}
-	}
+	b.RangeWhile(func(bucket Bucket) bool {
+		do(bucket)
+		return true
+	})
 }
 
 func (b *UnSyncBuckets) ReverseRange(do func(Bucket)) {
-	layersLen := len(b.layers)
-	for i := range b.layers {
-		layer := &b.layers[layersLen-i-1]
-		for i := range layer.buckets {
-			fraction := 0xff - i
-			count := layer.buckets[fraction]
-			if count == 0 {
-				continue
-			}
-			do(Bucket{Value: compose(layer.signAndExp, uint8(fraction)), Count: count})
-		}
-	}
+	b.ReverseRangeWhile(func(bucket Bucket) bool {
+		do(bucket)
+		return true
+	})
+}
+
+func (b *UnSyncBuckets) RangeWhile(do func(Bucket) bool) {
+	rangeWhile(b, false, do)
+}
+
+func (b *UnSyncBuckets) ReverseRangeWhile(do func(Bucket) bool) {
+	rangeWhile(b, true, do)
+}
+
+func (b *UnSyncBuckets) RangeBetween(lo, hi float64, do func(Bucket) bool) {
+	rangeBetween(b, b.cfg.lpFloat(lo), b.cfg.lpFloat(hi), do)
+}
+
+func (b *UnSyncBuckets) Iterator() *Iterator {
+	return &Iterator{cursor: newLayersCursor(b, false)}
+}
+
+func (b *UnSyncBuckets) ReverseIterator() *Iterator {
+	return &Iterator{cursor: newLayersCursor(b, true)}
+}
+
+func (b *UnSyncBuckets) layersLen() int {
+	return len(b.layers)
+}
+
+func (b *UnSyncBuckets) layerRankAt(layer int) int32 {
+	return layerRank(b.layers[layer].signAndExp)
+}
+
+func (b *UnSyncBuckets) layerLen(int) int {
+	return len(emptyBuckets)
+}
+
+func (b *UnSyncBuckets) bucketAt(layer, i int) Bucket {
+	l := &b.layers[layer]
+	fraction := l.fractionAt(i)
+	return Bucket{Value: compose(l.signAndExp, fraction), Count: l.buckets[fraction]}
 }
 
 func (b *UnSyncBuckets) Buckets() []Bucket {
@@ -130,51 +316,78 @@ func (b *UnSyncBuckets) Buckets() []Bucket {
 }
 
 func (b *UnSyncBuckets) Summary(percentilesCfg []float32) Summary {
-	if percentilesCfg == nil {
-		percentilesCfg = DefaultPercentilesCfg()
+	builder := newSummaryBuilder(percentilesCfg, b.Total())
+	if b.weighted {
+		builder = newWeightedSummaryBuilder(percentilesCfg, b.Total(), b.TotalWeight())
 	}
-	if err := CheckPercentilesCfg(percentilesCfg); err != nil {
-		panic(fmt.Errorf("invalid percentiles cfg %v: %s", percentilesCfg, err))
-	}
-
-	summary := makeSummary(percentilesCfg)
-	var sum float64
-	var percentileIdx int
-
-	total := b.Total()
+	builder.addUnderflow(&b.collapsed.underflow)
 	for i := range b.layers {
 		layer := &b.layers[i]
-		sum += layer.sum
-		for fraction, count := range layer.buckets {
+		builder.addLayer(&layer.layerStats, layer.extra.sum())
+		for j := range layer.buckets {
+			fraction := layer.fractionAt(j)
+			count := layer.buckets[fraction]
 			if count == 0 {
 				continue
 			}
-
-			lpf := compose(layer.signAndExp, uint8(fraction))
-			if summary.Total == 0 {
-				summary.Min = lpf
-			}
-			summary.Total += count
-			if summary.Total == total {
-				summary.Max = lpf
-			}
-			for percentileIdx < len(percentilesCfg) &&
-				float64(summary.Total)*100 >= float64(total)*float64(percentilesCfg[percentileIdx]) {
-				summary.Percentiles[percentileIdx].LessThan = lpf
-				percentileIdx++
+			if b.weighted {
+				builder.addWeightedBucket(compose(layer.signAndExp, fraction), count,
+					float64(count)+layer.extra.get(fraction))
+			} else {
+				builder.addBucket(compose(layer.signAndExp, fraction), count)
 			}
 		}
 	}
-	summary.Sum = FromFloat64(sum)
-	summary.Avg = FromFloat64(sum / float64(summary.Total))
-	return summary
+	builder.addOverflow(&b.collapsed.overflow)
+	builder.addNonFinite(&b.nonFinite)
+	builder.addClamped(b.clamped)
+	return builder.build()
 }
 
 func (b *UnSyncBuckets) Reset() {
+	b.ResetWith(ResetKeepLayers)
+}
+
+func (b *UnSyncBuckets) ResetWith(mode ResetMode) {
+	b.collapsed.reset()
+	b.nonFinite = nonFiniteCounts{}
+	b.weighted = false
+	b.clamped = false
+	if mode == ResetReleaseLayers {
+		b.layers = nil
+		b.index = layerIndex{}
+		return
+	}
 	for i := range b.layers {
 		layer := &b.layers[i]
 		layer.buckets = emptyBuckets
-		layer.count = 0
-		layer.sum = 0
+		layer.extra = nil
+		layer.reset()
+	}
+}
+
+func (b *UnSyncBuckets) Compact() {
+	var layers []f64BucketsLayer
+	b.index = layerIndex{}
+	for i := range b.layers {
+		if b.layers[i].count == 0 {
+			continue
+		}
+		layers = append(layers, b.layers[i])
+		b.index.set(b.layers[i].signAndExp, len(layers)-1)
+	}
+	b.layers = layers
+}
+
+// MemoryUsage returns the approximate number of bytes held by the buckets.
+func (b *UnSyncBuckets) MemoryUsage() uint64 {
+	usage := uint64(unsafe.Sizeof(*b)) +
+		uint64(cap(b.layers))*uint64(unsafe.Sizeof(f64BucketsLayer{})) +
+		b.index.memoryUsage()
+	for i := range b.layers {
+		if b.layers[i].extra != nil {
+			usage += uint64(unsafe.Sizeof(extraWeights{}))
+		}
 	}
+	return usage
 }
@@ -0,0 +1,234 @@
+package lpfloat
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WindowCfg configures windowed buckets: a ring of Intervals sub-histograms, each collecting
+// the observations of one Interval, so the window covers the last Intervals * Interval.
+type WindowCfg struct {
+	Interval  time.Duration
+	Intervals int
+	Buckets   BucketsCfg
+	// Now returns the current time, time.Now if nil. Tests inject fake clocks here.
+	Now func() time.Time
+}
+
+func CheckWindowCfg(cfg WindowCfg) error {
+	if cfg.Interval <= 0 {
+		return errors.New("the interval should be positive")
+	}
+	if cfg.Intervals <= 0 {
+		return errors.New("the intervals should be positive")
+	}
+	return CheckBucketsCfg(cfg.Buckets)
+}
+
+func mustCheckWindowCfg(cfg WindowCfg) {
+	if err := CheckWindowCfg(cfg); err != nil {
+		panic(fmt.Errorf("invalid window cfg %+v: %s", cfg, err))
+	}
+}
+
+// noEpoch marks the slots which never collected anything.
+const noEpoch = math.MinInt64
+
+// epoch returns the number of the interval now falls into.
+func (cfg *WindowCfg) epoch() int64 {
+	now := time.Now
+	if cfg.Now != nil {
+		now = cfg.Now
+	}
+	return floorDiv(now().UnixNano(), int64(cfg.Interval))
+}
+
+// slot returns the position in the ring of the interval epoch.
+func (cfg *WindowCfg) slot(epoch int64) int {
+	slot := epoch % int64(cfg.Intervals)
+	if slot < 0 {
+		slot += int64(cfg.Intervals)
+	}
+	return int(slot)
+}
+
+// lastEpochs returns how many intervals, the current one included, cover the last d.
+func (cfg *WindowCfg) lastEpochs(d time.Duration) int64 {
+	if d <= 0 || d >= cfg.Interval*time.Duration(cfg.Intervals) {
+		return int64(cfg.Intervals)
+	}
+	return int64((d + cfg.Interval - 1) / cfg.Interval)
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+// UnSyncWindowedBuckets is a rolling histogram of the last WindowCfg.Intervals intervals.
+type UnSyncWindowedBuckets struct {
+	cfg   WindowCfg
+	slots []unSyncWindowSlot
+}
+
+type unSyncWindowSlot struct {
+	epoch   int64
+	buckets *UnSyncBuckets
+}
+
+func NewUnSyncWindowedBuckets(cfg WindowCfg) *UnSyncWindowedBuckets {
+	mustCheckWindowCfg(cfg)
+	w := &UnSyncWindowedBuckets{cfg: cfg, slots: make([]unSyncWindowSlot, cfg.Intervals)}
+	for i := range w.slots {
+		w.slots[i] = unSyncWindowSlot{epoch: noEpoch, buckets: NewUnSyncBuckets(cfg.Buckets)}
+	}
+	return w
+}
+
+func (w *UnSyncWindowedBuckets) Insert(f float64) {
+	w.InsertN(f, 1)
+}
+
+func (w *UnSyncWindowedBuckets) InsertN(f float64, count uint64) {
+	epoch := w.cfg.epoch()
+	slot := &w.slots[w.cfg.slot(epoch)]
+	if slot.epoch != epoch {
+		if slot.epoch > epoch {
+			// the clock went back past the window
+			return
+		}
+		slot.buckets.Reset()
+		slot.epoch = epoch
+	}
+	slot.buckets.InsertN(f, count)
+}
+
+// Snapshot merges the intervals covering the last d, the current one included, into new buckets.
+// d is rounded up to whole intervals, 0 means the whole window.
+func (w *UnSyncWindowedBuckets) Snapshot(d time.Duration) *UnSyncBuckets {
+	epoch := w.cfg.epoch()
+	merged := &UnSyncBuckets{cfg: w.cfg.Buckets}
+	for i := int64(0); i < w.cfg.lastEpochs(d); i++ {
+		if slot := &w.slots[w.cfg.slot(epoch-i)]; slot.epoch == epoch-i {
+			merged.merge(slot.buckets)
+		}
+	}
+	return merged
+}
+
+// Summary summarizes the whole window.
+func (w *UnSyncWindowedBuckets) Summary(percentilesCfg []float32) Summary {
+	return w.SummaryOver(0, percentilesCfg)
+}
+
+// SummaryOver summarizes the last d, see Snapshot.
+func (w *UnSyncWindowedBuckets) SummaryOver(d time.Duration, percentilesCfg []float32) Summary {
+	return w.Snapshot(d).Summary(percentilesCfg)
+}
+
+func (w *UnSyncWindowedBuckets) Reset() {
+	for i := range w.slots {
+		w.slots[i].epoch = noEpoch
+		w.slots[i].buckets.Reset()
+	}
+}
+
+// SyncWindowedBuckets is UnSyncWindowedBuckets safe for concurrent use. Inserts are lock-free,
+// except for the first one of each interval which takes a lock to recycle the oldest sub-histogram.
+type SyncWindowedBuckets struct {
+	cfg   WindowCfg
+	m     sync.Mutex        // serializes rotations
+	slots []*syncWindowSlot // pointers keep the epochs 64-bit aligned
+}
+
+type syncWindowSlot struct {
+	epoch   int64 // atomic, noEpoch while the buckets are reset for the next one
+	buckets *SyncBuckets
+}
+
+func NewSyncWindowedBuckets(cfg WindowCfg) *SyncWindowedBuckets {
+	mustCheckWindowCfg(cfg)
+	w := &SyncWindowedBuckets{cfg: cfg, slots: make([]*syncWindowSlot, cfg.Intervals)}
+	for i := range w.slots {
+		w.slots[i] = &syncWindowSlot{epoch: noEpoch, buckets: NewSyncBuckets(cfg.Buckets)}
+	}
+	return w
+}
+
+func (w *SyncWindowedBuckets) Insert(f float64) {
+	w.InsertN(f, 1)
+}
+
+// InsertN inserts into the current interval. An insert running across the recycling of its
+// sub-histogram, which takes a whole window to come round, may land in the new interval.
+func (w *SyncWindowedBuckets) InsertN(f float64, count uint64) {
+	epoch := w.cfg.epoch()
+	slot := w.slots[w.cfg.slot(epoch)]
+	if atomic.LoadInt64(&slot.epoch) != epoch && !w.rotate(slot, epoch) {
+		return
+	}
+	slot.buckets.InsertN(f, count)
+}
+
+// rotate recycles the slot for epoch, it reports false if the slot already moved past it.
+func (w *SyncWindowedBuckets) rotate(slot *syncWindowSlot, epoch int64) bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	current := atomic.LoadInt64(&slot.epoch)
+	if current < epoch {
+		// snapshots copying the old interval must see it invalidated before any of it is reset
+		atomic.StoreInt64(&slot.epoch, noEpoch)
+		slot.buckets.Reset()
+		atomic.StoreInt64(&slot.epoch, epoch)
+		return true
+	}
+	return current == epoch
+}
+
+// Snapshot merges the intervals covering the last d, the current one included, into new buckets
+// without blocking writers. d is rounded up to whole intervals, 0 means the whole window.
+func (w *SyncWindowedBuckets) Snapshot(d time.Duration) *UnSyncBuckets {
+	epoch := w.cfg.epoch()
+	merged := &UnSyncBuckets{cfg: w.cfg.Buckets}
+	for i := int64(0); i < w.cfg.lastEpochs(d); i++ {
+		slot := w.slots[w.cfg.slot(epoch-i)]
+		if atomic.LoadInt64(&slot.epoch) != epoch-i {
+			continue
+		}
+		snapshot := slot.buckets.Snapshot()
+		if atomic.LoadInt64(&slot.epoch) == epoch-i {
+			// not recycled while copying
+			merged.merge(snapshot)
+		}
+	}
+	return merged
+}
+
+// Summary summarizes the whole window.
+func (w *SyncWindowedBuckets) Summary(percentilesCfg []float32) Summary {
+	return w.SummaryOver(0, percentilesCfg)
+}
+
+// SummaryOver summarizes the last d, see Snapshot.
+func (w *SyncWindowedBuckets) SummaryOver(d time.Duration, percentilesCfg []float32) Summary {
+	return w.Snapshot(d).Summary(percentilesCfg)
+}
+
+// Reset clears the window, inserts running meanwhile may be partially kept.
+func (w *SyncWindowedBuckets) Reset() {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	for i := range w.slots {
+		atomic.StoreInt64(&w.slots[i].epoch, noEpoch)
+		w.slots[i].buckets.Reset()
+	}
+}